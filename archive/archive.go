@@ -0,0 +1,293 @@
+package archive
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// blockSize is the tar block size, all headers and file contents are padded to its multiple.
+const blockSize = 512
+
+// entry is a single walked entry of a directory tree.
+type entry struct {
+	// path is the location of the entry on disk.
+	path string
+
+	// hdr is the tar header of the entry, recorded when walking the tree.
+	hdr *tar.Header
+}
+
+// counter is an io.Writer that only counts the bytes written to it.
+type counter int
+
+// NewReader returns a new io.ReadCloser streaming a tar archive of the directory tree rooted at dir, along with its exact size.
+// Permissions, modification times, ownership and symlinks are preserved. Symlinks are never followed.
+//
+// The tree is walked once up front and the archive holds exactly the entries seen then, so that the size is known before
+// the upload starts. Files that grow meanwhile are cut to their recorded size, files that shrink fail the archive.
+func NewReader(dir string) (r io.ReadCloser, size int, err error) {
+	var entries []entry
+	entries, err = walk(dir)
+	if err != nil {
+		return
+	}
+
+	for _, e := range entries {
+		var n int
+		n, err = headerSize(e.hdr)
+		if err != nil {
+			return
+		}
+		size += n + int((e.hdr.Size+blockSize-1)/blockSize*blockSize)
+	}
+	size += 2 * blockSize
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(write(pw, entries))
+	}()
+
+	return pr, size, nil
+}
+
+// walk collects the headers of all entries of the directory tree, skipping sockets.
+func walk(dir string) (entries []entry, err error) {
+	err = filepath.Walk(dir, func(path string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if f.Mode()&os.ModeSocket != 0 {
+			fmt.Fprintln(os.Stderr, "Skipping socket", path)
+			return nil
+		}
+
+		var link string
+		if f.Mode()&os.ModeSymlink != 0 {
+			link, err = os.Readlink(path)
+			if err != nil {
+				return err
+			}
+		}
+
+		hdr, err := tar.FileInfoHeader(f, link)
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if f.IsDir() {
+			hdr.Name += "/"
+		}
+
+		entries = append(entries, entry{path: path, hdr: hdr})
+		return nil
+	})
+	return
+}
+
+// headerSize returns the encoded length of hdr, including the extended headers the tar writer adds for long or non-ASCII names.
+func headerSize(hdr *tar.Header) (int, error) {
+	var c counter
+	err := tar.NewWriter(&c).WriteHeader(hdr)
+	return int(c), err
+}
+
+// Write counts the length of p.
+func (c *counter) Write(p []byte) (int, error) {
+	*c += counter(len(p))
+	return len(p), nil
+}
+
+// write writes the walked entries into w as a tar archive, with the content of regular files cut to their recorded size.
+func write(w io.Writer, entries []entry) error {
+	tw := tar.NewWriter(w)
+
+	for _, e := range entries {
+		err := tw.WriteHeader(e.hdr)
+		if err != nil {
+			return err
+		}
+
+		if e.hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		err = copyFile(tw, e.path, e.hdr.Size)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tw.Close()
+}
+
+// copyFile copies the first size bytes of the file into w, failing if it is shorter.
+func copyFile(w io.Writer, path string, size int64) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	_, err = io.CopyN(w, src, size)
+	if err == io.EOF {
+		return errors.New(path + " shrank while archiving.")
+	}
+	return err
+}
+
+// Extract unpacks a tar archive read from r into dir, creating dir if necessary.
+// Existing files are never overwritten. Ownership is only restored when running as root.
+//
+// Directory permissions and modification times are applied once all entries are extracted,
+// so that read-only directories can still be populated.
+func Extract(r io.Reader, dir string) error {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+
+	tr := tar.NewReader(r)
+	var dirs []*tar.Header
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		path, err := join(dir, hdr.Name)
+		if err != nil {
+			return err
+		}
+		mode := uint32(hdr.FileInfo().Mode().Perm())
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(path, 0700)
+			dirs = append(dirs, hdr)
+		case tar.TypeReg, tar.TypeRegA:
+			err = extractFile(tr, path, hdr.Size)
+		case tar.TypeSymlink:
+			err = os.Symlink(hdr.Linkname, path)
+		case tar.TypeLink:
+			var target string
+			target, err = join(dir, hdr.Linkname)
+			if err == nil {
+				err = os.Link(target, path)
+			}
+		case tar.TypeChar:
+			err = unix.Mknod(path, unix.S_IFCHR|mode, int(unix.Mkdev(uint32(hdr.Devmajor), uint32(hdr.Devminor))))
+		case tar.TypeBlock:
+			err = unix.Mknod(path, unix.S_IFBLK|mode, int(unix.Mkdev(uint32(hdr.Devmajor), uint32(hdr.Devminor))))
+		case tar.TypeFifo:
+			err = unix.Mkfifo(path, mode)
+		default:
+			fmt.Fprintln(os.Stderr, "Skipping unsupported entry", hdr.Name)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if hdr.Typeflag != tar.TypeDir {
+			err = setAttributes(path, hdr)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// Deepest directories first, so that setting times on children doesn't update parents
+	for i := len(dirs) - 1; i >= 0; i-- {
+		err = setAttributes(filepath.Join(dir, filepath.FromSlash(dirs[i].Name)), dirs[i])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// join returns the location of an archive entry under dir, refusing entries that would end up outside of it,
+// either by name or through a symlink extracted earlier. A symlink at the location itself is refused as well,
+// since a directory entry would populate its target and a hard link would point through it.
+func join(dir, name string) (string, error) {
+	clean := filepath.Clean(filepath.FromSlash(name))
+	if filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return "", errors.New("Illegal path in archive " + name)
+	}
+	if clean == "." {
+		return dir, nil
+	}
+
+	path := dir
+	for _, part := range strings.Split(clean, string(filepath.Separator)) {
+		path = filepath.Join(path, part)
+		f, err := os.Lstat(path)
+		if os.IsNotExist(err) {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		if f.Mode()&os.ModeSymlink != 0 {
+			return "", errors.New("Illegal path in archive " + name + ", it leads through a symlink")
+		}
+	}
+
+	return filepath.Join(dir, clean), nil
+}
+
+func extractFile(r io.Reader, path string, size int64) error {
+	dst, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.CopyN(dst, r, size)
+	if err != nil {
+		dst.Close()
+		return err
+	}
+
+	return dst.Close()
+}
+
+// setAttributes applies ownership, permissions and modification time stored in hdr, without following symlinks.
+func setAttributes(path string, hdr *tar.Header) error {
+	if os.Geteuid() == 0 {
+		err := os.Lchown(path, hdr.Uid, hdr.Gid)
+		if err != nil {
+			return err
+		}
+	}
+
+	if hdr.Typeflag != tar.TypeSymlink {
+		err := os.Chmod(path, hdr.FileInfo().Mode())
+		if err != nil {
+			return err
+		}
+	}
+
+	ts := []unix.Timeval{
+		unix.NsecToTimeval(time.Now().UnixNano()),
+		unix.NsecToTimeval(hdr.ModTime.UnixNano()),
+	}
+	return unix.Lutimes(path, ts)
+}
@@ -0,0 +1,305 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// crafted returns a tar archive of the given entries, with contents of regular files set to their names.
+func crafted(t *testing.T, entries ...*tar.Header) *bytes.Buffer {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+
+	for _, hdr := range entries {
+		if hdr.Typeflag == tar.TypeReg {
+			hdr.Size = int64(len(hdr.Name))
+		}
+		if hdr.Mode == 0 {
+			hdr.Mode = 0700
+		}
+
+		err := tw.WriteHeader(hdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if hdr.Typeflag == tar.TypeReg {
+			_, err = tw.Write([]byte(hdr.Name))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	err := tw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "ogive-archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestExtractRefusesEscapes(t *testing.T) {
+	tmp := tempDir(t)
+	defer os.RemoveAll(tmp)
+	dir := filepath.Join(tmp, "dir")
+
+	for _, name := range []string{"../f", "a/../../f", "/f"} {
+		err := Extract(crafted(t, &tar.Header{Name: name, Typeflag: tar.TypeReg}), dir)
+		if err == nil {
+			t.Errorf("Extract() of %s succeeded", name)
+		}
+	}
+
+	err := Extract(crafted(t, &tar.Header{Name: "h", Typeflag: tar.TypeLink, Linkname: "../f"}), dir)
+	if err == nil {
+		t.Error("Extract() of a hard link outside of the directory succeeded")
+	}
+
+	_, err = os.Lstat(filepath.Join(tmp, "f"))
+	if !os.IsNotExist(err) {
+		t.Errorf("file created outside of the directory: %v", err)
+	}
+}
+
+func TestExtractRefusesSymlinkParents(t *testing.T) {
+	tmp := tempDir(t)
+	defer os.RemoveAll(tmp)
+
+	outside := filepath.Join(tmp, "outside")
+	err := os.Mkdir(outside, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string][]*tar.Header{
+		"file": {
+			{Name: "d/", Typeflag: tar.TypeDir},
+			{Name: "d/a", Typeflag: tar.TypeSymlink, Linkname: outside},
+			{Name: "d/a/owned.txt", Typeflag: tar.TypeReg},
+		},
+		"dir": {
+			{Name: "a", Typeflag: tar.TypeSymlink, Linkname: outside},
+			{Name: "a/sub/", Typeflag: tar.TypeDir},
+		},
+		"dir chmod": {
+			{Name: "a", Typeflag: tar.TypeSymlink, Linkname: outside},
+			{Name: "a/", Typeflag: tar.TypeDir, Mode: 0777},
+		},
+		"fifo": {
+			{Name: "a", Typeflag: tar.TypeSymlink, Linkname: outside},
+			{Name: "a/fifo", Typeflag: tar.TypeFifo},
+		},
+		"link": {
+			{Name: "f", Typeflag: tar.TypeReg},
+			{Name: "a", Typeflag: tar.TypeSymlink, Linkname: outside},
+			{Name: "a/f", Typeflag: tar.TypeLink, Linkname: "f"},
+		},
+		"link to symlink": {
+			{Name: "a", Typeflag: tar.TypeSymlink, Linkname: filepath.Join(outside, "x")},
+			{Name: "b", Typeflag: tar.TypeLink, Linkname: "a"},
+		},
+		"relative": {
+			{Name: "a", Typeflag: tar.TypeSymlink, Linkname: "../outside"},
+			{Name: "a/owned.txt", Typeflag: tar.TypeReg},
+		},
+		"dotdot": {
+			{Name: "../outside/owned.txt", Typeflag: tar.TypeReg},
+		},
+	}
+
+	for name, entries := range tests {
+		dst := filepath.Join(tmp, "dst")
+		err = Extract(crafted(t, entries...), dst)
+		if err == nil {
+			t.Errorf("%s: Extract succeeded", name)
+		}
+
+		files, err := ioutil.ReadDir(outside)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range files {
+			t.Errorf("%s: %s written outside of the destination", name, f.Name())
+		}
+
+		f, err := os.Stat(outside)
+		if err != nil || f.Mode().Perm() != 0700 {
+			t.Errorf("%s: permissions of the symlink target changed to %v", name, f.Mode())
+		}
+
+		err = os.RemoveAll(dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestExtractKeepsSymlinks(t *testing.T) {
+	tmp := tempDir(t)
+	defer os.RemoveAll(tmp)
+
+	err := Extract(crafted(t,
+		&tar.Header{Name: "d/", Typeflag: tar.TypeDir},
+		&tar.Header{Name: "d/f", Typeflag: tar.TypeReg},
+		&tar.Header{Name: "d/l", Typeflag: tar.TypeSymlink, Linkname: "/nonexistent"},
+		&tar.Header{Name: "d/h", Typeflag: tar.TypeLink, Linkname: "d/f"},
+	), tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	link, err := os.Readlink(filepath.Join(tmp, "d", "l"))
+	if err != nil || link != "/nonexistent" {
+		t.Errorf("Readlink() = %q, %v", link, err)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(tmp, "d", "h"))
+	if err != nil || string(data) != "d/f" {
+		t.Errorf("hard link content = %q, %v", data, err)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	tmp := tempDir(t)
+	defer os.RemoveAll(tmp)
+
+	src := filepath.Join(tmp, "src")
+	mtime := time.Unix(1500000000, 0)
+	for _, d := range []string{"", "sub", "sub/ro"} {
+		err := os.Mkdir(filepath.Join(src, d), 0750)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Long and non-ASCII names need extended headers
+	files := map[string]string{"a": "first", "sub/b": "", "sub/ro/c": strings.Repeat("x", 1000), "sub/é": "accented", strings.Repeat("n", 200): "long"}
+	for name, content := range files {
+		err := ioutil.WriteFile(filepath.Join(src, name), []byte(content), 0640)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := os.Symlink("../a", filepath.Join(src, "sub", "l"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Symlink(strings.Repeat("../", 40)+"a", filepath.Join(src, "long link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chtimes(filepath.Join(src, "a"), mtime, mtime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chmod(filepath.Join(src, "sub", "ro"), 0500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(filepath.Join(src, "sub", "ro"), 0700)
+
+	r, size, err := NewReader(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != size {
+		t.Errorf("archive size %d, NewReader() reported %d", len(data), size)
+	}
+
+	dst := filepath.Join(tmp, "dst")
+	err = Extract(bytes.NewReader(data), dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(filepath.Join(dst, "sub", "ro"), 0700)
+
+	for name, content := range files {
+		got, err := ioutil.ReadFile(filepath.Join(dst, name))
+		if err != nil || string(got) != content {
+			t.Errorf("content of %s = %q, %v", name, got, err)
+		}
+	}
+
+	f, err := os.Stat(filepath.Join(dst, "a"))
+	if err != nil || f.Mode().Perm() != 0640 || !f.ModTime().Equal(mtime) {
+		t.Errorf("Stat(a) = %v, %v", f, err)
+	}
+	f, err = os.Stat(filepath.Join(dst, "sub", "ro"))
+	if err != nil || f.Mode().Perm() != 0500 {
+		t.Errorf("Stat(sub/ro) = %v, %v", f, err)
+	}
+
+	link, err := os.Readlink(filepath.Join(dst, "sub", "l"))
+	if err != nil || link != "../a" {
+		t.Errorf("Readlink() = %q, %v", link, err)
+	}
+
+	// Existing files are never overwritten
+	err = Extract(bytes.NewReader(data), dst)
+	if err == nil {
+		t.Error("Extract() over existing files succeeded")
+	}
+}
+
+func TestReaderSnapshot(t *testing.T) {
+	tmp := tempDir(t)
+	defer os.RemoveAll(tmp)
+
+	for name, content := range map[string]string{"grows": "first", "shrinks": "second"} {
+		err := ioutil.WriteFile(filepath.Join(tmp, name), []byte(content), 0640)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Growing files are cut to the size recorded by the walk
+	r, size, err := NewReader(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(tmp, "grows"), []byte(strings.Repeat("x", 4096)), 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != size {
+		t.Errorf("archive size %d, NewReader() reported %d", len(data), size)
+	}
+
+	// Shrinking files fail the archive
+	r, _, err = NewReader(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(tmp, "shrinks"), []byte("s"), 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ioutil.ReadAll(r)
+	r.Close()
+	if err == nil {
+		t.Error("archive of a shrunk file succeeded")
+	}
+}
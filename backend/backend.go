@@ -0,0 +1,62 @@
+package backend
+
+import (
+	"errors"
+	"github.com/mgren/ogive/profile"
+	"github.com/mgren/ogive/util"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ContentType is the Content-Type used to tell ogive archives apart from other objects.
+const ContentType = "application/x-ogive"
+
+// maxCopySize is the largest object S3 copies in a single request, larger objects are copied in parts.
+const maxCopySize = int64(5 << 30)
+
+var (
+	// ErrRestoreInProgress is returned by Restore when a restore job for the object is already running.
+	ErrRestoreInProgress = errors.New("Restoration already in progress.")
+
+	// ErrAlreadyRestored is returned by Restore when a restored copy of the object is already available.
+	ErrAlreadyRestored = errors.New("Restoration already completed.")
+
+	// ErrNotRestored is returned by Get when the object has to be restored before it can be downloaded.
+	ErrNotRestored = errors.New("Object is not restored.")
+
+	// ErrSlowDown is returned by Head when requests are being throttled and should be retried later.
+	ErrSlowDown = errors.New("Request rate too high.")
+
+	// ErrETagMismatch is returned by uploads when the ETag reported for stored content does not match the content sent.
+	ErrETagMismatch = errors.New("Uploaded content does not match its ETag.")
+)
+
+// New returns the Backend described by ogive profile data.
+// Endpoints with the file:// scheme select a Local backend rooted at <endpoint path>/<bucket name>,
+// with the simulated restore delay optionally set by the restore-delay query parameter, ex. file:///mnt/vault?restore-delay=1h
+// All other endpoints, including ones without a scheme such as minio.local:9000, are passed to S3 unchanged.
+func New(i *profile.InnerData) (Backend, error) {
+	if !strings.HasPrefix(i.Endpoint, "file://") {
+		return NewS3(util.GetSession(i), i.BucketName), nil
+	}
+	u, err := url.Parse(i.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	// AWS credentials are not needed here
+	i.AWSKeyId.Destroy()
+	i.AWSSecret.Destroy()
+
+	var delay time.Duration
+	if d := u.Query().Get("restore-delay"); d != "" {
+		delay, err = time.ParseDuration(d)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return NewLocal(filepath.Join(u.Path, i.BucketName), delay)
+}
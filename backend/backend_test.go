@@ -0,0 +1,383 @@
+package backend
+
+import (
+	"bytes"
+	"github.com/awnumar/memguard"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/mgren/ogive/profile"
+	"github.com/mgren/ogive/s3test"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestS3(t *testing.T) (*S3, *s3test.Server) {
+	s := s3test.NewServer("bucket")
+
+	in, err := s.Profile()
+	if err != nil {
+		s.Close()
+		t.Fatal(err)
+	}
+
+	b, err := New(in)
+	if err != nil {
+		s.Close()
+		t.Fatal(err)
+	}
+	return b.(*S3), s
+}
+
+// newTestProfile returns profile data of a bucket at the endpoint, with dummy AWS credentials.
+func newTestProfile(t *testing.T, endpoint string) *profile.InnerData {
+	id, err := memguard.NewImmutableFromBytes([]byte("AKIAOGIVETEST"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := memguard.NewImmutableFromBytes([]byte("ogive-test-secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &profile.InnerData{AWSKeyId: id, AWSSecret: secret, BucketName: "bucket", Region: "us-east-1", Endpoint: endpoint}
+}
+
+// testBackend exercises the semantics every backend has to share. Restores are expected to complete at once.
+func testBackend(t *testing.T, b Backend) {
+	meta := map[string]string{"Nonce": "abc"}
+	err := b.Put("a", strings.NewReader("content"), 7, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	o, err := b.Head("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.ContentType != ContentType || o.Size != 7 || o.StorageClass != "DEEP_ARCHIVE" || o.Metadata["Nonce"] != "abc" || o.Restore != "" {
+		t.Errorf("Head() = %+v", o)
+	}
+
+	_, err = b.Get("a", 0, -1)
+	if err != ErrNotRestored {
+		t.Errorf("Get() before restore = %v, want %v", err, ErrNotRestored)
+	}
+
+	err = b.Restore("a", 1, "Bulk")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	o, err = b.Head("a")
+	if err != nil || !strings.Contains(o.Restore, "ongoing-request=\"false\"") || !strings.Contains(o.Restore, "expiry-date=") {
+		t.Errorf("Head() after restore = %+v, %v", o, err)
+	}
+
+	body, err := b.Get("a", 2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(body)
+	body.Close()
+	if err != nil || string(data) != "nte" {
+		t.Errorf("Get(2, 3) = %q, %v", data, err)
+	}
+
+	if mp, ok := b.(Multipart); ok {
+		id, err := mp.CreateUpload("b", meta)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var parts []Part
+		for i, p := range []string{"first ", "second"} {
+			etag, err := mp.UploadPart("b", id, i+1, strings.NewReader(p))
+			if err != nil {
+				t.Fatal(err)
+			}
+			parts = append(parts, Part{Number: i + 1, ETag: etag})
+		}
+
+		err = mp.CompleteUpload("b", id, parts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		o, err = b.Head("b")
+		if err != nil || o.Size != 12 || o.Metadata["Nonce"] != "abc" {
+			t.Errorf("Head() of multipart upload = %+v, %v", o, err)
+		}
+
+		id, err = mp.CreateUpload("c", meta)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = mp.AbortUpload("c", id)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if c, ok := b.(Copier); ok {
+		err = c.Copy("a", "d", 7, map[string]string{"Nonce": "def"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		o, err = b.Head("d")
+		if err != nil || o.Size != 7 || o.Metadata["Nonce"] != "def" || o.Restore != "" {
+			t.Errorf("Head() of copy = %+v, %v", o, err)
+		}
+	}
+
+	var keys []string
+	err = b.List(func(key string) bool {
+		keys = append(keys, key)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(keys, " ") != "a b d" {
+		t.Errorf("List() = %q", keys)
+	}
+
+	err = b.Delete("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = b.Head("a")
+	if err == nil {
+		t.Error("Head() of deleted object succeeded")
+	}
+}
+
+func TestS3(t *testing.T) {
+	b, s := newTestS3(t)
+	defer s.Close()
+
+	testBackend(t, b)
+}
+
+func TestLocal(t *testing.T) {
+	l := newTestLocal(t)
+	defer os.RemoveAll(l.root)
+
+	testBackend(t, l)
+
+	err := l.Restore("b", 1, "Bulk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = l.Restore("b", 1, "Bulk")
+	if err != ErrAlreadyRestored {
+		t.Errorf("second Restore() = %v, want %v", err, ErrAlreadyRestored)
+	}
+}
+
+func TestNewLocal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ogive-local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	b, err := New(newTestProfile(t, "file://"+dir+"?restore-delay=1h"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, ok := b.(*Local)
+	if !ok || l.root != filepath.Join(dir, "bucket") || l.delay.Hours() != 1 {
+		t.Errorf("New() = %+v", b)
+	}
+
+	_, err = New(newTestProfile(t, "file://"+dir+"?restore-delay=soon"))
+	if err == nil {
+		t.Error("New() accepted an invalid restore delay")
+	}
+
+	_, err = New(newTestProfile(t, "file://%zz"))
+	if err == nil {
+		t.Error("New() accepted an invalid endpoint")
+	}
+}
+
+func TestNewS3(t *testing.T) {
+	for _, endpoint := range []string{"", "https://s3.example.com", "minio.local:9000", "127.0.0.1:9000"} {
+		b, err := New(newTestProfile(t, endpoint))
+		if err != nil {
+			t.Errorf("New(%q) error = %v", endpoint, err)
+			continue
+		}
+		if _, ok := b.(*S3); !ok {
+			t.Errorf("New(%q) = %T, want *S3", endpoint, b)
+		}
+	}
+}
+
+func TestS3ListPages(t *testing.T) {
+	b, s := newTestS3(t)
+	defer s.Close()
+	s.MaxKeys = 2
+
+	for _, key := range []string{"e", "d", "c", "b", "a"} {
+		err := b.Put(key, bytes.NewReader(nil), 0, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var keys []string
+	err := b.List(func(key string) bool {
+		keys = append(keys, key)
+		return key != "d"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(keys, " ") != "a b c d" {
+		t.Errorf("List() = %q", keys)
+	}
+}
+
+func TestS3RestoreInProgress(t *testing.T) {
+	b, s := newTestS3(t)
+	defer s.Close()
+	s.RestoreDelay = time.Hour
+
+	err := b.Put("a", strings.NewReader("content"), 7, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = b.Restore("a", 1, "Standard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.Restore("a", 1, "Standard")
+	if err != ErrRestoreInProgress {
+		t.Errorf("second Restore() = %v, want %v", err, ErrRestoreInProgress)
+	}
+	_, err = b.Get("a", 0, -1)
+	if err != ErrNotRestored {
+		t.Errorf("Get() during restore = %v, want %v", err, ErrNotRestored)
+	}
+
+	s.CompleteRestores()
+	body, err := b.Get("a", 0, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body.Close()
+}
+
+func TestS3Notifications(t *testing.T) {
+	b, s := newTestS3(t)
+	defer s.Close()
+	s.RestoreDelay = time.Hour
+
+	for _, key := range []string{"a", "b"} {
+		err := b.Put(key, strings.NewReader(key), 1, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = b.Restore(key, 1, "Bulk")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	all := func(string) bool { return true }
+	keys, err := b.Restored(s.QueueURL(), 0, all)
+	if err != nil || len(keys) != 0 {
+		t.Fatalf("Restored() before completion = %q, %v", keys, err)
+	}
+
+	// Events nobody waits for stay in the queue and can be received again at once
+	s.CompleteRestores()
+	keys, err = b.Restored(s.QueueURL(), time.Second, func(key string) bool { return key == "a" })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(keys, " ") != "a" || s.Messages() != 1 {
+		t.Errorf("Restored() of a = %q, %d message(s) left", keys, s.Messages())
+	}
+
+	keys, err = b.Restored(s.QueueURL(), 0, all)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(keys, " ") != "b" {
+		t.Errorf("Restored() = %q", keys)
+	}
+	if s.Messages() != 0 {
+		t.Errorf("%d message(s) left in the queue", s.Messages())
+	}
+}
+
+func TestS3Throttling(t *testing.T) {
+	b, s := newTestS3(t)
+	defer s.Close()
+
+	err := b.Put("a", strings.NewReader("content"), 7, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without retries, the SDK would back off for seconds
+	b = NewS3(session.Must(session.NewSession(b.svc.Config.Copy(&aws.Config{MaxRetries: aws.Int(0)}))), s.Bucket)
+	s.Throttle(1)
+	_, err = b.Head("a")
+	if err != ErrSlowDown {
+		t.Errorf("Head() while throttled = %v, want %v", err, ErrSlowDown)
+	}
+}
+
+func TestS3Corruption(t *testing.T) {
+	b, s := newTestS3(t)
+	defer s.Close()
+
+	// Every retry is damaged as well
+	s.Corrupt(100)
+	err := b.Put("a", strings.NewReader("content"), 7, nil)
+	if err == nil {
+		t.Error("Put() of damaged content succeeded")
+	}
+
+	s.Corrupt(1)
+	id, err := b.CreateUpload("b", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = b.UploadPart("b", id, 1, strings.NewReader("content"))
+	if err == nil {
+		t.Fatal("UploadPart() of damaged content succeeded")
+	}
+	etag, err := b.UploadPart("b", id, 1, strings.NewReader("content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.CompleteUpload("b", id, []Part{{Number: 1, ETag: etag}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.Corrupt(0)
+	err = b.Restore("b", 1, "Bulk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := b.Get("b", 0, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(body)
+	body.Close()
+	if err != nil || string(data) != "content" {
+		t.Errorf("Get() = %q, %v", data, err)
+	}
+}
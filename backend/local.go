@@ -0,0 +1,352 @@
+package backend
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Every directory under Local.root has its own namespace, so that any key is a valid filename in objectDir.
+const (
+	// objectDir is the directory under Local.root that holds the archives.
+	objectDir = "objects"
+
+	// metaDir is the directory under Local.root that holds sidecar files.
+	metaDir = "meta"
+
+	// uploadDir is the directory under Local.root that holds pending multipart uploads, one directory per upload,
+	// as well as temporary files of uploads in progress.
+	uploadDir = "uploads"
+
+	// uploadMeta is the sidecar file of the future object in an upload directory, next to the numbered parts.
+	uploadMeta = "meta"
+)
+
+// NewLocal returns a Backend operating on the selected directory, creating it if necessary.
+// Restore requests will take delay to complete.
+func NewLocal(root string, delay time.Duration) (*Local, error) {
+	for _, dir := range []string{objectDir, metaDir, uploadDir} {
+		err := os.MkdirAll(filepath.Join(root, dir), 0700)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &Local{root, delay}, nil
+}
+
+// Put writes body into a temporary file which is then moved into place together with its sidecar.
+func (l *Local) Put(key string, body io.Reader, size int64, meta map[string]string) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Join(l.root, uploadDir), ".put-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = io.Copy(tmp, body)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	err = l.writeSidecar(key, &sidecar{ContentType: ContentType, Metadata: meta})
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), l.path(key))
+}
+
+// Head combines file information with the sidecar and reports a DEEP_ARCHIVE storage class for every object.
+// The restore header is computed from the time of the last restore request.
+func (l *Local) Head(key string) (*Object, error) {
+	if err := checkKey(key); err != nil {
+		return nil, err
+	}
+
+	f, err := os.Stat(l.path(key))
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := l.readSidecar(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Object{
+		ContentType:  s.ContentType,
+		Size:         f.Size(),
+		LastModified: f.ModTime(),
+		StorageClass: "DEEP_ARCHIVE",
+		Restore:      l.restoreHeader(s),
+		Metadata:     s.Metadata,
+	}, nil
+}
+
+// Get opens the object for reading, failing with ErrNotRestored unless a restored copy is available.
+func (l *Local) Get(key string, offset, length int64) (io.ReadCloser, error) {
+	if err := checkKey(key); err != nil {
+		return nil, err
+	}
+
+	s, err := l.readSidecar(key)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.Contains(l.restoreHeader(s), "ongoing-request=\"false\"") {
+		return nil, ErrNotRestored
+	}
+
+	f, err := os.Open(l.path(key))
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = f.Seek(offset, io.SeekStart)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if length < 0 {
+		return f, nil
+	}
+
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(f, length), f}, nil
+}
+
+// Copy stores a copy of the object under dst like Put, failing with ErrNotRestored unless a restored copy is available.
+func (l *Local) Copy(src, dst string, size int64, meta map[string]string) error {
+	body, err := l.Get(src, 0, -1)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	return l.Put(dst, body, size, meta)
+}
+
+// Restore records the restore request in the object sidecar.
+func (l *Local) Restore(key string, days int, tier string) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+
+	s, err := l.readSidecar(key)
+	if err != nil {
+		return err
+	}
+
+	switch l.restoreHeader(s) {
+	case "":
+	case "ongoing-request=\"true\"":
+		return ErrRestoreInProgress
+	default:
+		return ErrAlreadyRestored
+	}
+
+	s.Restored = time.Now()
+	s.Days = days
+
+	return l.writeSidecar(key, s)
+}
+
+// List walks the object directory in lexical order.
+func (l *Local) List(fn func(key string) bool) error {
+	files, err := ioutil.ReadDir(filepath.Join(l.root, objectDir))
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		if !fn(f.Name()) {
+			break
+		}
+	}
+
+	return nil
+}
+
+// Delete removes the object together with its sidecar.
+func (l *Local) Delete(key string) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+
+	err := os.Remove(l.path(key))
+	if err != nil {
+		return err
+	}
+
+	return os.Remove(filepath.Join(l.root, metaDir, key))
+}
+
+// CreateUpload creates a directory for the upload parts holding the future object sidecar.
+func (l *Local) CreateUpload(key string, meta map[string]string) (string, error) {
+	if err := checkKey(key); err != nil {
+		return "", err
+	}
+
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		return "", err
+	}
+
+	uploadID := hex.EncodeToString(id)
+	dir := filepath.Join(l.root, uploadDir, uploadID)
+
+	err = os.Mkdir(dir, 0700)
+	if err != nil {
+		return "", err
+	}
+
+	return uploadID, writeSidecar(filepath.Join(dir, uploadMeta), &sidecar{ContentType: ContentType, Metadata: meta})
+}
+
+// UploadPart stores the part in the upload directory. The returned ETag is the MD5 sum of the part, same as in S3.
+func (l *Local) UploadPart(key, uploadID string, number int, body io.ReadSeeker) (string, error) {
+	if err := checkKey(uploadID); err != nil {
+		return "", err
+	}
+
+	dst, err := os.OpenFile(filepath.Join(l.root, uploadDir, uploadID, strconv.Itoa(number)), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return "", err
+	}
+
+	h := md5.New()
+	_, err = io.Copy(io.MultiWriter(dst, h), body)
+	if err != nil {
+		dst.Close()
+		return "", err
+	}
+
+	return "\"" + hex.EncodeToString(h.Sum(nil)) + "\"", dst.Close()
+}
+
+// CompleteUpload concatenates the listed parts into the object and removes the upload directory.
+func (l *Local) CompleteUpload(key, uploadID string, parts []Part) error {
+	if err := checkKey(uploadID); err != nil {
+		return err
+	}
+
+	dir := filepath.Join(l.root, uploadDir, uploadID)
+	s, err := readSidecar(filepath.Join(dir, uploadMeta))
+	if err != nil {
+		return err
+	}
+
+	readers := make([]io.Reader, len(parts))
+	for i, p := range parts {
+		f, err := os.Open(filepath.Join(dir, strconv.Itoa(p.Number)))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		readers[i] = f
+	}
+
+	err = l.Put(key, io.MultiReader(readers...), -1, s.Metadata)
+	if err != nil {
+		return err
+	}
+
+	return os.RemoveAll(dir)
+}
+
+// AbortUpload removes the upload directory.
+func (l *Local) AbortUpload(key, uploadID string) error {
+	if err := checkKey(uploadID); err != nil {
+		return err
+	}
+
+	return os.RemoveAll(filepath.Join(l.root, uploadDir, uploadID))
+}
+
+// restoreHeader emulates the x-amz-restore header for the current point in time.
+func (l *Local) restoreHeader(s *sidecar) string {
+	if s.Restored.IsZero() {
+		return ""
+	}
+
+	ready := s.Restored.Add(l.delay)
+	if time.Now().Before(ready) {
+		return "ongoing-request=\"true\""
+	}
+
+	// S3 rounds the expiry up to the next midnight UTC
+	expiry := ready.UTC().Truncate(24*time.Hour).AddDate(0, 0, s.Days+1)
+	if time.Now().After(expiry) {
+		return ""
+	}
+
+	return "ongoing-request=\"false\", expiry-date=\"" + expiry.Format(http.TimeFormat) + "\""
+}
+
+// path returns the filename of the object stored under key.
+func (l *Local) path(key string) string {
+	return filepath.Join(l.root, objectDir, key)
+}
+
+func (l *Local) readSidecar(key string) (*sidecar, error) {
+	return readSidecar(filepath.Join(l.root, metaDir, key))
+}
+
+func (l *Local) writeSidecar(key string, s *sidecar) error {
+	return writeSidecar(filepath.Join(l.root, metaDir, key), s)
+}
+
+func readSidecar(fname string) (s *sidecar, err error) {
+	var data []byte
+	data, err = ioutil.ReadFile(fname)
+	if err != nil {
+		return
+	}
+
+	err = json.Unmarshal(data, &s)
+	return
+}
+
+func writeSidecar(fname string, s *sidecar) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(fname, data, 0600)
+}
+
+// checkKey makes sure the key can be safely used as a filename in a directory under Local.root.
+func checkKey(key string) error {
+	if key == "" || key == "." || key == ".." || strings.ContainsAny(key, "/"+string(filepath.Separator)) {
+		return errors.New("Invalid key " + key)
+	}
+	return nil
+}
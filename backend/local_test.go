@@ -0,0 +1,150 @@
+package backend
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestLocal(t *testing.T) *Local {
+	dir, err := ioutil.TempDir("", "ogive-local")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := NewLocal(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func TestLocalRestoreDelay(t *testing.T) {
+	l := newTestLocal(t)
+	defer os.RemoveAll(l.root)
+	l.delay = 100 * time.Millisecond
+
+	err := l.Put("a", strings.NewReader("content"), 7, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = l.Restore("a", 1, "Bulk")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	o, err := l.Head("a")
+	if err != nil || o.Restore != "ongoing-request=\"true\"" {
+		t.Errorf("Head() during restore = %+v, %v", o, err)
+	}
+	err = l.Restore("a", 1, "Bulk")
+	if err != ErrRestoreInProgress {
+		t.Errorf("second Restore() = %v, want %v", err, ErrRestoreInProgress)
+	}
+	_, err = l.Get("a", 0, -1)
+	if err != ErrNotRestored {
+		t.Errorf("Get() during restore = %v, want %v", err, ErrNotRestored)
+	}
+
+	time.Sleep(l.delay)
+	o, err = l.Head("a")
+	if err != nil || !strings.HasPrefix(o.Restore, "ongoing-request=\"false\", expiry-date=") {
+		t.Errorf("Head() after restore = %+v, %v", o, err)
+	}
+}
+
+func TestLocalDotKeys(t *testing.T) {
+	l := newTestLocal(t)
+	defer os.RemoveAll(l.root)
+	keys := []string{".a.bc", ".meta", ".uploads", "abc"}
+
+	for _, key := range keys {
+		err := l.Put(key, strings.NewReader(key), int64(len(key)), map[string]string{"Nonce": key})
+		if err != nil {
+			t.Fatalf("Put(%q): %v", key, err)
+		}
+	}
+
+	var listed []string
+	err := l.List(func(key string) bool {
+		listed = append(listed, key)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(listed, " ") != strings.Join(keys, " ") {
+		t.Errorf("List() = %q, want %q", listed, keys)
+	}
+
+	for _, key := range keys {
+		o, err := l.Head(key)
+		if err != nil || o.Metadata["Nonce"] != key {
+			t.Fatalf("Head(%q) = %v, %v", key, o, err)
+		}
+
+		err = l.Restore(key, 1, "Bulk")
+		if err != nil {
+			t.Fatalf("Restore(%q): %v", key, err)
+		}
+
+		body, err := l.Get(key, 0, -1)
+		if err != nil {
+			t.Fatalf("Get(%q): %v", key, err)
+		}
+		data, err := ioutil.ReadAll(body)
+		body.Close()
+		if err != nil || string(data) != key {
+			t.Errorf("Get(%q) = %q, %v", key, data, err)
+		}
+
+		err = l.Delete(key)
+		if err != nil {
+			t.Fatalf("Delete(%q): %v", key, err)
+		}
+	}
+}
+
+func TestLocalInvalidKeys(t *testing.T) {
+	l := newTestLocal(t)
+	defer os.RemoveAll(l.root)
+
+	for _, key := range []string{"", ".", "..", "a/b", "../a"} {
+		if err := l.Put(key, bytes.NewReader(nil), 0, nil); err == nil {
+			t.Errorf("Put(%q) succeeded", key)
+		}
+	}
+}
+
+func TestLocalMultipart(t *testing.T) {
+	l := newTestLocal(t)
+	defer os.RemoveAll(l.root)
+	key := ".multi"
+
+	id, err := l.CreateUpload(key, map[string]string{"Nonce": "n"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var parts []Part
+	for i, p := range []string{"first ", "second"} {
+		etag, err := l.UploadPart(key, id, i+1, strings.NewReader(p))
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts = append(parts, Part{Number: i + 1, ETag: etag})
+	}
+
+	err = l.CompleteUpload(key, id, parts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	o, err := l.Head(key)
+	if err != nil || o.Size != int64(len("first second")) || o.Metadata["Nonce"] != "n" {
+		t.Fatalf("Head(%q) = %v, %v", key, o, err)
+	}
+}
@@ -0,0 +1,415 @@
+package backend
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/mgren/ogive/util"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// NewS3 returns a Backend operating on the selected bucket using an existing AWS session.
+func NewS3(sess *session.Session, bucket string) *S3 {
+	return &S3{s3.New(sess), sess, bucket}
+}
+
+// Put uploads body as a DEEP_ARCHIVE object using a multipart upload.
+// Every part is sent with Content-MD5 and the ETags of the parts and of the assembled object are verified.
+func (b *S3) Put(key string, body io.Reader, size int64, meta map[string]string) error {
+	_, err := s3manager.NewUploaderWithClient(b.svc, func(u *s3manager.Uploader) {
+		u.PartSize = util.GetPartSize(size)
+	}, s3manager.WithUploaderRequestOptions(checkIntegrity)).Upload(&s3manager.UploadInput{
+		Body:         body,
+		Bucket:       &b.bucket,
+		Key:          &key,
+		ContentType:  aws.String(ContentType),
+		StorageClass: aws.String(s3.StorageClassDeepArchive),
+		Metadata:     aws.StringMap(meta),
+	})
+
+	return err
+}
+
+// Head performs a HeadObject request, translating throttling errors into ErrSlowDown.
+func (b *S3) Head(key string) (*Object, error) {
+	res, err := b.svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: &b.bucket,
+		Key:    &key,
+	})
+	if isSlowDown(err) {
+		return nil, ErrSlowDown
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &Object{
+		ContentType:  aws.StringValue(res.ContentType),
+		Size:         aws.Int64Value(res.ContentLength),
+		LastModified: aws.TimeValue(res.LastModified),
+		StorageClass: aws.StringValue(res.StorageClass),
+		Restore:      aws.StringValue(res.Restore),
+		Metadata:     aws.StringValueMap(res.Metadata),
+	}, nil
+}
+
+// Get performs a ranged GetObject request.
+func (b *S3) Get(key string, offset, length int64) (io.ReadCloser, error) {
+	rng := fmt.Sprintf("bytes=%d-", offset)
+	if length >= 0 {
+		rng += fmt.Sprint(offset + length - 1)
+	}
+
+	res, err := b.svc.GetObject(&s3.GetObjectInput{
+		Bucket: &b.bucket,
+		Key:    &key,
+		Range:  &rng,
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "InvalidObjectState" {
+		return nil, ErrNotRestored
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return res.Body, nil
+}
+
+// Restore performs a RestoreObject request, translating AWS error codes into ErrAlreadyRestored and ErrRestoreInProgress.
+func (b *S3) Restore(key string, days int, tier string) error {
+	_, err := b.svc.RestoreObject(&s3.RestoreObjectInput{
+		Bucket: &b.bucket,
+		Key:    &key,
+		RestoreRequest: &s3.RestoreRequest{
+			Days: aws.Int64(int64(days)),
+			GlacierJobParameters: &s3.GlacierJobParameters{
+				Tier: &tier,
+			},
+		},
+	})
+
+	if aerr, ok := err.(awserr.Error); ok {
+		switch aerr.Code() {
+		case s3.ErrCodeObjectAlreadyInActiveTierError:
+			return ErrAlreadyRestored
+		case "RestoreAlreadyInProgress": // Doesn't seem to be defined in current version of AWS SDK
+			return ErrRestoreInProgress
+		}
+	}
+
+	return err
+}
+
+// List lists the entire bucket page by page.
+func (b *S3) List(fn func(key string) bool) error {
+	return b.svc.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: &b.bucket,
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			if !fn(*obj.Key) {
+				return false
+			}
+		}
+		return !lastPage
+	})
+}
+
+// Delete performs a DeleteObject request.
+func (b *S3) Delete(key string) error {
+	_, err := b.svc.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: &b.bucket,
+		Key:    &key,
+	})
+
+	return err
+}
+
+// CreateUpload performs a CreateMultipartUpload request for a DEEP_ARCHIVE object.
+func (b *S3) CreateUpload(key string, meta map[string]string) (string, error) {
+	res, err := b.svc.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
+		Bucket:       &b.bucket,
+		Key:          &key,
+		ContentType:  aws.String(ContentType),
+		StorageClass: aws.String(s3.StorageClassDeepArchive),
+		Metadata:     aws.StringMap(meta),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return aws.StringValue(res.UploadId), nil
+}
+
+// UploadPart performs an UploadPart request with Content-MD5, verifying the returned ETag.
+func (b *S3) UploadPart(key, uploadID string, number int, body io.ReadSeeker) (string, error) {
+	res, err := b.svc.UploadPartWithContext(aws.BackgroundContext(), &s3.UploadPartInput{
+		Bucket:     &b.bucket,
+		Key:        &key,
+		UploadId:   &uploadID,
+		PartNumber: aws.Int64(int64(number)),
+		Body:       body,
+	}, checkIntegrity)
+	if err != nil {
+		return "", err
+	}
+
+	return aws.StringValue(res.ETag), nil
+}
+
+// CompleteUpload performs a CompleteMultipartUpload request, verifying the ETag of the assembled object against the part ETags.
+func (b *S3) CompleteUpload(key, uploadID string, parts []Part) error {
+	completed := make([]*s3.CompletedPart, len(parts))
+	for i, p := range parts {
+		completed[i] = &s3.CompletedPart{
+			ETag:       aws.String(p.ETag),
+			PartNumber: aws.Int64(int64(p.Number)),
+		}
+	}
+
+	_, err := b.svc.CompleteMultipartUploadWithContext(aws.BackgroundContext(), &s3.CompleteMultipartUploadInput{
+		Bucket:          &b.bucket,
+		Key:             &key,
+		UploadId:        &uploadID,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: completed},
+	}, checkIntegrity)
+
+	return err
+}
+
+// Copy performs a CopyObject request for a DEEP_ARCHIVE object, or a multipart copy for objects too large for a single request.
+// Archived objects have to be restored before they can be copied.
+func (b *S3) Copy(src, dst string, size int64, meta map[string]string) error {
+	source := b.bucket + "/" + url.PathEscape(src)
+
+	if size <= maxCopySize {
+		_, err := b.svc.CopyObject(&s3.CopyObjectInput{
+			Bucket:            &b.bucket,
+			Key:               &dst,
+			CopySource:        &source,
+			MetadataDirective: aws.String(s3.MetadataDirectiveReplace),
+			ContentType:       aws.String(ContentType),
+			StorageClass:      aws.String(s3.StorageClassDeepArchive),
+			Metadata:          aws.StringMap(meta),
+		})
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "InvalidObjectState" {
+			return ErrNotRestored
+		}
+		return err
+	}
+
+	uploadID, err := b.CreateUpload(dst, meta)
+	if err != nil {
+		return err
+	}
+
+	partSize := util.GetPartSize(size)
+	var parts []Part
+	for offset := int64(0); offset < size; offset += partSize {
+		end := offset + partSize
+		if end > size {
+			end = size
+		}
+
+		var res *s3.UploadPartCopyOutput
+		res, err = b.svc.UploadPartCopy(&s3.UploadPartCopyInput{
+			Bucket:          &b.bucket,
+			Key:             &dst,
+			UploadId:        &uploadID,
+			PartNumber:      aws.Int64(int64(len(parts) + 1)),
+			CopySource:      &source,
+			CopySourceRange: aws.String(fmt.Sprintf("bytes=%d-%d", offset, end-1)),
+		})
+		if err != nil {
+			break
+		}
+		parts = append(parts, Part{len(parts) + 1, aws.StringValue(res.CopyPartResult.ETag)})
+	}
+
+	if err == nil {
+		err = b.CompleteUpload(dst, uploadID, parts)
+	}
+	if err != nil {
+		b.AbortUpload(dst, uploadID)
+	}
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "InvalidObjectState" {
+		return ErrNotRestored
+	}
+
+	return err
+}
+
+// AbortUpload performs an AbortMultipartUpload request.
+func (b *S3) AbortUpload(key, uploadID string) error {
+	_, err := b.svc.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+		Bucket:   &b.bucket,
+		Key:      &key,
+		UploadId: &uploadID,
+	})
+
+	return err
+}
+
+// checkIntegrity is a request option for uploads. It makes sure content is sent with Content-MD5,
+// so that S3 rejects anything damaged in transit, and checks the returned ETag against the digest sent.
+// ETags of multipart objects are the MD5 of the concatenated part digests followed by the number of parts.
+// With SSE-KMS bucket encryption ETags are not digests of the content, so they are not checked.
+func checkIntegrity(r *request.Request) {
+	r.Handlers.Build.PushBack(setContentMD5)
+	r.Handlers.Unmarshal.PushBack(checkETag)
+}
+
+// setContentMD5 computes Content-MD5 of PutObject and UploadPart requests, unless already set by the SDK.
+func setContentMD5(r *request.Request) {
+	if r.Error != nil || r.HTTPRequest.Header.Get("Content-Md5") != "" || r.Body == nil {
+		return
+	}
+	if r.Operation.Name != "PutObject" && r.Operation.Name != "UploadPart" {
+		return
+	}
+
+	start, err := r.Body.Seek(0, io.SeekCurrent)
+	if err != nil {
+		r.Error = err
+		return
+	}
+
+	h := md5.New()
+	_, err = io.Copy(h, r.Body)
+	if err == nil {
+		_, err = r.Body.Seek(start, io.SeekStart)
+	}
+	if err != nil {
+		r.Error = err
+		return
+	}
+
+	r.HTTPRequest.Header.Set("Content-Md5", base64.StdEncoding.EncodeToString(h.Sum(nil)))
+}
+
+// checkETag fails the request with ErrETagMismatch if the returned ETag doesn't match the content sent.
+func checkETag(r *request.Request) {
+	if r.Error != nil {
+		return
+	}
+
+	var etag, sse, expected *string
+	switch out := r.Data.(type) {
+	case *s3.PutObjectOutput:
+		etag, sse, expected = out.ETag, out.ServerSideEncryption, contentETag(r)
+	case *s3.UploadPartOutput:
+		etag, sse, expected = out.ETag, out.ServerSideEncryption, contentETag(r)
+	case *s3.CompleteMultipartUploadOutput:
+		etag, sse = out.ETag, out.ServerSideEncryption
+		if in, ok := r.Params.(*s3.CompleteMultipartUploadInput); ok && in.MultipartUpload != nil {
+			expected = partsETag(in.MultipartUpload.Parts)
+		}
+	}
+
+	if expected == nil || aws.StringValue(sse) == s3.ServerSideEncryptionAwsKms {
+		return
+	}
+
+	if strings.Trim(aws.StringValue(etag), "\"") != *expected {
+		r.Error = ErrETagMismatch
+	}
+}
+
+// contentETag returns the ETag expected for the content of a single request, nil if it has no Content-MD5.
+func contentETag(r *request.Request) *string {
+	sum, err := base64.StdEncoding.DecodeString(r.HTTPRequest.Header.Get("Content-Md5"))
+	if err != nil || len(sum) != md5.Size {
+		return nil
+	}
+
+	return aws.String(hex.EncodeToString(sum))
+}
+
+// partsETag returns the ETag expected for an object assembled from parts, nil if some part ETag is not a digest.
+func partsETag(parts []*s3.CompletedPart) *string {
+	h := md5.New()
+	for _, p := range parts {
+		sum, err := hex.DecodeString(strings.Trim(aws.StringValue(p.ETag), "\""))
+		if err != nil || len(sum) != md5.Size {
+			return nil
+		}
+		h.Write(sum)
+	}
+
+	return aws.String(fmt.Sprintf("%x-%d", h.Sum(nil), len(parts)))
+}
+
+// isSlowDown reports whether err is an S3 throttling error.
+// HEAD responses carry no body, so throttling only shows as 503 Service Unavailable there.
+func isSlowDown(err error) bool {
+	if rerr, ok := err.(awserr.RequestFailure); ok && rerr.StatusCode() == http.StatusServiceUnavailable {
+		return true
+	}
+
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == "SlowDown"
+}
+
+// Restored long-polls an SQS queue for s3:ObjectRestore:Completed events about the bucket.
+// The session endpoint belongs to S3, so requests are sent to the host of the queue URL instead.
+// S3 test events about the bucket concern no object, they are removed along with the accepted events.
+func (b *S3) Restored(queue string, wait time.Duration, want func(key string) bool) ([]string, error) {
+	u, err := url.Parse(queue)
+	if err != nil {
+		return nil, err
+	}
+
+	svc := sqs.New(b.sess, &aws.Config{Endpoint: aws.String(u.Scheme + "://" + u.Host)})
+	res, err := svc.ReceiveMessage(&sqs.ReceiveMessageInput{
+		QueueUrl:            &queue,
+		MaxNumberOfMessages: aws.Int64(10),
+		WaitTimeSeconds:     aws.Int64(int64(wait / time.Second)),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	for _, m := range res.Messages {
+		var ev restoreEvent
+		consume := json.Unmarshal([]byte(aws.StringValue(m.Body)), &ev) == nil && ev.Bucket == b.bucket && len(ev.Records) == 0
+
+		var accepted, other bool
+		for _, r := range ev.Records {
+			key, err := url.QueryUnescape(r.S3.Object.Key)
+			if err == nil && r.S3.Bucket.Name == b.bucket && r.EventName == "ObjectRestore:Completed" && want(key) {
+				keys = append(keys, key)
+				accepted = true
+			} else {
+				other = true
+			}
+		}
+
+		if consume || accepted && !other {
+			_, err = svc.DeleteMessage(&sqs.DeleteMessageInput{QueueUrl: &queue, ReceiptHandle: m.ReceiptHandle})
+		} else {
+			_, err = svc.ChangeMessageVisibility(&sqs.ChangeMessageVisibilityInput{
+				QueueUrl:          &queue,
+				ReceiptHandle:     m.ReceiptHandle,
+				VisibilityTimeout: aws.Int64(0),
+			})
+		}
+		if err != nil {
+			return keys, err
+		}
+	}
+
+	return keys, nil
+}
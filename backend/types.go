@@ -0,0 +1,157 @@
+package backend
+
+import (
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"io"
+	"time"
+)
+
+// Backend is the storage abstraction used by all ogive commands.
+// Implementations are expected to emulate S3 Glacier Deep Archive semantics closely enough
+// for object.Parse to derive a meaningful restore status from the returned Object.
+type Backend interface {
+	// Put stores everything read from body under key. Size may be -1 if it is not known in advance.
+	// All objects are stored with ContentType and the supplied user metadata.
+	Put(key string, body io.Reader, size int64, meta map[string]string) error
+
+	// Head retrieves object metadata without downloading its content.
+	Head(key string) (*Object, error)
+
+	// Get returns a reader for length bytes of object content starting at offset.
+	// A negative length reads until the end of the object.
+	Get(key string, offset, length int64) (io.ReadCloser, error)
+
+	// Restore requests a temporary copy of an archived object to be made available for the specified number of days.
+	Restore(key string, days int, tier string) error
+
+	// List calls fn for every key stored in the backend until fn returns false.
+	List(fn func(key string) bool) error
+
+	// Delete permanently removes an object.
+	Delete(key string) error
+}
+
+// Multipart is implemented by backends able to assemble objects from separately uploaded parts.
+// Parts can be uploaded in any order and pending uploads survive process restarts, which allows to resume them.
+type Multipart interface {
+	// CreateUpload starts a new multipart upload of an object stored with ContentType and the supplied user metadata.
+	CreateUpload(key string, meta map[string]string) (uploadID string, err error)
+
+	// UploadPart uploads a single part. Part numbers start at 1.
+	UploadPart(key, uploadID string, number int, body io.ReadSeeker) (etag string, err error)
+
+	// CompleteUpload assembles the object from the listed parts, which must be sorted by part number.
+	CompleteUpload(key, uploadID string, parts []Part) error
+
+	// AbortUpload discards a pending upload together with all uploaded parts.
+	AbortUpload(key, uploadID string) error
+}
+
+// Copier is implemented by backends able to copy objects without downloading them.
+type Copier interface {
+	// Copy stores a copy of the restored size bytes long object src under dst, with ContentType and the supplied user metadata
+	// replacing the original metadata. The copy is archived like a new upload.
+	Copy(src, dst string, size int64, meta map[string]string) error
+}
+
+// Notifier is implemented by backends able to report completed restores through a message queue.
+type Notifier interface {
+	// Restored waits up to wait for restore completion events in the queue and returns the keys of restored objects accepted by want.
+	// Only events about accepted objects are removed from the queue, all others are made visible again at once,
+	// so that they still reach whoever waits for them.
+	Restored(queue string, wait time.Duration, want func(key string) bool) ([]string, error)
+}
+
+// Part identifies a single uploaded part of a multipart upload
+type Part struct {
+	// Number is the part number
+	Number int
+
+	// ETag is the part ETag as returned by UploadPart
+	ETag string
+}
+
+// Object is a backend-agnostic representation of a HEAD result on a stored file
+type Object struct {
+	// ContentType is the stored Content-Type, ContentType for all ogive archives
+	ContentType string
+
+	// Size is the object size as indicated by Content-Length
+	Size int64
+
+	// LastModified is the object creation date as indicated by Last-Modified
+	LastModified time.Time
+
+	// StorageClass is the object storage class, ex. DEEP_ARCHIVE
+	StorageClass string
+
+	// Restore is the raw value of the x-amz-restore header, empty if no restore was ever requested
+	Restore string
+
+	// Metadata is the user-defined object metadata with canonicalized keys
+	Metadata map[string]string
+}
+
+// S3 is a Backend storing archives in an AWS S3 (or S3-compatible) bucket
+type S3 struct {
+	// svc is the S3 client shared by all requests.
+	svc *s3.S3
+
+	// sess is the AWS session, used to set up clients of other services.
+	sess *session.Session
+
+	// bucket is the name of the bucket holding the archives.
+	bucket string
+}
+
+// Local is a Backend storing archives in a local directory.
+// It emulates Deep Archive restore semantics, so objects have to be restored before they can be downloaded.
+type Local struct {
+	// root is the directory holding the archives.
+	root string
+
+	// delay is the simulated time it takes for a restore request to complete.
+	delay time.Duration
+}
+
+// sidecar is the object metadata stored by Local alongside every archive
+type sidecar struct {
+	// ContentType is the Content-Type supplied on upload.
+	ContentType string
+
+	// Metadata is the user-defined object metadata.
+	Metadata map[string]string
+
+	// Restored is the time at which the last restore was requested, zero if never.
+	Restored time.Time
+
+	// Days is the number of days the restored copy remains available once the restore completes.
+	Days int
+}
+
+// restoreEvent is the subset of an S3 event notification message used to detect completed restores
+type restoreEvent struct {
+	// Event is set on the test message sent when notifications are configured, ex. s3:TestEvent
+	Event string
+
+	// Bucket is the bucket the test message is about
+	Bucket string
+
+	// Records are the individual events
+	Records []struct {
+		// EventName is the event type without the s3: prefix, ex. ObjectRestore:Completed
+		EventName string `json:"eventName"`
+
+		S3 struct {
+			Bucket struct {
+				Name string `json:"name"`
+			} `json:"bucket"`
+
+			Object struct {
+				// Key is the URL-encoded object key
+				Key string `json:"key"`
+			} `json:"object"`
+		} `json:"s3"`
+	}
+}
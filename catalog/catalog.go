@@ -0,0 +1,140 @@
+package catalog
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/gob"
+	"errors"
+	"github.com/awnumar/memguard"
+	"github.com/mgren/ogive/crypt"
+	"golang.org/x/crypto/hkdf"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+const version = uint32(1)
+const magic = "OGCAT"
+
+// Key derives the catalog key from the master key.
+func Key(master *memguard.LockedBuffer) (*memguard.LockedBuffer, error) {
+	buf := make([]byte, 32)
+	_, err := io.ReadFull(hkdf.New(sha256.New, master.Buffer(), nil, []byte("ogive catalog")), buf)
+	if err != nil {
+		return nil, err
+	}
+
+	return memguard.NewImmutableFromBytes(buf)
+}
+
+// New returns an empty catalog kept under the specified state directory, replacing any existing one once saved.
+func New(dir string, key *memguard.LockedBuffer) (c *Catalog, err error) {
+	c = &Catalog{Entries: map[string]Entry{}, fname: filepath.Join(dir, "catalog")}
+	c.gcm, err = crypt.GetGCM(key, 0)
+	return
+}
+
+// Open reads and decrypts the catalog kept under the specified state directory.
+// A missing catalog file results in an empty catalog.
+func Open(dir string, key *memguard.LockedBuffer) (c *Catalog, err error) {
+	c, err = New(dir, key)
+	if err != nil {
+		return
+	}
+
+	var data []byte
+	data, err = ioutil.ReadFile(c.fname)
+	if os.IsNotExist(err) {
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+
+	var f file
+	err = gob.NewDecoder(bytes.NewReader(data)).Decode(&f)
+	if err != nil {
+		return
+	}
+
+	nonceSize := c.gcm.NonceSize()
+	if f.Magic != magic || f.Version != version || len(f.Data) < nonceSize {
+		err = errors.New("Unsupported or corrupted catalog file.")
+		return
+	}
+
+	var plain []byte
+	plain, err = c.gcm.Open(nil, f.Data[:nonceSize], f.Data[nonceSize:], []byte(magic))
+	if err != nil {
+		return
+	}
+
+	err = gob.NewDecoder(bytes.NewReader(plain)).Decode(&c.Entries)
+	return
+}
+
+// Save encrypts the catalog and writes it to disk, replacing the previous one atomically.
+func (c *Catalog) Save() error {
+	var plain bytes.Buffer
+	err := gob.NewEncoder(&plain).Encode(c.Entries)
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, c.gcm.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return err
+	}
+
+	f := file{Magic: magic, Version: version, Data: c.gcm.Seal(nonce, nonce, plain.Bytes(), []byte(magic))}
+
+	var buf bytes.Buffer
+	err = gob.NewEncoder(&buf).Encode(&f)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(c.fname), 0700)
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(c.fname+".tmp", buf.Bytes(), 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(c.fname+".tmp", c.fname)
+}
+
+// SetKey changes the key the catalog is encrypted with when saved.
+func (c *Catalog) SetKey(key *memguard.LockedBuffer) (err error) {
+	c.gcm, err = crypt.GetGCM(key, 0)
+	return
+}
+
+// Add records an archive, replacing any previous entry with the same storage key.
+func (c *Catalog) Add(e Entry) {
+	c.Entries[e.ID] = e
+}
+
+// Remove forgets an archive.
+func (c *Catalog) Remove(id string) {
+	delete(c.Entries, id)
+}
+
+// List returns all entries ordered by storage key, same as the bucket listing.
+func (c *Catalog) List() []Entry {
+	entries := make([]Entry, 0, len(c.Entries))
+	for _, e := range c.Entries {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ID < entries[j].ID })
+
+	return entries
+}
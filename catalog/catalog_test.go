@@ -0,0 +1,62 @@
+package catalog
+
+import (
+	"github.com/awnumar/memguard"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestCatalog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ogive-catalog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	master, err := memguard.NewImmutableRandom(32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := Key(master)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := Open(dir, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.List()) != 0 {
+		t.Fatalf("new catalog lists %v", c.List())
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	c.Add(Entry{ID: "b", Name: "second", Size: 2, Uploaded: now, Nonce: []byte("n")})
+	c.Add(Entry{ID: "a", Name: "first", Size: 1, Uploaded: now})
+	c.Add(Entry{ID: "c", Name: "third"})
+	c.Remove("c")
+	err = c.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err = Open(dir, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := c.List()
+	if len(entries) != 2 || entries[0].Name != "first" || entries[1].Name != "second" || !entries[1].Uploaded.Equal(now) || string(entries[1].Nonce) != "n" {
+		t.Errorf("List() = %+v", entries)
+	}
+
+	other, err := memguard.NewImmutableRandom(32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = Open(dir, other)
+	if err == nil {
+		t.Error("Open() with a wrong key succeeded")
+	}
+}
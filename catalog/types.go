@@ -0,0 +1,54 @@
+package catalog
+
+import (
+	"crypto/cipher"
+	"time"
+)
+
+// Entry describes a single archive stored in the bucket
+type Entry struct {
+	// ID is the storage key of the archive
+	ID string
+
+	// Name is the original unencrypted filename
+	Name string
+
+	// Size is the stored (encrypted) size of the archive
+	Size int64
+
+	// Uploaded is the upload time as indicated by Last-Modified
+	Uploaded time.Time
+
+	// ModTime is the original modification time, zero if unknown
+	ModTime time.Time
+
+	// Nonce is the unique nonce used for key derivation
+	Nonce []byte
+
+	// Checksum is the SHA-256 digest of the original content, empty if unknown
+	Checksum []byte
+}
+
+// Catalog is a local record of archives stored in the bucket, kept encrypted on disk
+type Catalog struct {
+	// Entries maps storage keys to archive entries
+	Entries map[string]Entry
+
+	// fname is the location of the catalog file.
+	fname string
+
+	// gcm is the cipher used to seal the catalog file.
+	gcm cipher.AEAD
+}
+
+// file is the on-disk representation of the catalog.
+type file struct {
+	// Magic is a constant string identifying the file type
+	Magic string
+
+	// Version is the catalog format version
+	Version uint32
+
+	// Data holds the nonce followed by encrypted catalog entries
+	Data []byte
+}
@@ -0,0 +1,110 @@
+package checksum
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+)
+
+// Size is the length of a digest and of the trailer.
+const Size = sha256.Size
+
+// ErrMismatch is returned when content does not match its stored digest.
+var ErrMismatch = errors.New("Checksum mismatch.")
+
+// NewReader returns a Reader hashing r and appending the digest to it.
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: r, h: sha256.New()}
+}
+
+// Read reads from the underlying reader, followed by the trailer.
+func (r *Reader) Read(p []byte) (int, error) {
+	if r.sum == nil {
+		n, err := r.r.Read(p)
+		r.h.Write(p[:n])
+		if err != io.EOF {
+			return n, err
+		}
+
+		r.sum = r.h.Sum(nil)
+		r.trailer = r.sum
+		if n > 0 {
+			return n, nil
+		}
+	}
+
+	if len(r.trailer) == 0 {
+		return 0, io.EOF
+	}
+
+	n := copy(p, r.trailer)
+	r.trailer = r.trailer[n:]
+	return n, nil
+}
+
+// Sum returns the digest of the underlying stream, nil until it has been read entirely.
+func (r *Reader) Sum() []byte {
+	return r.sum
+}
+
+// NewWriter returns a Writer passing everything on to w and comparing its digest with expected,
+// or with the trailer at the end of the stream if expected is nil.
+func NewWriter(w io.Writer, expected []byte) *Writer {
+	return &Writer{w: w, h: sha256.New(), expected: expected}
+}
+
+// Write passes p on to the underlying writer, holding back the last Size bytes when the stream ends with a trailer.
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.expected != nil {
+		w.h.Write(p)
+		return w.w.Write(p)
+	}
+
+	w.tail = append(w.tail, p...)
+	if len(w.tail) <= Size {
+		return len(p), nil
+	}
+
+	out := w.tail[:len(w.tail)-Size]
+	w.h.Write(out)
+	_, err := w.w.Write(out)
+
+	w.tail = append(w.tail[:0], w.tail[len(out):]...)
+	return len(p), err
+}
+
+// Close closes the underlying writer if it is an io.Closer. It does not verify the digest.
+func (w *Writer) Close() error {
+	if c, ok := w.w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// Verify compares the digest of everything passed on with the expected one. It must only be called once the stream has ended.
+func (w *Writer) Verify() error {
+	expected := w.expected
+	if expected == nil {
+		if len(w.tail) != Size {
+			return ErrMismatch
+		}
+		expected = w.tail
+	}
+
+	if !bytes.Equal(w.h.Sum(nil), expected) {
+		return ErrMismatch
+	}
+	return nil
+}
+
+// File returns the digest of the first size bytes of f.
+func File(f io.ReaderAt, size int64) ([]byte, error) {
+	h := sha256.New()
+	_, err := io.Copy(h, io.NewSectionReader(f, 0, size))
+	if err != nil {
+		return nil, err
+	}
+
+	return h.Sum(nil), nil
+}
@@ -0,0 +1,76 @@
+package checksum
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestTrailer(t *testing.T) {
+	content := strings.Repeat("content", 10000)
+	r := NewReader(strings.NewReader(content))
+
+	var stored bytes.Buffer
+	_, err := io.Copy(&stored, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte(content))
+	if !bytes.Equal(r.Sum(), sum[:]) || stored.Len() != len(content)+Size {
+		t.Fatalf("Reader stored %d bytes with digest %x", stored.Len(), r.Sum())
+	}
+
+	var out bytes.Buffer
+	w := NewWriter(&out, nil)
+	// Odd writes split the trailer
+	for data := stored.Bytes(); len(data) > 0; {
+		n := 1000
+		if n > len(data) {
+			n = len(data)
+		}
+		_, err = w.Write(data[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		data = data[n:]
+	}
+	if err = w.Verify(); err != nil || out.String() != content {
+		t.Errorf("Writer passed on %d bytes, Verify() = %v", out.Len(), err)
+	}
+
+	damaged := stored.Bytes()
+	damaged[10] ^= 1
+	w = NewWriter(ioutil.Discard, nil)
+	w.Write(damaged)
+	if err = w.Verify(); err != ErrMismatch {
+		t.Errorf("Verify() of damaged content = %v, want %v", err, ErrMismatch)
+	}
+
+	w = NewWriter(ioutil.Discard, nil)
+	w.Write(damaged[:Size-1])
+	if err = w.Verify(); err != ErrMismatch {
+		t.Errorf("Verify() of a truncated trailer = %v, want %v", err, ErrMismatch)
+	}
+}
+
+func TestExpected(t *testing.T) {
+	sum, err := File(strings.NewReader("content"), 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := NewWriter(ioutil.Discard, sum)
+	w.Write([]byte("content"))
+	if err = w.Verify(); err != nil {
+		t.Errorf("Verify() = %v", err)
+	}
+
+	w = NewWriter(ioutil.Discard, sum)
+	w.Write([]byte("contents"))
+	if err = w.Verify(); err != ErrMismatch {
+		t.Errorf("Verify() of different content = %v, want %v", err, ErrMismatch)
+	}
+}
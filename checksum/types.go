@@ -0,0 +1,38 @@
+package checksum
+
+import (
+	"hash"
+	"io"
+)
+
+// Reader computes the SHA-256 digest of a stream while it is being read.
+// Once the underlying reader is exhausted, the digest itself is appended to the stream as a trailer.
+type Reader struct {
+	// r is the underlying reader.
+	r io.Reader
+
+	// h hashes everything read from r.
+	h hash.Hash
+
+	// trailer holds the part of the digest not read yet, nil until r is exhausted.
+	trailer []byte
+
+	// sum is the final digest, nil until r is exhausted.
+	sum []byte
+}
+
+// Writer computes the SHA-256 digest of a stream while it is being written and compares it with the expected digest.
+// Without an expected digest, the stream is expected to end with a trailer appended by Reader, which is not passed on.
+type Writer struct {
+	// w is the underlying writer.
+	w io.Writer
+
+	// h hashes everything passed on to w.
+	h hash.Hash
+
+	// expected is the expected digest, nil if it is read from the trailer.
+	expected []byte
+
+	// tail holds back the last bytes written, which may belong to the trailer.
+	tail []byte
+}
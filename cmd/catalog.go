@@ -0,0 +1,108 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/awnumar/memguard"
+	"github.com/mgren/ogive/backend"
+	"github.com/mgren/ogive/catalog"
+	"github.com/mgren/ogive/object"
+	"github.com/mgren/ogive/profile"
+	"github.com/mgren/ogive/util"
+	"github.com/spf13/cobra"
+	"os"
+)
+
+func init() {
+	catalogCmd.AddCommand(catalogSyncCmd)
+	rootCmd.AddCommand(catalogCmd)
+}
+
+var catalogCmd = &cobra.Command{
+	Use:   "catalog",
+	Short: "Manage local catalog.",
+	Long:  "Manage the local encrypted catalog of archives, which is updated on every put and read by list --offline.",
+}
+
+var catalogSyncCmd = &cobra.Command{
+	Use:   "sync",
+	Short: "Synchronize catalog with bucket.",
+	Long:  "Rebuild the local catalog from the bucket. Lists entire bucket and HEADs each file.",
+	Run: func(cmd *cobra.Command, args []string) {
+		inner, err := profile.Open(profileFile)
+		if err != nil {
+			util.Fail(err, "Failed to open profile. Wrong password?")
+		}
+
+		kr := openKeyring(inner)
+		ckey, err := catalog.Key(kr.Master())
+		kr.Destroy()
+		if err != nil {
+			util.Fail(err, "Failed to derive catalog key.")
+		}
+
+		c, err := catalog.Open(util.GetStateDir(profileFile), ckey)
+		if err != nil {
+			// Ex. a catalog encrypted with a key rotated on another copy of the profile
+			fmt.Fprintln(os.Stderr, "Failed to open catalog, rebuilding it from scratch.", err)
+			c, err = catalog.New(util.GetStateDir(profileFile), ckey)
+		}
+		ckey.Destroy()
+		if err != nil {
+			util.Fail(err, "Failed to open catalog.")
+		}
+
+		b, err := backend.New(inner)
+		if err != nil {
+			util.Fail(err, "Failed to set up storage backend.")
+		}
+
+		stale := c.Entries
+		c.Entries = map[string]catalog.Entry{}
+		added := 0
+
+		keep := func(key string) {
+			// Keep what is known about the archive rather than dropping it
+			if e, ok := stale[key]; ok {
+				c.Add(e)
+				delete(stale, key)
+			}
+		}
+
+		err = listArchives(b, kr, defaultConcurrency, keep, func(key string, obj object.ResponseObject) {
+			old, ok := stale[key]
+			if ok {
+				delete(stale, key)
+			} else {
+				added++
+			}
+
+			e := catalog.Entry{
+				ID:       key,
+				Name:     obj.Name,
+				Size:     int64(obj.Size),
+				Uploaded: obj.LastModified,
+				Nonce:    obj.Nonce,
+			}
+			if obj.Meta != nil {
+				e.ModTime = obj.Meta.ModTime
+				e.Checksum = obj.Meta.Checksum
+			}
+			// Checksums of streamed archives can only be read from restored copies, keep those recorded on upload
+			if obj.Meta != nil && obj.Meta.Trailer {
+				e.Checksum = old.Checksum
+			}
+			c.Add(e)
+		})
+		if err != nil {
+			util.Fail(err, "Failed to list bucket.")
+		}
+
+		err = c.Save()
+		if err != nil {
+			util.Fail(err, "Failed to save catalog.")
+		}
+
+		fmt.Printf("Catalog synchronized: %d archives, %d added, %d removed.\n", len(c.Entries), added, len(stale))
+		memguard.SafeExit(0)
+	},
+}
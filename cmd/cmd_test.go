@@ -0,0 +1,1125 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/csv"
+	"encoding/json"
+	"github.com/awnumar/memguard"
+	"github.com/mgren/ogive/backend"
+	"github.com/mgren/ogive/input"
+	"github.com/mgren/ogive/object"
+	"github.com/mgren/ogive/profile"
+	"github.com/mgren/ogive/s3test"
+	"github.com/mgren/ogive/shamir"
+	"github.com/mgren/ogive/transfer"
+	"io/ioutil"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mainEnv makes the test binary run ogive instead of the tests, so that commands can be run with their exit codes.
+const mainEnv = "OGIVE_TEST_MAIN"
+
+// password is the password of test profiles.
+const password = "password123"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(mainEnv) != "" {
+		Execute()
+		memguard.SafeExit(0)
+	}
+
+	os.Exit(m.Run())
+}
+
+// testEnv is a profile in a temporary directory, along with the S3 test server it points to, if any.
+type testEnv struct {
+	t       *testing.T
+	dir     string
+	profile string
+	server  *s3test.Server
+}
+
+// newS3Env sets up a profile pointing to a new S3 test server.
+func newS3Env(t *testing.T) *testEnv {
+	e := newEnv(t)
+	e.server = s3test.NewServer("bucket")
+
+	in, err := e.server.Profile()
+	if err != nil {
+		e.close()
+		t.Fatal(err)
+	}
+	e.save(in, e.profile)
+	return e
+}
+
+// newLocalEnv sets up a profile storing archives in a directory with the Local backend.
+func newLocalEnv(t *testing.T, query string) *testEnv {
+	e := newEnv(t)
+
+	in, err := profile.NewInner()
+	if err != nil {
+		e.close()
+		t.Fatal(err)
+	}
+	in.BucketName, in.Region, in.Endpoint = "bucket", "us-east-1", "file://"+filepath.Join(e.dir, "vault")+query
+	e.credentials(in)
+	e.save(in, e.profile)
+	return e
+}
+
+func newEnv(t *testing.T) *testEnv {
+	dir, err := ioutil.TempDir("", "ogive-cmd")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := &testEnv{t: t, dir: dir, profile: filepath.Join(dir, "profile")}
+	e.write("password", password+"\n")
+
+	// Downloads go into an existing directory
+	err = os.Mkdir(e.path("out"), 0700)
+	if err != nil {
+		e.close()
+		t.Fatal(err)
+	}
+	return e
+}
+
+func (e *testEnv) close() {
+	if e.server != nil {
+		e.server.Close()
+	}
+	os.RemoveAll(e.dir)
+}
+
+// credentials sets dummy AWS credentials, which Local backends don't use.
+func (e *testEnv) credentials(in *profile.InnerData) {
+	var err error
+	in.AWSKeyId, err = memguard.NewImmutableFromBytes([]byte("AKIAOGIVETEST"))
+	if err == nil {
+		in.AWSSecret, err = memguard.NewImmutableFromBytes([]byte("ogive-test-secret"))
+	}
+	if err != nil {
+		e.t.Fatal(err)
+	}
+}
+
+func (e *testEnv) save(in *profile.InnerData, fname string) {
+	pwd, err := memguard.NewImmutableFromBytes([]byte(password))
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	defer pwd.Destroy()
+
+	err = profile.Save(pwd, in, fname)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+}
+
+// path returns the location of a file in the temporary directory.
+func (e *testEnv) path(name string) string {
+	return filepath.Join(e.dir, name)
+}
+
+// write creates a file in the temporary directory.
+func (e *testEnv) write(name, content string) string {
+	err := ioutil.WriteFile(e.path(name), []byte(content), 0600)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	return e.path(name)
+}
+
+// read returns the content of a file in the temporary directory.
+func (e *testEnv) read(name string) string {
+	data, err := ioutil.ReadFile(e.path(name))
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	return string(data)
+}
+
+// run runs ogive with the profile and the password file, returning its stdout and exit code.
+// Storage IDs may start with a dash, so they have to follow "--".
+func (e *testEnv) run(stdin string, args ...string) (string, int) {
+	return e.runProfile(e.profile, stdin, args...)
+}
+
+// runProfile is like run, but uses another profile protected with the same password.
+func (e *testEnv) runProfile(fname, stdin string, args ...string) (string, int) {
+	cmd := exec.Command(os.Args[0], append([]string{"--profile", fname, "--password-file", e.path("password")}, args...)...)
+	cmd.Env = append(os.Environ(), mainEnv+"=1")
+	cmd.Dir = e.dir
+	cmd.Stdin = strings.NewReader(stdin)
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err := cmd.Run()
+
+	code := 0
+	if eerr, ok := err.(*exec.ExitError); ok {
+		code = eerr.ExitCode()
+	} else if err != nil {
+		e.t.Fatal(err)
+	}
+
+	e.t.Logf("ogive %s: exit code %d\n%s", strings.Join(args, " "), code, stderr.String())
+	return stdout.String(), code
+}
+
+// mustRun runs ogive and fails the test unless it exits with the expected code.
+func (e *testEnv) mustRun(code int, stdin string, args ...string) string {
+	out, c := e.run(stdin, args...)
+	if c != code {
+		e.t.Fatalf("ogive %s: exit code %d, want %d", strings.Join(args, " "), c, code)
+	}
+	return out
+}
+
+// list returns the storage IDs and the status of the archives by their original names.
+func (e *testEnv) list() (ids, status map[string]string) {
+	out := e.mustRun(0, "", "list", "--output", "csv")
+	records, err := csv.NewReader(strings.NewReader(out)).ReadAll()
+	if err != nil || len(records) == 0 {
+		e.t.Fatalf("list printed %q, %v", out, err)
+	}
+
+	ids, status = map[string]string{}, map[string]string{}
+	for _, r := range records[1:] {
+		ids[r[1]], status[r[1]] = r[0], r[2]
+	}
+	return
+}
+
+// keys returns the storage IDs of all archives.
+func (e *testEnv) keys() []string {
+	if e.server != nil {
+		return e.server.Keys()
+	}
+
+	b, err := backend.NewLocal(e.path("vault/bucket"), 0)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+
+	var keys []string
+	err = b.List(func(key string) bool {
+		keys = append(keys, key)
+		return true
+	})
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	return keys
+}
+
+// random returns random printable content of the given size.
+func random(t *testing.T, size int) string {
+	data := make([]byte, size)
+	_, err := rand.Read(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range data {
+		data[i] = 'a' + data[i]%26
+	}
+	return string(data)
+}
+
+// status runs head and checks its output and exit code.
+func (e *testEnv) status(id, status string, code int) {
+	out := e.mustRun(code, "", "head", "--", id)
+	if strings.TrimSpace(out) != status {
+		e.t.Errorf("head printed %q, want %s", out, status)
+	}
+}
+
+func TestHeadLocal(t *testing.T) {
+	// Long enough to check the ongoing restore, even with the race detector
+	e := newLocalEnv(t, "?restore-delay=3s")
+	defer e.close()
+
+	e.write("file.txt", "content")
+	e.mustRun(0, "", "put", e.path("file.txt"))
+	keys := e.keys()
+	if len(keys) != 1 {
+		t.Fatalf("stored %q", keys)
+	}
+
+	e.status(keys[0], "DEEPS", 2)
+	e.mustRun(1, "", "get", "--", keys[0], e.path("out"))
+	e.mustRun(1, "", "head", "--", "nonexistent")
+
+	e.mustRun(0, "", "restore", "-y", "--", keys[0])
+	e.status(keys[0], "RECOV", 2)
+	e.mustRun(0, "", "restore", "-y", "--", keys[0])
+
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+		if _, code := e.run("", "head", "--", keys[0]); code == 0 {
+			break
+		}
+	}
+	e.status(keys[0], "READY", 0)
+
+	e.mustRun(0, "", "get", "--", keys[0], e.path("out"))
+	if e.read("out/file.txt") != "content" {
+		t.Error("downloaded file differs")
+	}
+}
+
+func testRoundTrip(t *testing.T, e *testEnv) {
+	content := random(t, 200<<10)
+	e.write("file.txt", content)
+	e.mustRun(0, "", "put", e.path("file.txt"))
+
+	keys := e.keys()
+	if len(keys) != 1 {
+		t.Fatalf("stored %q", keys)
+	}
+	id := keys[0]
+
+	out := e.mustRun(0, "", "list")
+	if !strings.Contains(out, id) || !strings.Contains(out, "file.txt") || !strings.Contains(out, "DEEPS") {
+		t.Errorf("list printed %q", out)
+	}
+
+	e.status(id, "DEEPS", 2)
+	e.mustRun(1, "", "get", "--", id, e.path("out"))
+	// Without a restored copy, the checksum recorded in the catalog is used
+	e.mustRun(0, "", "verify", "--", id, e.path("file.txt"))
+
+	e.mustRun(0, "", "restore", "-y", "--", id)
+	e.status(id, "READY", 0)
+
+	e.mustRun(0, "", "get", "--", id, e.path("out"))
+	if e.read("out/file.txt") != content {
+		t.Error("downloaded file differs")
+	}
+
+	// Existing files are never overwritten by fresh downloads
+	e.write("out/file.txt", "changed")
+	e.mustRun(1, "", "get", "--", id, e.path("out"))
+	if e.read("out/file.txt") != "changed" {
+		t.Error("get overwrote an existing file")
+	}
+
+	e.mustRun(0, "", "verify", "--", id, e.path("file.txt"))
+	e.write("file.txt", content[1:]+"x")
+	e.mustRun(2, "", "verify", "--", id, e.path("file.txt"))
+	e.write("file.txt", content[1:])
+	e.mustRun(2, "", "verify", "--", id, e.path("file.txt"))
+
+	e.mustRun(1, "", "delete", "--", id)
+	out = e.mustRun(0, "", "delete", "-y", "--", id)
+	if !strings.Contains(out, "Deleted.") || !strings.Contains(out, "early deletion fee") {
+		t.Errorf("delete printed %q", out)
+	}
+	e.mustRun(1, "", "head", "--", id)
+
+	if len(e.keys()) != 0 {
+		t.Errorf("stored %q after delete", e.keys())
+	}
+	out = e.mustRun(0, "", "list", "--offline")
+	if strings.Contains(out, id) {
+		t.Errorf("list --offline printed %q after delete", out)
+	}
+}
+
+func TestRoundTripS3(t *testing.T) {
+	e := newS3Env(t)
+	defer e.close()
+
+	testRoundTrip(t, e)
+}
+
+func TestRoundTripLocal(t *testing.T) {
+	e := newLocalEnv(t, "")
+	defer e.close()
+
+	testRoundTrip(t, e)
+}
+
+func TestRestoreDelayS3(t *testing.T) {
+	e := newS3Env(t)
+	defer e.close()
+	e.server.RestoreDelay = time.Hour
+
+	e.write("file.txt", "content")
+	e.mustRun(0, "", "put", e.path("file.txt"))
+	id := e.keys()[0]
+
+	e.mustRun(0, "", "restore", "-y", "--", id)
+	e.status(id, "RECOV", 2)
+	e.mustRun(1, "", "get", "--", id, e.path("out"))
+
+	e.server.CompleteRestores()
+	e.status(id, "READY", 0)
+}
+
+func TestDirectory(t *testing.T) {
+	e := newS3Env(t)
+	defer e.close()
+
+	err := os.MkdirAll(e.path("tree/sub"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.write("tree/a", "first")
+	e.write("tree/sub/b", "second")
+	err = os.Symlink("../a", e.path("tree/sub/l"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e.mustRun(0, "", "put", e.path("tree"))
+	id := e.keys()[0]
+	e.mustRun(0, "", "restore", "-y", "--", id)
+	e.mustRun(0, "", "get", "--", id, e.path("out"))
+
+	if e.read("out/tree/a") != "first" || e.read("out/tree/sub/b") != "second" || e.read("out/tree/sub/l") != "first" {
+		t.Error("downloaded directory differs")
+	}
+
+	// Existing files are never overwritten
+	e.mustRun(1, "", "get", "--", id, e.path("out"))
+}
+
+func TestStreams(t *testing.T) {
+	e := newS3Env(t)
+	defer e.close()
+
+	content := random(t, 100<<10)
+	e.mustRun(0, content, "put", "-", "--name", "stream.txt")
+	// Stdin has no filename
+	e.mustRun(1, content, "put", "-")
+
+	id := e.keys()[0]
+	e.mustRun(0, "", "restore", "-y", "--", id)
+	out := e.mustRun(0, "", "get", "--", id, "-")
+	if out != content {
+		t.Error("get - printed different content")
+	}
+
+	out = e.mustRun(0, "", "list")
+	if !strings.Contains(out, "stream.txt") {
+		t.Errorf("list printed %q", out)
+	}
+
+	// The checksum of streams is read from the trailer
+	e.write("stream.txt", content)
+	e.mustRun(0, "", "verify", "--", id, e.path("stream.txt"))
+	e.write("stream.txt", content+"x")
+	e.mustRun(2, "", "verify", "--", id, e.path("stream.txt"))
+}
+
+func TestResumeInvalid(t *testing.T) {
+	e := newS3Env(t)
+	defer e.close()
+
+	e.write("file.txt", "content")
+	// Nothing to resume
+	e.mustRun(1, "", "put", "--resume", e.path("file.txt"))
+	e.mustRun(1, "content", "put", "--resume", "-", "--name", "stream.txt")
+	e.mustRun(1, "", "put", "--resume", e.dir)
+
+	if len(e.keys()) != 0 {
+		t.Errorf("stored %q", e.keys())
+	}
+
+	// State without the wrapped data key can't be resumed, a fresh put discards it
+	stat, err := os.Stat(e.path("file.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err := transfer.NewUpload(e.path("profile.d"), e.path("file.txt"), stat.Size(), stat.ModTime(), "object", "", "", make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = st.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.mustRun(1, "", "put", "--resume", e.path("file.txt"))
+	e.mustRun(0, "", "put", e.path("file.txt"))
+	if len(e.keys()) != 1 {
+		t.Errorf("stored %q", e.keys())
+	}
+	e.mustRun(1, "", "put", "--resume", e.path("file.txt"))
+}
+
+func TestCatalog(t *testing.T) {
+	e := newS3Env(t)
+	defer e.close()
+
+	e.write("a.txt", "first")
+	e.write("b.txt", "second")
+	e.mustRun(0, "", "put", e.path("a.txt"))
+	e.mustRun(0, "", "put", e.path("b.txt"))
+
+	offline := func(names ...string) {
+		out := e.mustRun(0, "", "list", "--offline")
+		if strings.Count(out, "?????") != len(names) {
+			t.Errorf("list --offline printed %q, want %q", out, names)
+		}
+		for _, name := range names {
+			if !strings.Contains(out, name) {
+				t.Errorf("list --offline printed %q, want %q", out, names)
+			}
+		}
+	}
+	offline("a.txt", "b.txt")
+
+	err := os.Remove(e.path("profile.d/catalog"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	offline()
+
+	out := e.mustRun(0, "", "catalog", "sync")
+	if !strings.Contains(out, "2 archives, 2 added, 0 removed") {
+		t.Errorf("catalog sync printed %q", out)
+	}
+	offline("a.txt", "b.txt")
+}
+
+func TestListThrottled(t *testing.T) {
+	e := newS3Env(t)
+	defer e.close()
+
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		e.write(name, name)
+		e.mustRun(0, "", "put", e.path(name))
+	}
+
+	e.server.Throttle(2)
+	out := e.mustRun(0, "", "list", "--concurrency", "2")
+
+	// Rows follow the order of storage IDs
+	last := -1
+	for _, id := range e.keys() {
+		i := strings.Index(out, id)
+		if i < last {
+			t.Fatalf("list printed %q out of order", out)
+		}
+		last = i
+	}
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		if !strings.Contains(out, name) {
+			t.Errorf("list printed %q", out)
+		}
+	}
+
+	e.mustRun(1, "", "list", "--concurrency", "0")
+}
+
+func TestOutput(t *testing.T) {
+	e := newS3Env(t)
+	defer e.close()
+
+	e.write("file.txt", "content")
+	e.mustRun(0, "", "put", e.path("file.txt"))
+	ids, status := e.list()
+	if status["file.txt"] != "DEEPS" {
+		t.Fatalf("list --output csv listed %q, %q", ids, status)
+	}
+	id := ids["file.txt"]
+
+	var records []archiveRecord
+	out := e.mustRun(0, "", "list", "--output", "json")
+	err := json.Unmarshal([]byte(out), &records)
+	if err != nil || len(records) != 1 || records[0].ID != id || records[0].Name != "file.txt" || records[0].RestoreExpiry != nil {
+		t.Errorf("list --output json printed %q, %v", out, err)
+	}
+
+	e.mustRun(0, "", "restore", "-y", "--", id)
+	var record archiveRecord
+	out = e.mustRun(0, "", "head", "--output", "json", "--", id)
+	err = json.Unmarshal([]byte(out), &record)
+	if err != nil || record.Name != "file.txt" || record.Status != "READY" || record.RestoreExpiry == nil {
+		t.Errorf("head --output json printed %q, %v", out, err)
+	}
+
+	e.mustRun(1, "", "list", "--output", "xml")
+}
+
+func TestExpiry(t *testing.T) {
+	e := newS3Env(t)
+	defer e.close()
+
+	e.write("file.txt", "content")
+	e.mustRun(0, "", "put", e.path("file.txt"))
+	id := e.keys()[0]
+
+	out := e.mustRun(0, "", "list")
+	if !strings.Contains(out, "EXPIRES") || !regexp.MustCompile(`DEEPS +- +`+regexp.QuoteMeta(id)).MatchString(out) {
+		t.Errorf("list before restore printed %q", out)
+	}
+
+	e.mustRun(0, "", "restore", "-y", "--", id)
+	out = e.mustRun(0, "", "list")
+	if !regexp.MustCompile(`READY +\d+[dh] \d+[hm] +` + regexp.QuoteMeta(id)).MatchString(out) {
+		t.Errorf("list after restore printed %q", out)
+	}
+}
+
+func TestRestoreConfirm(t *testing.T) {
+	e := newS3Env(t)
+	defer e.close()
+
+	e.write("file.txt", "content")
+	e.mustRun(0, "", "put", e.path("file.txt"))
+	id := e.keys()[0]
+
+	// Redirected stdin can't confirm
+	e.mustRun(1, "y\n", "restore", "--", id)
+	e.mustRun(1, "", "restore", "-y", "--tier", "expedited", "--", id)
+	e.status(id, "DEEPS", 2)
+
+	out := e.mustRun(0, "", "restore", "-y", "--tier", "standard", "--", id)
+	if !strings.Contains(out, "Standard retrieval") || !strings.Contains(out, "Estimated cost: $0.0001") {
+		t.Errorf("restore printed %q", out)
+	}
+	e.status(id, "READY", 0)
+}
+
+func TestEstimateRestore(t *testing.T) {
+	// 100 GiB for 7 days: retrieval, requests and storage of the copy
+	got := estimateRestore(tiers["bulk"], 100<<30, 4, 7)
+	want := 100*0.0025 + 4*0.000025 + 100*0.023/30*7
+	if math.Abs(got-want) > 1e-9 {
+		t.Errorf("estimateRestore() = %f, want %f", got, want)
+	}
+}
+
+func TestRestoreSelection(t *testing.T) {
+	e := newS3Env(t)
+	defer e.close()
+
+	for _, name := range []string{"a.txt", "b.log", "c.txt"} {
+		e.write(name, name)
+		e.mustRun(0, "", "put", e.path(name))
+	}
+	ids, _ := e.list()
+
+	e.mustRun(1, "", "restore", "-y", "--match", "*.txt", "--", ids["a.txt"])
+	e.mustRun(1, "", "restore", "-y", "--match", "[")
+	e.mustRun(1, "", "restore", "-y", "--since", "yesterday")
+
+	tomorrow := time.Now().UTC().AddDate(0, 0, 1).Format("2006-01-02")
+	out := e.mustRun(0, "", "restore", "-y", "--since", tomorrow)
+	if !strings.Contains(out, "No archives selected.") {
+		t.Errorf("restore printed %q", out)
+	}
+
+	today := time.Now().UTC().Format("2006-01-02")
+	out = e.mustRun(0, "", "restore", "-y", "--match", "*.txt", "--until", today)
+	if !strings.Contains(out, "Restoring 2 file(s)") {
+		t.Errorf("restore printed %q", out)
+	}
+
+	_, status := e.list()
+	if status["a.txt"] != "READY" || status["b.log"] != "DEEPS" || status["c.txt"] != "READY" {
+		t.Errorf("list printed status %q", status)
+	}
+}
+
+func TestArchiveFilter(t *testing.T) {
+	f, err := newArchiveFilter("*.txt", "2019-05-01", "2019-05-02")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		name string
+		date string
+		want bool
+	}{
+		{"a.txt", "2019-05-01T00:00:00Z", true},
+		{"a.txt", "2019-05-02T23:59:59Z", true},
+		{"a.txt", "2019-05-03T00:00:00Z", false},
+		{"a.txt", "2019-04-30T23:59:59Z", false},
+		{"a.log", "2019-05-01T12:00:00Z", false},
+		{"dir.txt" + object.DirSuffix, "2019-05-01T12:00:00Z", true},
+	} {
+		date, err := time.Parse(time.RFC3339, c.date)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := f.matches(object.ResponseObject{Name: c.name, LastModified: date}); got != c.want {
+			t.Errorf("matches(%s, %s) = %v, want %v", c.name, c.date, got, c.want)
+		}
+	}
+}
+
+func TestRestoreThenGet(t *testing.T) {
+	e := newS3Env(t)
+	defer e.close()
+	e.server.RestoreDelay = 500 * time.Millisecond
+
+	e.write("a.txt", "first")
+	e.write("b.txt", "second")
+	e.write("c.txt", "third")
+	e.mustRun(0, "", "put", e.path("a.txt"))
+	e.mustRun(0, "", "put", e.path("b.txt"))
+	e.mustRun(0, "", "put", e.path("c.txt"))
+	ids, _ := e.list()
+
+	// The event about c.txt is left for whoever waits for it
+	e.mustRun(0, "", "restore", "-y", "--", ids["c.txt"])
+
+	// Completed restores are only reported by the SQS stand-in
+	e.mustRun(0, "", "restore", "-y", "--then-get", e.path("out"), "--timeout", "1m", "--", ids["a.txt"], ids["b.txt"])
+	if e.read("out/a.txt") != "first" || e.read("out/b.txt") != "second" {
+		t.Error("downloaded files differ")
+	}
+	if e.server.Messages() != 1 {
+		t.Errorf("%d message(s) left in the queue, want 1", e.server.Messages())
+	}
+}
+
+func TestWait(t *testing.T) {
+	e := newS3Env(t)
+	defer e.close()
+	e.server.RestoreDelay = time.Hour
+
+	e.write("a.txt", "first")
+	e.mustRun(0, "", "put", e.path("a.txt"))
+	ids, _ := e.list()
+
+	e.mustRun(0, "", "restore", "-y", "--", ids["a.txt"])
+	e.mustRun(2, "", "head", "--", ids["a.txt"])
+	e.mustRun(2, "", "wait", "--interval", "10ms", "--timeout", "100ms", "--", ids["a.txt"])
+
+	e.server.CompleteRestores()
+	e.mustRun(0, "", "wait", "--interval", "10ms", "--then-get", e.path("out"), "--", ids["a.txt"])
+	if e.read("out/a.txt") != "first" {
+		t.Error("downloaded file differs")
+	}
+}
+
+func TestEarlyDeletion(t *testing.T) {
+	if days := earlyDays(time.Now().AddDate(0, 0, -minStorageDays-1)); days != 0 {
+		t.Errorf("earlyDays() of an old archive = %d", days)
+	}
+	if days := earlyDays(time.Now().AddDate(0, 0, -30).Add(-time.Hour)); days != minStorageDays-30 {
+		t.Errorf("earlyDays() of a 30 days old archive = %d, want %d", days, minStorageDays-30)
+	}
+
+	// A TiB deleted a month early
+	if fee := earlyDeletionFee(1<<40, 30); math.Abs(fee-1024*archivePerGBMonth) > 1e-9 {
+		t.Errorf("earlyDeletionFee() = %f", fee)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	e := newS3Env(t)
+	defer e.close()
+
+	e.write("other.txt", "other")
+	e.mustRun(0, "", "put", e.path("other.txt"))
+
+	// Versions from the oldest, the last two are younger than the minimum storage duration
+	now := time.Now()
+	dates := []time.Time{
+		time.Date(2018, 1, 10, 0, 0, 0, 0, time.UTC),
+		time.Date(2018, 6, 10, 0, 0, 0, 0, time.UTC),
+		time.Date(2019, 1, 5, 0, 0, 0, 0, time.UTC),
+		now.AddDate(0, 0, -10),
+		now,
+	}
+	known := map[string]bool{e.keys()[0]: true}
+	for i, date := range dates {
+		e.write("file.txt", strconv.Itoa(i))
+		e.mustRun(0, "", "put", e.path("file.txt"))
+		for _, id := range e.keys() {
+			if !known[id] {
+				known[id] = true
+				e.server.SetModified(id, date)
+			}
+		}
+	}
+
+	e.mustRun(1, "", "prune", "--match", "file.txt")
+	out := e.mustRun(0, "", "prune", "--keep-last", "1", "--match", "file.txt")
+	if !strings.Contains(out, "3 version(s) to prune") || !strings.Contains(out, "1 version(s) held back") || !strings.Contains(out, "Nothing deleted") {
+		t.Errorf("prune printed %q", out)
+	}
+	if len(e.keys()) != 6 {
+		t.Fatalf("dry run deleted archives, %d left", len(e.keys()))
+	}
+
+	e.mustRun(0, "", "prune", "--keep-yearly", "2", "--match", "file.txt", "--delete", "-y")
+	if len(e.keys()) != 4 {
+		t.Fatalf("%d archives left after pruning, want 4", len(e.keys()))
+	}
+
+	out = e.mustRun(0, "", "prune", "--keep-last", "1", "--delete", "-y", "--force")
+	if !strings.Contains(out, "early deletion fee") {
+		t.Errorf("prune --force printed %q", out)
+	}
+	ids, _ := e.list()
+	if len(e.keys()) != 2 || ids["other.txt"] == "" || ids["file.txt"] == "" {
+		t.Errorf("%q left after pruning, want the latest versions", ids)
+	}
+}
+
+func TestRetention(t *testing.T) {
+	var versions []archiveRecord
+	for i, date := range []string{"2019-01-01", "2019-03-03", "2019-03-04", "2019-03-05", "2019-03-11"} {
+		d, err := time.Parse("2006-01-02", date)
+		if err != nil {
+			t.Fatal(err)
+		}
+		versions = append(versions, archiveRecord{ID: strconv.Itoa(i), LastModified: d, Created: d})
+	}
+
+	reasons := retention{Last: 1, Weekly: 2, Monthly: 2}.apply(versions)
+	want := map[string]string{
+		"4": "last weekly monthly",
+		"3": "weekly",
+		"0": "monthly",
+	}
+	if len(reasons) != len(want) {
+		t.Errorf("apply() = %q", reasons)
+	}
+	for id, w := range want {
+		if strings.Join(reasons[id], " ") != w {
+			t.Errorf("apply() kept %s for %q, want %q", id, reasons[id], w)
+		}
+	}
+	if versions[0].ID != "4" {
+		t.Errorf("apply() did not sort versions from the newest")
+	}
+}
+
+func TestAttributes(t *testing.T) {
+	e := newS3Env(t)
+	defer e.close()
+
+	mtime := time.Date(2019, 5, 1, 12, 0, 0, 0, time.UTC)
+	e.write("file.txt", "content")
+	err := os.Chmod(e.path("file.txt"), 0640)
+	if err == nil {
+		err = os.Chtimes(e.path("file.txt"), mtime, mtime)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e.mustRun(0, "", "put", e.path("file.txt"))
+	id := e.keys()[0]
+
+	out := e.mustRun(0, "", "list", "--mtime")
+	if !strings.Contains(out, "2019-May-01") {
+		t.Errorf("list --mtime printed %q", out)
+	}
+	out = e.mustRun(0, "", "list", "--output", "csv")
+	if !strings.Contains(out, ",mtime\n") || !strings.Contains(out, ",2019-05-01T12:00:00Z\n") {
+		t.Errorf("list --output csv printed %q", out)
+	}
+
+	e.mustRun(0, "", "restore", "-y", "--", id)
+	e.mustRun(0, "", "get", "--", id, e.path("out"))
+	f, err := os.Stat(e.path("out/file.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Mode().Perm() != 0640 || !f.ModTime().Equal(mtime) {
+		t.Errorf("downloaded file has mode %v and modification time %v", f.Mode(), f.ModTime())
+	}
+}
+
+func TestRekey(t *testing.T) {
+	e := newS3Env(t)
+	defer e.close()
+
+	e.write("a.txt", "first")
+	e.mustRun(0, "", "put", e.path("a.txt"))
+	ids, _ := e.list()
+	old := ids["a.txt"]
+
+	out := e.mustRun(0, "", "rekey", "-y")
+	if !strings.Contains(out, "All files are encrypted with the active key.") {
+		t.Errorf("rekey printed %q", out)
+	}
+
+	e.mustRun(0, "", "key", "rotate")
+	out = e.mustRun(0, "", "key", "list")
+	if lines := strings.Split(strings.TrimSpace(out), "\n"); len(lines) != 2 || !strings.HasSuffix(lines[0], " retired") || !strings.HasSuffix(lines[1], " active") {
+		t.Errorf("key list printed %q", out)
+	}
+	// The catalog is re-encrypted along with the rotation
+	out = e.mustRun(0, "", "list", "--offline")
+	if !strings.Contains(out, old) {
+		t.Errorf("list --offline printed %q", out)
+	}
+	e.mustRun(2, "", "rekey", "-y")
+
+	e.mustRun(0, "", "restore", "-y", "--", old)
+	e.mustRun(0, "", "rekey", "-y")
+
+	ids, status := e.list()
+	if len(ids) != 1 || ids["a.txt"] == old || status["a.txt"] != "DEEPS" {
+		t.Fatalf("list after rekey = %v %v", ids, status)
+	}
+	e.mustRun(1, "", "head", "--", old)
+
+	e.mustRun(0, "", "restore", "-y", "--", ids["a.txt"])
+	out = e.mustRun(0, "", "get", "--", ids["a.txt"], "-")
+	if out != "first" {
+		t.Errorf("get - printed %q", out)
+	}
+	e.mustRun(0, "", "verify", "--", ids["a.txt"], e.path("a.txt"))
+
+	// Files encrypted with the active key are only re-encrypted if named
+	old = ids["a.txt"]
+	e.mustRun(0, "", "rekey", "-y", "--reencrypt")
+	e.mustRun(0, "", "rekey", "-y", "--reencrypt", "--", old)
+	ids, _ = e.list()
+	if len(ids) != 1 || ids["a.txt"] == old {
+		t.Fatalf("list after rekey --reencrypt = %v", ids)
+	}
+
+	e.mustRun(0, "", "restore", "-y", "--", ids["a.txt"])
+	out = e.mustRun(0, "", "get", "--", ids["a.txt"], "-")
+	if out != "first" {
+		t.Errorf("get - printed %q", out)
+	}
+}
+
+func TestWriteOnly(t *testing.T) {
+	e := newLocalEnv(t, "")
+	defer e.close()
+
+	recipient := strings.TrimSpace(e.mustRun(0, "", "key", "recipient"))
+
+	in := profile.NewWriteOnly(recipient)
+	in.BucketName, in.Region, in.Endpoint = "bucket", "us-east-1", "file://"+e.path("vault")
+	e.credentials(in)
+	writeOnly := e.path("write-only")
+	e.save(in, writeOnly)
+
+	e.write("a.txt", "first")
+	_, code := e.runProfile(writeOnly, "", "put", e.path("a.txt"))
+	if code != 0 {
+		t.Fatalf("put with the write-only profile: exit code %d", code)
+	}
+	_, code = e.runProfile(writeOnly, "", "key", "rotate")
+	if code != 1 {
+		t.Errorf("key rotate with the write-only profile: exit code %d, want 1", code)
+	}
+
+	// Only the profile of the recipient can read the file
+	ids, _ := e.list()
+	e.mustRun(0, "", "restore", "-y", "--", ids["a.txt"])
+	out := e.mustRun(0, "", "get", "--", ids["a.txt"], "-")
+	if out != "first" {
+		t.Errorf("get - printed %q", out)
+	}
+
+	// The checksum is stored with the archive, not only in the catalog of the uploading profile
+	e.mustRun(0, "", "verify", "--", ids["a.txt"], e.path("a.txt"))
+
+	// Streams carry their checksum in the archive only, which is read once restored
+	_, code = e.runProfile(writeOnly, "stream", "put", "-", "--name", "s.txt")
+	if code != 0 {
+		t.Fatalf("put - with the write-only profile: exit code %d", code)
+	}
+	e.write("s.txt", "stream")
+	ids, _ = e.list()
+	e.mustRun(3, "", "verify", "--", ids["s.txt"], e.path("s.txt"))
+	e.mustRun(0, "", "restore", "-y", "--", ids["s.txt"])
+	e.mustRun(0, "", "verify", "--", ids["s.txt"], e.path("s.txt"))
+	e.write("s.txt", "other")
+	e.mustRun(2, "", "verify", "--", ids["s.txt"], e.path("s.txt"))
+
+	// The write-only profile can't read it back
+	_, code = e.runProfile(writeOnly, "", "get", "--", ids["a.txt"], "-")
+	if code != 1 {
+		t.Errorf("get with the write-only profile: exit code %d, want 1", code)
+	}
+
+	// Filenames chosen by a write-only host must not lead out of the download directory
+	r, err := object.ParseRecipient(recipient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"../x", "../x" + object.DirSuffix} {
+		req, err := object.Prepare(nil, []*object.Recipient{r}, name, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		local, err := backend.NewLocal(filepath.Join(e.path("vault"), "bucket"), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = local.Put(req.Name, strings.NewReader(""), 0, req.Metadata())
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = local.Restore(req.Name, 1, "Bulk")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		e.mustRun(1, "", "get", "--", req.Name, e.path("out"))
+		if _, err := os.Lstat(e.path("x")); !os.IsNotExist(err) {
+			t.Errorf("get of %q created a file outside of the download directory", name)
+		}
+	}
+}
+
+func TestRecipients(t *testing.T) {
+	e := newLocalEnv(t, "")
+	defer e.close()
+
+	in, err := profile.NewInner()
+	if err != nil {
+		t.Fatal(err)
+	}
+	in.BucketName, in.Region, in.Endpoint = "bucket", "us-east-1", "file://"+e.path("vault")
+	e.credentials(in)
+	other := e.path("other")
+	e.save(in, other)
+
+	recipient, code := e.runProfile(other, "", "key", "recipient")
+	if code != 0 {
+		t.Fatalf("key recipient with the other profile: exit code %d", code)
+	}
+
+	e.write("a.txt", "first")
+	e.mustRun(1, "", "put", "--recipient", "ogive1invalid", e.path("a.txt"))
+	e.mustRun(0, "", "put", "--recipient", strings.TrimSpace(recipient), e.path("a.txt"))
+	id := e.keys()[0]
+	e.mustRun(0, "", "restore", "-y", "--", id)
+
+	// Both profiles can read the file
+	out, code := e.runProfile(other, "", "get", "--", id, "-")
+	if code != 0 || out != "first" {
+		t.Errorf("get - with the other profile printed %q, exit code %d", out, code)
+	}
+	out = e.mustRun(0, "", "get", "--", id, "-")
+	if out != "first" {
+		t.Errorf("get - printed %q", out)
+	}
+
+	// Archives of other profiles can be restored by ID, but not read
+	e.write("b.txt", "second")
+	_, code = e.runProfile(other, "", "put", e.path("b.txt"))
+	if code != 0 {
+		t.Fatalf("put with the other profile: exit code %d", code)
+	}
+	for _, key := range e.keys() {
+		if key != id {
+			e.mustRun(0, "", "restore", "-y", "--", key)
+			e.status(key, "READY", 0)
+			e.mustRun(1, "", "get", "--", key, "-")
+		}
+	}
+}
+
+func TestKeySplitCombine(t *testing.T) {
+	e := newLocalEnv(t, "")
+	defer e.close()
+
+	e.write("a.txt", "first")
+	e.mustRun(0, "", "put", e.path("a.txt"))
+	id := e.keys()[0]
+	e.mustRun(0, "", "restore", "-y", "--", id)
+
+	e.mustRun(1, "", "key", "split", "--shares", "3", "--threshold", "1")
+	out := e.mustRun(0, "", "key", "split", "--shares", "3", "--threshold", "2")
+	var shares []string
+	for _, line := range strings.Split(out, "\n") {
+		if strings.HasPrefix(line, "OGS-") {
+			shares = append(shares, line)
+		}
+	}
+	if len(shares) != 3 {
+		t.Fatalf("key split printed %q", out)
+	}
+
+	// An existing profile is never overwritten
+	e.mustRun(1, shares[0]+"\n"+shares[2]+"\n", "key", "combine")
+
+	// Damaged shares with a valid checksum don't combine to the master keys
+	damaged, err := shamir.ParseShare(shares[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	damaged.Y[0] ^= 1
+	_, code := e.runProfile(e.path("damaged"), damaged.String()+"\n"+shares[0]+"\n", "key", "combine")
+	if code != 1 {
+		t.Errorf("key combine with a damaged share: exit code %d, want 1", code)
+	}
+	if _, err := os.Stat(e.path("damaged")); !os.IsNotExist(err) {
+		t.Errorf("key combine with a damaged share saved a profile: %v", err)
+	}
+
+	answers := []string{shares[2], shares[2], shares[0], "AKIAOGIVETEST", "ogive-test-secret", "bucket", "us-east-1", "file://" + e.path("vault"), ""}
+	_, code = e.runProfile(e.path("combined"), strings.Join(answers, "\n")+"\n", "key", "combine")
+	if code != 0 {
+		t.Fatalf("key combine: exit code %d", code)
+	}
+
+	out, code = e.runProfile(e.path("combined"), "", "get", "--", id, "-")
+	if code != 0 || out != "first" {
+		t.Errorf("get - with the combined profile printed %q, exit code %d", out, code)
+	}
+	// The combined profile starts without a catalog
+	_, code = e.runProfile(e.path("combined"), "", "verify", "--", id, e.path("a.txt"))
+	if code != 0 {
+		t.Errorf("verify with the combined profile: exit code %d", code)
+	}
+}
+
+func TestReinitQueue(t *testing.T) {
+	e := newLocalEnv(t, "")
+	defer e.close()
+
+	queue := func() string {
+		input.PasswordFile = e.path("password")
+		defer func() { input.PasswordFile = "" }()
+
+		in, err := profile.Open(e.profile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return in.NotifyQueue
+	}
+
+	// Empty answers keep the queue
+	keys := "AKIAOGIVETEST\nogive-test-secret\n"
+	e.mustRun(0, keys+"https://sqs.example.com/queue\n", "init", "--reinit")
+	if queue() != "https://sqs.example.com/queue" {
+		t.Errorf("NotifyQueue = %q after setting it", queue())
+	}
+	e.mustRun(0, keys+"\n", "init", "--reinit")
+	if queue() != "https://sqs.example.com/queue" {
+		t.Errorf("NotifyQueue = %q after keeping it", queue())
+	}
+	e.mustRun(0, keys+"-\n", "init", "--reinit")
+	if queue() != "" {
+		t.Errorf("NotifyQueue = %q after removing it", queue())
+	}
+
+	// Input ending early leaves the profile in place
+	e.mustRun(1, keys, "init", "--reinit")
+	if _, err := os.Stat(e.profile); err != nil {
+		t.Fatal("profile moved away by a failed reinit:", err)
+	}
+
+	e.write("a.txt", "first")
+	e.mustRun(0, "", "put", e.path("a.txt"))
+}
@@ -0,0 +1,149 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"github.com/awnumar/memguard"
+	"github.com/mgren/ogive/backend"
+	"github.com/mgren/ogive/catalog"
+	"github.com/mgren/ogive/object"
+	"github.com/mgren/ogive/profile"
+	"github.com/mgren/ogive/util"
+	"github.com/spf13/cobra"
+	"os"
+	"strconv"
+	"time"
+)
+
+func init() {
+	deleteCmd.Flags().BoolVarP(&yes, "yes", "y", false, "Skip confirmation. Required when stdin is not interactive.")
+	rootCmd.AddCommand(deleteCmd)
+}
+
+const (
+	// minStorageDays is the Deep Archive minimum storage duration, deleting objects earlier is charged as if they were stored this long.
+	minStorageDays = 180
+
+	// archivePerGBMonth is the us-east-1 price of storing a GiB in Deep Archive for a month in USD.
+	archivePerGBMonth = 0.00099
+)
+
+var deleteCmd = &cobra.Command{
+	Use:   "delete <storage_id>...",
+	Short: "Delete files.",
+	Long:  "Permanently delete files from the bucket and the local catalog. The original filenames are printed and the deletion has to be confirmed, unless --yes is set. Files stored for less than the 180-day Deep Archive minimum storage duration are marked, since deleting them incurs an early deletion fee.",
+	Args:  cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		inner, err := profile.Open(profileFile)
+		if err != nil {
+			util.Fail(err, "Failed to open profile. Wrong password?")
+		}
+
+		kr := openKeyring(inner)
+		ckey, err := catalog.Key(kr.Master())
+		kr.Destroy()
+		if err != nil {
+			util.Fail(err, "Failed to derive catalog key.")
+		}
+
+		b, err := backend.New(inner)
+		if err != nil {
+			util.Fail(err, "Failed to set up storage backend.")
+		}
+
+		var targets []archiveRecord
+		for i := range args {
+			res, err := b.Head(args[i])
+			if err != nil {
+				util.Fail(err, "Failed to head object "+args[i]+".")
+			}
+
+			obj, err := object.Parse(res, &args[i], kr, false)
+			if err != nil {
+				util.Fail(err, "Invalid file metadata "+args[i]+".")
+			}
+
+			targets = append(targets, newRecord(args[i], obj))
+		}
+
+		printDeletion(targets)
+		confirm("Delete permanently?", "deletion")
+
+		failed := deleteArchives(b, ckey, targets)
+		if failed > 0 {
+			util.Fail(errors.New(strconv.Itoa(failed)+" deletion(s) failed."), "Failed to delete files.")
+		}
+
+		memguard.SafeExit(0)
+	},
+}
+
+// printDeletion lists archives about to be deleted, together with the estimated early deletion fee.
+func printDeletion(targets []archiveRecord) {
+	size, fee, early := int64(0), 0.0, 0
+	for _, r := range targets {
+		size += r.Size
+		note := ""
+		if days := earlyDays(r.LastModified); days > 0 {
+			early++
+			fee += earlyDeletionFee(r.Size, days)
+			note = fmt.Sprintf(" (stored for less than %d days, %d days remaining)", minStorageDays, days)
+		}
+		fmt.Printf("  %s %s %s %s%s\n", util.SizeIEC(r.Size), r.LastModified.Local().Format("2006-Jan-02"), r.ID, r.Name, note)
+	}
+
+	fmt.Printf("Deleting %d file(s) totaling %s.\n", len(targets), util.SizeIEC(size))
+	if early > 0 {
+		fmt.Printf("Warning: %d file(s) are younger than the Deep Archive minimum storage duration of %d days.\n", early, minStorageDays)
+		fmt.Printf("Deleting them incurs an early deletion fee of about $%.4f, based on us-east-1 prices.\n", fee)
+	}
+}
+
+// deleteArchives deletes archives one by one, reporting the result for each of them, and removes the deleted ones from the catalog.
+// It returns the number of failed deletions.
+func deleteArchives(b backend.Backend, ckey *memguard.LockedBuffer, targets []archiveRecord) (failed int) {
+	defer ckey.Destroy()
+
+	var deleted []string
+	for _, r := range targets {
+		err := b.Delete(r.ID)
+		if err != nil {
+			failed++
+			fmt.Fprintln(os.Stderr, r.ID+" "+r.Name+": Failed to delete.", err)
+			continue
+		}
+
+		fmt.Println(r.ID + " " + r.Name + ": Deleted.")
+		deleted = append(deleted, r.ID)
+	}
+
+	c, err := catalog.Open(util.GetStateDir(profileFile), ckey)
+	if err == nil {
+		for _, id := range deleted {
+			c.Remove(id)
+		}
+		err = c.Save()
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to update catalog, run \"ogive catalog sync\" to fix it.", err)
+	}
+
+	return
+}
+
+// earlyDays returns the number of days remaining until an archive uploaded at the given time reaches the minimum storage duration.
+func earlyDays(uploaded time.Time) int {
+	left := uploaded.AddDate(0, 0, minStorageDays).Sub(time.Now())
+	if left <= 0 {
+		return 0
+	}
+
+	// Partial days are charged as whole days
+	return int((left + 24*time.Hour - 1) / (24 * time.Hour))
+}
+
+// earlyDeletionFee returns the estimated fee in USD for deleting an archive of the given size with days remaining of the minimum storage duration.
+func earlyDeletionFee(size int64, days int) float64 {
+	return float64(size) / (1 << 30) * archivePerGBMonth * float64(days) / 30
+}
@@ -1,29 +1,54 @@
 package cmd
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"github.com/awnumar/memguard"
-	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/mgren/ogive/archive"
+	"github.com/mgren/ogive/backend"
+	"github.com/mgren/ogive/checksum"
 	"github.com/mgren/ogive/crypt"
 	"github.com/mgren/ogive/object"
 	"github.com/mgren/ogive/profile"
 	"github.com/mgren/ogive/progress"
+	"github.com/mgren/ogive/transfer"
 	"github.com/mgren/ogive/util"
 	"github.com/spf13/cobra"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
 )
 
 func init() {
 	getCmd.Flags().StringVarP(&output, "output", "o", "", "Override destination filename.")
+	getCmd.Flags().BoolVarP(&resumeGet, "resume", "r", false, "Resume an interrupted download of the file.")
+	getCmd.Flags().BoolVarP(&force, "force", "f", false, "Download even if the restored copy is likely to expire before the download completes.")
 	rootCmd.AddCommand(getCmd)
 }
 
 var output string
+var resumeGet bool
+var force bool
+
+const (
+	// partSize is the length of a single ranged download request when streaming.
+	partSize = int64(50 << 20)
+
+	// assumedThroughput is a conservative download speed in bytes per second, used to estimate download time.
+	assumedThroughput = int64(10 << 20)
+
+	// expiryMargin is the minimum time a restored copy should remain available after the estimated download time.
+	expiryMargin = time.Hour
+)
 
 var getCmd = &cobra.Command{
-	Use:   "get <source_file> <destination_directory>",
+	Use:   "get <source_file> <destination_directory|->",
 	Short: "Download file.",
-	Long:  "Download and decrypt file, saving it under the original filename.",
+	Long:  "Download and decrypt file, saving it under the original filename. Directory archives are unpacked into a directory with the original name. If the destination is -, plaintext is written to stdout, with directory archives written out as a tar stream. Downloads of files into a directory can be resumed with --resume if interrupted. The decrypted content is verified against the checksum stored with the archive and the command fails if they don't match.",
 	Args:  cobra.MinimumNArgs(2),
 	Run: func(cmd *cobra.Command, args []string) {
 		inner, err := profile.Open(profileFile)
@@ -31,79 +56,389 @@ var getCmd = &cobra.Command{
 			util.Fail(err, "Failed to open profile. Wrong password?")
 		}
 
-		gcm, err := crypt.GetGCM(inner.Key, 32)
+		kr := openKeyring(inner)
+
+		b, err := backend.New(inner)
 		if err != nil {
-			util.Fail(err, "Failed to set up decryptors.")
+			util.Fail(err, "Failed to set up storage backend.")
+		}
+
+		err = getFile(b, kr, args[0], args[1], output)
+		kr.Destroy()
+		if gerr, ok := err.(*getError); ok {
+			util.Fail(gerr.err, gerr.hint)
 		}
 
-		sess := util.GetSession(inner)
-		svc := s3.New(sess)
+		memguard.SafeExit(0)
+	},
+}
+
+// Error returns the underlying error followed by the hint.
+func (e *getError) Error() string {
+	return e.err.Error() + " " + e.hint
+}
 
-		res, err := svc.HeadObject(&s3.HeadObjectInput{
-			Bucket: &inner.BucketName,
-			Key:    &args[0],
-		})
+// getFile downloads and decrypts a single restored file into dest, a directory or - for stdout, optionally under a different name.
+// Unlike the get command, it returns a *getError instead of exiting, so that it can be used to download multiple files.
+func getFile(b backend.Backend, kr *object.Keyring, id, dest, name string) error {
+	res, err := b.Head(id)
+	if err != nil {
+		return &getError{err, "Failed to head object."}
+	}
+
+	obj, err := object.Parse(res, &id, kr, true)
+	if err != nil {
+		return &getError{err, "Invalid file metadata."}
+	}
+	defer obj.Key.Destroy()
+
+	if obj.Restore != "READY" {
+		return &getError{errors.New("File status is " + obj.Restore + "."), "File not restored, please run ogive restore first."}
+	}
+
+	isDir := strings.HasSuffix(obj.Name, object.DirSuffix)
+	toStdout := dest == "-"
+	if resumeGet && (isDir || toStdout) {
+		return &getError{errors.New("Only downloads of files into a directory can be resumed."), "Can't resume download."}
+	}
+
+	if name == "" {
+		name = strings.TrimSuffix(obj.Name, object.DirSuffix)
+	}
+
+	// Keep stdout clean when it carries the data
+	info := io.Writer(os.Stdout)
+	if toStdout {
+		info = os.Stderr
+		name = "stdout"
+	}
+
+	fmt.Fprintln(info, "File will be saved as", name)
+	err = checkExpiry(obj.Expiry, res.Size, info)
+	if err != nil {
+		return err
+	}
+
+	if !isDir && !toStdout {
+		return downloadFile(b, id, res.Size, obj.Key, dest, name, obj.Meta)
+	}
+
+	var out io.WriteCloser
+	extracted := make(chan error, 1)
+
+	if toStdout {
+		// Directory archives are written out as a plain tar stream
+		out = os.Stdout
+		extracted <- nil
+	} else {
+		out, err = getArchiveWriter(filepath.Join(dest, name), extracted)
 		if err != nil {
-			util.Fail(err, "Failed to head object.")
+			return &getError{err, "Failed to open file for writing."}
 		}
+	}
+
+	// The checksum writer also strips the trailer, so that it never reaches the output
+	var sum *checksum.Writer
+	if hasChecksum(obj.Meta) {
+		sum = checksum.NewWriter(out, obj.Meta.Checksum)
+		out = sum
+	} else {
+		fmt.Fprintln(info, "No checksum stored, skipping verification.")
+	}
+
+	writer, err := crypt.NewCryptWriter(obj.Key, out)
+	if err != nil {
+		return &getError{err, "Failed to open file for writing."}
+	}
+	// This writer is initiated with 2 bytes already written.
+	// Since sio supports two different ciphers, it lazily initiates only one of them when it knows which one
+	// i.e. when the second byte is written to the writer.
+	// The destruction must be delayed until that happens, otherwise the underlying AES asm code will run into a memory violation during key expansion.
+	// Since there is no out-of-the-box way to notify this routine of when that happens, the writer is initialized via magic.
+	// Both sio version and cipher are pinned for the sio.EncryptReader, so all uploaded files will always have the same header.
+	// The first two bytes (0x20 0x00) are written manually using WriterAtFake which then omits first two bytes on the very first call.
+	// As bad as it sounds, it relies on exported constants, it's just that they weren't supposed to be used this way.
+	obj.Key.Destroy()
+	defer writer.Close()
+
+	proxyWriter := progress.NewWriter(writer)
+	done := make(chan bool)
+	go progress.TrackProgress(proxyWriter, int(res.Size)-2, done)
+	defer proxyWriter.Finish()
+
+	// Streams can only be written sequentially, so ranges are requested one after another.
+	fake := util.NewWriterAtFake(proxyWriter)
+
+	for offset := int64(0); offset < res.Size; offset += partSize {
+		err = getRange(b, id, offset, partSize, fake)
+		if err != nil {
+			return &getError{err, "Failed to download file."}
+		}
+	}
+
+	// Closing the writer also authenticates the final package, empty files have none.
+	err = writer.Close()
+	if err != nil && res.Size > 0 {
+		return &getError{err, "Failed to decrypt file."}
+	}
+
+	err = <-extracted
+	if err != nil {
+		return &getError{err, "Failed to extract archive."}
+	}
+
+	proxyWriter.Finish()
+	<-done
+
+	if sum != nil {
+		err = sum.Verify()
+		if err != nil {
+			return &getError{err, "Downloaded content does not match the archive, it may be corrupted."}
+		}
+		fmt.Fprintln(info, "Checksum verified.")
+	}
+
+	fmt.Fprintf(info, "Successfully downloaded %s as %s.\n", id, name)
+	return nil
+}
+
+// checkExpiry refuses downloads that are unlikely to complete before the restored copy expires and warns about those that might not.
+func checkExpiry(expiry time.Time, size int64, info io.Writer) error {
+	if expiry.IsZero() {
+		return nil
+	}
+
+	left := time.Until(expiry)
+	estimate := time.Duration(size/assumedThroughput) * time.Second
+
+	msg := fmt.Sprintf("Restored copy expires in %s, downloading %s is estimated to take up to %s.",
+		util.DurationShort(left), util.SizeIEC(size), util.DurationShort(estimate))
+
+	if left < estimate && !force {
+		return &getError{errors.New(msg), "Extend the restore with ogive restore --lifetime, or use --force to download anyway."}
+	}
+
+	if left < estimate+expiryMargin {
+		fmt.Fprintln(info, "Warning:", msg)
+	}
+
+	return nil
+}
+
+// downloadFile performs a journaled parallel download of the object into dir, removing the journal once it completes.
+// When resuming, the output file recorded in the journal is used instead of fname.
+// The original permissions and modification time are restored from meta, unless it is nil.
+func downloadFile(b backend.Backend, key string, size int64, fkey *memguard.LockedBuffer, dir, fname string, meta *object.Meta) error {
+	stateDir := util.GetStateDir(profileFile)
+
+	var st *transfer.DownloadState
+	var err error
 
-		obj, err := object.Parse(res, &args[0], gcm, inner.Key)
-		inner.Key.Destroy()
+	if resumeGet {
+		st, err = transfer.LoadDownload(stateDir, key)
 		if err != nil {
-			util.Fail(err, "Invalid file metadata")
+			return &getError{err, "No interrupted download of " + key + " found."}
 		}
-		if obj.Restore != "READY" {
-			util.Fail(err, "File not restored, please run ogive restore first.")
+		if st.Size != size {
+			return &getError{errors.New(key + " changed size after the download started."), "Can't resume download."}
+		}
+		fmt.Printf("Resuming download of %s as %s, %d parts already downloaded\n", key, st.Output, len(st.Parts))
+	} else {
+		f, err := os.Stat(dir)
+		if err != nil {
+			return &getError{err, "Failed to open file for writing."}
+		}
+		if !f.Mode().IsDir() {
+			return &getError{errors.New(dir + " is not a directory."), "Failed to open file for writing."}
 		}
 
-		if output == "" {
-			output = obj.Name
+		abs, err := filepath.Abs(filepath.Join(dir, fname))
+		if err != nil {
+			return &getError{err, "Failed to resolve destination path."}
 		}
 
-		fmt.Println("File will be saved as", output)
+		st = transfer.NewDownload(stateDir, key, abs, size)
+	}
+
+	// Only a resumed download may continue writing into an existing file
+	flag := os.O_RDWR
+	if !resumeGet {
+		flag |= os.O_CREATE | os.O_EXCL
+	}
+
+	dst, err := os.OpenFile(st.Output, flag, 0600)
+	if err != nil {
+		return &getError{err, "Failed to open file for writing."}
+	}
+	defer dst.Close()
 
-		writer, err := crypt.GetCryptWriter(obj.Key, args[1], output)
+	if !resumeGet {
+		err = st.Save()
 		if err != nil {
-			util.Fail(err, "Failed to open file for writing.")
-		}
-		// This writer is initiated with 2 bytes already written.
-		// Since sio supports two different ciphers, it lazily initiates only one of them when it knows which one
-		// i.e. when the second byte is written to the writer.
-		// The destruction must be delayed until that happens, otherwise the underlying AES asm code will run into a memory violation during key expansion.
-		// Since there is no out-of-the-box way to notify this routine of when that happens, the writer is initialized via magic.
-		// Both sio version and cipher are pinned for the sio.EncryptReader, so all uploaded files will always have the same header.
-		// The first two bytes (0x20 0x00) are written manually using WriterAtFake which then omits first two bytes on the very first call.
-		// As bad as it sounds, it relies on exported constants, it's just that they weren't supposed to be used this way.
-		obj.Key.Destroy()
-		defer writer.Close()
-
-		proxyWriter := progress.NewWriter(writer)
-		done := make(chan bool)
-		go progress.TrackProgress(&proxyWriter, int(*res.ContentLength)-2, done)
-
-		// WriterAtFake works, because s3manager.Downloader.Concurrency = 1 assures sequential write.
-		// Using actual WriterAt with AES is technically possible but requires every At to be a multiple of block size.
-		// This could also be implemented with an intermediate buffer of size s3manager.Download.Concurreny * s3manager.Download.PartSize,
-		// but Download doesn't guarantee a write of size s3manager.Download.PartSize even for non-final parts, which makes it much more difficult to do.
-		// Best way would be probably to request with s3.GetObjectInput.Range specified and implement concurrency locally.
-		fake := util.NewWriterAtFake(&proxyWriter)
-
-		_, err = s3manager.NewDownloader(sess, func(u *s3manager.Downloader) {
-			u.PartSize = 50 << 20
-			u.Concurrency = 1
-		}).Download(&fake, &s3.GetObjectInput{
-			Bucket: &inner.BucketName,
-			Key:    &args[0],
-		})
+			os.Remove(st.Output)
+			return &getError{err, "Failed to prepare download."}
+		}
+	}
+
+	counter := &progress.Counter{}
+	done := make(chan bool)
+	go progress.TrackProgress(counter, int(size), done)
+	defer counter.Finish()
+
+	err = transfer.Download(b, st, fkey, dst, counter)
+	if err != nil {
+		return &getError{err, "Failed to download file. Use \"ogive get --resume " + key + " " + dir + "\" to continue."}
+	}
+
+	counter.Finish()
+	<-done
+
+	err = truncateOutput(dst, size)
+	if err != nil {
+		return &getError{err, "Failed to write file."}
+	}
+
+	if hasChecksum(meta) {
+		err = verifyFile(dst, size, meta)
 		if err != nil {
-			util.Fail(err, "Failed to download file.")
+			return &getError{err, "Downloaded file does not match the archive, it may be corrupted."}
 		}
+		fmt.Println("Checksum verified.")
+	} else {
+		fmt.Println("No checksum stored, skipping verification.")
+	}
 
-		<-done
-		fmt.Printf("Successfully downloaded %s as %s. Exiting...\n", args[0], output)
+	err = dst.Close()
+	if err != nil {
+		return &getError{err, "Failed to write file."}
+	}
 
-		// This is needed because memguard.SafeExit relies on os.Exit, which doesn't honour defer stack.
-		writer.Close()
-		memguard.SafeExit(0)
-	},
+	err = restoreAttrs(st.Output, meta)
+	if err != nil {
+		return &getError{err, "Failed to restore file attributes."}
+	}
+
+	err = st.Remove()
+	if err != nil {
+		return &getError{err, "Failed to remove download state."}
+	}
+
+	fmt.Printf("Successfully downloaded %s as %s.\n", key, st.Output)
+	return nil
+}
+
+// hasChecksum reports whether the archive carries a checksum of its content, either in meta or in a trailer.
+func hasChecksum(meta *object.Meta) bool {
+	return meta != nil && (len(meta.Checksum) > 0 || meta.Trailer)
+}
+
+// verifyFile compares the content of a downloaded file with its checksum, given the stored (encrypted) size.
+// A trailer is only cut off regular files once it matches, so that a failed download stays intact for inspection.
+func verifyFile(f *os.File, size int64, meta *object.Meta) error {
+	plain, err := crypt.DecryptedSize(size)
+	if err != nil {
+		return err
+	}
+
+	expected := meta.Checksum
+	if meta.Trailer {
+		if plain < checksum.Size {
+			return checksum.ErrMismatch
+		}
+		plain -= checksum.Size
+
+		expected = make([]byte, checksum.Size)
+		_, err = f.ReadAt(expected, plain)
+		if err != nil {
+			return err
+		}
+	}
+
+	sum, err := checksum.File(f, plain)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(sum, expected) {
+		return checksum.ErrMismatch
+	}
+
+	stat, err := f.Stat()
+	if err != nil || !meta.Trailer || !stat.Mode().IsRegular() {
+		return err
+	}
+
+	return f.Truncate(plain)
+}
+
+// truncateOutput cuts off anything past the decrypted content of a regular file, given the stored (encrypted) size,
+// since the output of a resumed download may have been written to in the meantime.
+func truncateOutput(f *os.File, size int64) error {
+	plain, err := crypt.DecryptedSize(size)
+	if err != nil {
+		return err
+	}
+
+	stat, err := f.Stat()
+	if err != nil || !stat.Mode().IsRegular() || stat.Size() <= plain {
+		return err
+	}
+
+	return f.Truncate(plain)
+}
+
+// restoreAttrs applies the original permissions and modification time to a downloaded regular file.
+// Other destinations, ex. block devices, and streamed archives without attributes are left untouched.
+func restoreAttrs(fname string, meta *object.Meta) error {
+	if meta == nil || meta.ModTime.IsZero() || !meta.Mode.IsRegular() {
+		return nil
+	}
+
+	f, err := os.Stat(fname)
+	if err != nil || !f.Mode().IsRegular() {
+		return err
+	}
+
+	err = os.Chmod(fname, meta.Mode.Perm())
+	if err != nil {
+		return err
+	}
+
+	return os.Chtimes(fname, meta.ModTime, meta.ModTime)
+}
+
+// getRange copies a single range of the object into w.
+func getRange(b backend.Backend, key string, offset, length int64, w io.Writer) error {
+	body, err := b.Get(key, offset, length)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	_, err = io.Copy(w, body)
+	return err
+}
+
+// getArchiveWriter returns a writer that extracts the written tar archive into dir.
+// The result of the extraction is sent over the passed channel once the writer is closed.
+func getArchiveWriter(dir string, extracted chan<- error) (io.WriteCloser, error) {
+	f, err := os.Stat(filepath.Dir(dir))
+	if err != nil {
+		return nil, err
+	}
+	if !f.Mode().IsDir() {
+		return nil, errors.New(filepath.Dir(dir) + " is not a directory.")
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		err := archive.Extract(pr, dir)
+		if err == nil {
+			// Consume any trailing padding, so that the writer never blocks
+			_, err = io.Copy(ioutil.Discard, pr)
+		}
+		pr.CloseWithError(err)
+		extracted <- err
+	}()
+
+	return pw, nil
 }
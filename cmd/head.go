@@ -3,45 +3,76 @@ package cmd
 import (
 	"fmt"
 	"github.com/awnumar/memguard"
-	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/mgren/ogive/backend"
 	"github.com/mgren/ogive/object"
 	"github.com/mgren/ogive/profile"
 	"github.com/mgren/ogive/util"
 	"github.com/spf13/cobra"
+	"os"
+	"time"
 )
 
 func init() {
+	headCmd.Flags().StringVar(&outputFormat, "output", "", "Output format, json or csv. Prints the status only by default.")
 	rootCmd.AddCommand(headCmd)
 }
 
 var headCmd = &cobra.Command{
 	Use:   "head <storage_id>",
 	Short: "Head a specific file.",
-	Long:  "Head a specific ogive file on S3 and retrieve its current archival status. Prints out file status and exits with code: 0 - file available for download, 1 - error occurred, 2 - file not available for download.",
+	Long:  "Head a specific ogive file on S3 and retrieve its current archival status. Prints out file status (or all file details with --output), how long a restored file remains downloadable, and exits with code: 0 - file available for download, 1 - error occurred, 2 - file not available for download.",
 	Args:  cobra.MinimumNArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
 		inner, err := profile.Open(profileFile)
 		if err != nil {
 			util.Fail(err, "Failed to open profile. Wrong password?")
 		}
-		inner.Key.Destroy() // Not needed here
 
-		svc := s3.New(util.GetSession(inner))
+		var kr *object.Keyring
+		if outputFormat != "" {
+			// The original name is only printed with details
+			kr = openKeyring(inner)
+			kr.Destroy()
+		} else if !inner.WriteOnly() {
+			inner.Key.Destroy()
+		}
 
-		res, err := svc.HeadObject(&s3.HeadObjectInput{
-			Bucket: &inner.BucketName,
-			Key:    &args[0],
-		})
+		printer, err := newArchivePrinter(outputFormat, false)
+		if err != nil {
+			util.Fail(err, "Invalid output format.")
+		}
+
+		b, err := backend.New(inner)
+		if err != nil {
+			util.Fail(err, "Failed to set up storage backend.")
+		}
+
+		res, err := b.Head(args[0])
 		if err != nil {
 			util.Fail(err, "Failed to head object.")
 		}
 
-		obj, err := object.Parse(res, nil, nil, nil)
+		obj, err := object.Parse(res, &args[0], kr, false)
 		if err != nil {
 			util.Fail(err, "Failed to parse response.")
 		}
 
-		fmt.Println(obj.Restore)
+		if outputFormat == "" {
+			fmt.Println(obj.Restore)
+
+			// Keep stdout limited to the status, scripts compare it
+			if !obj.Expiry.IsZero() {
+				fmt.Fprintf(os.Stderr, "Downloadable for %s more, until %s\n", util.DurationShort(time.Until(obj.Expiry)), obj.Expiry.Local().Format("2006-Jan-02 15:04 MST"))
+			}
+		} else {
+			err = printer.Print(newRecord(args[0], obj))
+			if err == nil {
+				err = printer.Close()
+			}
+			if err != nil {
+				util.Fail(err, "Failed to print file details.")
+			}
+		}
 
 		if obj.Restore != "READY" {
 			memguard.SafeExit(2)
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"github.com/awnumar/memguard"
 	"github.com/mgren/ogive/input"
+	"github.com/mgren/ogive/object"
 	"github.com/mgren/ogive/profile"
 	"github.com/mgren/ogive/util"
 	"github.com/spf13/cobra"
@@ -12,37 +13,52 @@ import (
 )
 
 func init() {
-	initCmd.Flags().BoolVarP(&reinit, "reinit", "r", false, "Reinitialize an existing profile to change password and/or AWS keys. Old profile is stored as \"<name>.bak\".")
+	initCmd.Flags().BoolVarP(&reinit, "reinit", "r", false, "Reinitialize an existing profile to change password, AWS keys and/or notification queue. Old profile is stored as \"<name>.bak\".")
+	initCmd.Flags().StringVar(&initRecipient, "recipient", "", "Set up a write-only profile without master key, encrypting files to the recipient printed by \"ogive key recipient\".")
 	rootCmd.AddCommand(initCmd)
 }
 
 var reinit bool
+var initRecipient string
 
 var initCmd = &cobra.Command{
 	Use:   "init",
 	Short: "Set up an ogive profile.",
-	Long:  "Set up an ogive profile, including your cryptographic key and S3 bucket location.",
+	Long:  "Set up an ogive profile, including your cryptographic key and S3 bucket location. Write-only profiles set up with --recipient hold no master key, they can only upload files, which are decrypted with the profile the recipient belongs to.",
 	Run: func(cmd *cobra.Command, args []string) {
 		var profileInner *profile.InnerData
 		var err error
 
-		if reinit {
+		if reinit && initRecipient != "" {
+			util.Fail(errors.New("Conflicting flags."), "The recipient can't be changed with --reinit.")
+		}
+
+		switch {
+		case reinit:
 			profileInner, err = profile.Open(profileFile)
-		} else {
+		case initRecipient != "":
+			var r *object.Recipient
+			r, err = object.ParseRecipient(initRecipient)
+			if err == nil {
+				profileInner = profile.NewWriteOnly(r.String())
+			}
+		default:
 			profileInner, err = profile.NewInner()
 		}
 		if err != nil {
 			util.Fail(err, "Failed to generate profile.")
 		}
-		defer profileInner.Key.Destroy()
+		if !profileInner.WriteOnly() {
+			defer profileInner.Key.Destroy()
+		}
 
-		pwd, err := input.GetMaskedInput("Enter password", "", "", 64, 8)
+		pwd, err := input.GetPassword("Enter password", 64, 8)
 		if err != nil {
 			util.Fail(err, "Failed to read password.")
 		}
 		defer pwd.Destroy()
 
-		pwd2, err := input.GetMaskedInput("Confirm password", "", "", 64, 8)
+		pwd2, err := input.GetPassword("Confirm password", 64, 8)
 		if err != nil {
 			util.Fail(err, "Failed to read password.")
 		}
@@ -63,14 +79,22 @@ var initCmd = &cobra.Command{
 		defer profileInner.AWSKeyId.Destroy()
 		defer profileInner.AWSSecret.Destroy()
 
+		// This remains unchanged on reinit
+		if !reinit {
+			profileInner.BucketName, profileInner.Region, profileInner.Endpoint = getInputs()
+		}
+
+		// Write-only profiles never restore, nor can their credentials read the queue
+		if !profileInner.WriteOnly() {
+			profileInner.NotifyQueue = getQueueInput(profileInner.NotifyQueue)
+		}
+
+		// All input is read before the old profile is moved away
 		if reinit {
 			err = os.Rename(profileFile, profileFile+".bak")
 			if err != nil {
 				util.Fail(err, "Failed to back up profile.")
 			}
-		} else {
-			// This remains unchanged on reinit
-			profileInner.BucketName, profileInner.Region, profileInner.Endpoint = getInputs()
 		}
 
 		err = profile.Save(pwd, profileInner, profileFile)
@@ -140,3 +164,22 @@ func getMaskedInputs(allowBlank bool) (id, secret *memguard.LockedBuffer) {
 
 	return
 }
+
+// getQueueInput asks for the optional restore notification queue, keeping the current one on empty input.
+// The current queue is removed with "-".
+func getQueueInput(current string) string {
+	prompt := "Enter SQS queue URL for restore notifications (optional)"
+	if current != "" {
+		prompt = "Enter SQS queue URL for restore notifications (optional, - to remove)"
+	}
+
+	buf, err := input.GetInput(prompt, current, "", 256, 0)
+	if err != nil {
+		util.Fail(err, "Failed to generate profile.")
+	}
+	if buf == nil || string(buf.Buffer()) == "-" {
+		return ""
+	}
+
+	return string(buf.Buffer())
+}
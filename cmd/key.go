@@ -0,0 +1,338 @@
+package cmd
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/awnumar/memguard"
+	"github.com/mgren/ogive/catalog"
+	"github.com/mgren/ogive/input"
+	"github.com/mgren/ogive/object"
+	"github.com/mgren/ogive/profile"
+	"github.com/mgren/ogive/shamir"
+	"github.com/mgren/ogive/util"
+	"github.com/spf13/cobra"
+	"os"
+)
+
+func init() {
+	keyCmd.AddCommand(keyListCmd)
+	keyCmd.AddCommand(keyRotateCmd)
+	keyCmd.AddCommand(keyRecipientCmd)
+	keySplitCmd.Flags().IntVar(&splitShares, "shares", 0, "Number of shares to create, at most 255.")
+	keySplitCmd.Flags().IntVar(&splitThreshold, "threshold", 0, "Number of shares required to restore the keys, at least 2.")
+	keyCmd.AddCommand(keySplitCmd)
+	keyCmd.AddCommand(keyCombineCmd)
+	rootCmd.AddCommand(keyCmd)
+}
+
+var splitShares, splitThreshold int
+
+var keyCmd = &cobra.Command{
+	Use:   "key",
+	Short: "Manage master keys.",
+	Long:  "Manage the master keys stored in the profile. Every archive records the ID of the master key it is encrypted with.",
+}
+
+var keyListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List master keys.",
+	Long:  "List the IDs of all master keys in the profile, oldest first. New archives are encrypted with the active key, the last one.",
+	Run: func(cmd *cobra.Command, args []string) {
+		inner, err := profile.Open(profileFile)
+		if err != nil {
+			util.Fail(err, "Failed to open profile. Wrong password?")
+		}
+
+		kr := openKeyring(inner)
+		kr.Destroy()
+
+		for _, id := range kr.IDs() {
+			if id == kr.Active() {
+				fmt.Println(id, "active")
+			} else {
+				fmt.Println(id, "retired")
+			}
+		}
+
+		memguard.SafeExit(0)
+	},
+}
+
+var keyRotateCmd = &cobra.Command{
+	Use:   "rotate",
+	Short: "Add a new active master key.",
+	Long:  "Generate a new master key and make it the active one. Retired keys are kept in the profile, so that existing archives remain readable; use rekey to re-encrypt them with the new key. The local catalog is re-encrypted with the new key. Old profile is stored as \"<name>.bak\".",
+	Run: func(cmd *cobra.Command, args []string) {
+		pwd, err := input.GetPassword("Enter password", 64, 8)
+		if err != nil {
+			util.Fail(err, "Failed to read password.")
+		}
+		defer pwd.Destroy()
+
+		inner, err := profile.Load(profileFile, pwd)
+		if err != nil {
+			util.Fail(err, "Failed to open profile. Wrong password?")
+		}
+		if inner.WriteOnly() {
+			util.Fail(profile.ErrWriteOnly, "Write-only profiles have no master key to rotate.")
+		}
+
+		// The catalog is encrypted with a key derived from the active key
+		ckey, err := catalog.Key(inner.Key)
+		if err != nil {
+			util.Fail(err, "Failed to derive catalog key.")
+		}
+
+		c, err := catalog.Open(util.GetStateDir(profileFile), ckey)
+		ckey.Destroy()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to open catalog, run \"ogive catalog sync\" after the rotation to rebuild it.", err)
+			c = nil
+		}
+
+		err = inner.Rotate()
+		if err != nil {
+			util.Fail(err, "Failed to generate key.")
+		}
+		id := object.KeyID(inner.Key)
+
+		if c != nil {
+			ckey, err = catalog.Key(inner.Key)
+			if err == nil {
+				err = c.SetKey(ckey)
+				ckey.Destroy()
+			}
+			if err != nil {
+				util.Fail(err, "Failed to derive catalog key.")
+			}
+		}
+
+		err = os.Rename(profileFile, profileFile+".bak")
+		if err != nil {
+			util.Fail(err, "Failed to back up profile.")
+		}
+
+		err = profile.Save(pwd, inner, profileFile)
+		if err != nil {
+			util.Fail(err, "Failed to save profile.")
+		}
+
+		if c != nil {
+			err = c.Save()
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Failed to update catalog, run \"ogive catalog sync\" to fix it.", err)
+			}
+		}
+
+		fmt.Println("New archives will be encrypted with key", id+".")
+		fmt.Println("Run \"ogive rekey\" to re-encrypt existing archives.")
+		memguard.SafeExit(0)
+	},
+}
+
+var keyRecipientCmd = &cobra.Command{
+	Use:   "recipient",
+	Short: "Print the recipient public key.",
+	Long:  "Print the X25519 public key of the profile, to be passed to \"ogive init --recipient\" when setting up a write-only profile. Files uploaded with such profiles can only be decrypted with this one. Profiles created before identities were supported get a new one, the old profile is stored as \"<name>.bak\".",
+	Run: func(cmd *cobra.Command, args []string) {
+		pwd, err := input.GetPassword("Enter password", 64, 8)
+		if err != nil {
+			util.Fail(err, "Failed to read password.")
+		}
+		defer pwd.Destroy()
+
+		inner, err := profile.Load(profileFile, pwd)
+		if err != nil {
+			util.Fail(err, "Failed to open profile. Wrong password?")
+		}
+
+		if inner.WriteOnly() {
+			fmt.Println(inner.Recipient)
+			memguard.SafeExit(0)
+		}
+
+		created := inner.Identity == nil
+		if created {
+			inner.Identity, err = object.NewIdentity()
+			if err != nil {
+				util.Fail(err, "Failed to generate identity.")
+			}
+		}
+
+		r, err := object.IdentityRecipient(inner.Identity)
+		if err != nil {
+			util.Fail(err, "Failed to read identity.")
+		}
+
+		if created {
+			err = os.Rename(profileFile, profileFile+".bak")
+			if err != nil {
+				util.Fail(err, "Failed to back up profile.")
+			}
+
+			err = profile.Save(pwd, inner, profileFile)
+			if err != nil {
+				util.Fail(err, "Failed to save profile.")
+			}
+		}
+
+		fmt.Println(r)
+		memguard.SafeExit(0)
+	},
+}
+
+var keySplitCmd = &cobra.Command{
+	Use:   "split",
+	Short: "Split the master keys into Shamir shares.",
+	Long:  "Split the master keys and the identity of the profile into --shares printable Shamir shares, any --threshold of which restore them with \"ogive key combine\", while fewer reveal nothing about them. Every share ends with a checksum, so that typos are caught. The shares are printed to stdout and have to be kept as safe as the profile itself, each in a different place.",
+	Run: func(cmd *cobra.Command, args []string) {
+		if splitThreshold < 2 || splitThreshold > splitShares || splitShares > 255 {
+			util.Fail(errors.New("Invalid number of shares."), "The threshold must be at least 2 and at most --shares, which is at most 255.")
+		}
+
+		inner, err := profile.Open(profileFile)
+		if err != nil {
+			util.Fail(err, "Failed to open profile. Wrong password?")
+		}
+		if inner.WriteOnly() {
+			util.Fail(profile.ErrWriteOnly, "Write-only profiles have no master key to split.")
+		}
+
+		secret, err := inner.KeyMaterial()
+		if err != nil {
+			util.Fail(err, "Failed to read master keys.")
+		}
+
+		// The combined keys are verified against the ID of the active key, which is stored with every archive anyway
+		var id [8]byte
+		_, err = hex.Decode(id[:], []byte(object.KeyID(inner.Key)))
+		if err != nil {
+			util.Fail(err, "Failed to read master keys.")
+		}
+
+		shares, err := shamir.Split(secret.Buffer(), id, splitShares, splitThreshold)
+		secret.Destroy()
+		if err != nil {
+			util.Fail(err, "Failed to split master keys.")
+		}
+
+		fmt.Printf("Any %d of the following %d shares restore the master keys with \"ogive key combine\".\n", splitThreshold, splitShares)
+		for i, s := range shares {
+			fmt.Printf("\nShare %d of %d:\n%s\n", i+1, len(shares), s)
+			memguard.WipeBytes(s.Y)
+		}
+
+		memguard.SafeExit(0)
+	},
+}
+
+var keyCombineCmd = &cobra.Command{
+	Use:   "combine",
+	Short: "Rebuild a profile from Shamir shares.",
+	Long:  "Rebuild a profile from shares created by \"ogive key split\". Shares are asked for until enough of them are entered, then the new profile password and the bucket settings are asked for like in init. An existing profile is never overwritten. The local catalog can be rebuilt with \"ogive catalog sync\" afterwards.",
+	Run: func(cmd *cobra.Command, args []string) {
+		if _, err := os.Stat(profileFile); err == nil {
+			util.Fail(errors.New(profileFile+" already exists."), "Choose another profile location with --profile.")
+		}
+
+		var shares []shamir.Share
+		for len(shares) == 0 || len(shares) < int(shares[0].Threshold) {
+			buf, err := input.GetMaskedInput(fmt.Sprintf("Enter share %d", len(shares)+1), "", "", 1024, 1)
+			if err != nil {
+				util.Fail(err, "Failed to read share.")
+			}
+
+			s, err := shamir.ParseShare(string(buf.Buffer()))
+			buf.Destroy()
+			if err == nil && hasShare(shares, s.X) {
+				err = errors.New("Share was already entered.")
+			}
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				continue
+			}
+			shares = append(shares, s)
+		}
+
+		secret, err := shamir.Combine(shares)
+		if err != nil {
+			util.Fail(err, "Failed to combine shares.")
+		}
+
+		buf, err := memguard.NewImmutableFromBytes(secret)
+		if err != nil {
+			util.Fail(err, "Failed to combine shares.")
+		}
+
+		inner, err := profile.FromKeyMaterial(buf)
+		buf.Destroy()
+		if err == nil && object.KeyID(inner.Key) != hex.EncodeToString(shares[0].KeyID[:]) {
+			err = errors.New("Shares don't combine to the master keys.")
+		}
+		if err != nil {
+			util.Fail(err, "Failed to restore master keys, a share may be damaged.")
+		}
+		id := object.KeyID(inner.Key)
+
+		pwd, err := input.GetPassword("Enter password", 64, 8)
+		if err != nil {
+			util.Fail(err, "Failed to read password.")
+		}
+		defer pwd.Destroy()
+
+		pwd2, err := input.GetPassword("Confirm password", 64, 8)
+		if err != nil {
+			util.Fail(err, "Failed to read password.")
+		}
+		defer pwd2.Destroy()
+
+		assertEqual(pwd, pwd2)
+
+		inner.AWSKeyId, inner.AWSSecret = getMaskedInputs(false)
+		inner.BucketName, inner.Region, inner.Endpoint = getInputs()
+		inner.NotifyQueue = getQueueInput("")
+
+		err = profile.Save(pwd, inner, profileFile)
+		if err != nil {
+			util.Fail(err, "Failed to save profile.")
+		}
+
+		fmt.Println("Profile successfully restored, new archives will be encrypted with key", id+".")
+		fmt.Println("Run \"ogive catalog sync\" to rebuild the local catalog.")
+		memguard.SafeExit(0)
+	},
+}
+
+// hasShare reports whether the share evaluated at x is among the shares.
+func hasShare(shares []shamir.Share, x byte) bool {
+	for _, s := range shares {
+		if s.X == x {
+			return true
+		}
+	}
+	return false
+}
+
+// openKeyring sets up a keyring holding all master keys and the identity of the profile, destroying the originals.
+func openKeyring(inner *profile.InnerData) *object.Keyring {
+	if inner.WriteOnly() {
+		util.Fail(profile.ErrWriteOnly, "Write-only profiles can only upload files, use the profile holding the master key.")
+	}
+
+	keys, err := inner.Keys()
+	inner.Key.Destroy()
+	if inner.Retired != nil {
+		inner.Retired.Destroy()
+	}
+	if err != nil {
+		util.Fail(err, "Failed to read master keys.")
+	}
+
+	kr, err := object.NewKeyring(keys, inner.Identity)
+	if err != nil {
+		util.Fail(err, "Failed to set up decryptors.")
+	}
+
+	return kr
+}
@@ -1,88 +1,217 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
 	"github.com/InVisionApp/tabular"
 	"github.com/awnumar/memguard"
-	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/mgren/ogive/crypt"
+	"github.com/mgren/ogive/backend"
+	"github.com/mgren/ogive/catalog"
 	"github.com/mgren/ogive/object"
 	"github.com/mgren/ogive/profile"
 	"github.com/mgren/ogive/util"
 	"github.com/spf13/cobra"
 	"os"
+	"strconv"
+	"time"
 )
 
 func init() {
+	listCmd.Flags().BoolVar(&offline, "offline", false, "Read archives from the local catalog instead of the bucket.")
+	listCmd.Flags().IntVar(&concurrency, "concurrency", defaultConcurrency, "Number of objects headed in parallel.")
+	listCmd.Flags().StringVar(&outputFormat, "output", "", "Output format, json or csv. Prints a table by default.")
+	listCmd.Flags().BoolVar(&showMtime, "mtime", false, "Show the original modification time instead of the upload date, where known.")
 	rootCmd.AddCommand(listCmd)
 
 	tab = tabular.New()
 	tab.Col("SIZE", "SIZE", 10)
 	tab.Col("DATE", "DATE", 12)
 	tab.Col("STAT", "STATUS", 6)
+	tab.Col("EXP", "EXPIRES", 7)
 	tab.Col("ID", "STORAGE ID", 10)
 	tab.Col("NAME", "FILENAME", 8)
 }
 
 var tab tabular.Table
+var offline bool
+var concurrency int
+var outputFormat string
+var showMtime bool
+
+const (
+	// defaultConcurrency is the default number of parallel HEAD requests.
+	defaultConcurrency = 8
+
+	// headRetries is the number of times a throttled HEAD request is retried.
+	headRetries = 6
+
+	// headBackoff is the delay before the first retry of a throttled HEAD request, doubled with every retry.
+	headBackoff = 500 * time.Millisecond
+)
 
 var listCmd = &cobra.Command{
 	Use:   "list",
 	Short: "List archives.",
-	Long:  "Lists all ogive archives in bucket. Lists entire bucket and HEADs each file.",
+	Long:  "Lists all ogive archives in bucket. Lists entire bucket and HEADs each file. READY archives show how long they remain downloadable. With --offline, only the local catalog is read and restore status is unknown.",
 	Run: func(cmd *cobra.Command, args []string) {
 		inner, err := profile.Open(profileFile)
 		if err != nil {
 			util.Fail(err, "Failed to open profile. Wrong password?")
 		}
 
-		gcm, err := crypt.GetGCM(inner.Key, 32)
-		inner.Key.Destroy()
+		if offline {
+			listOffline(inner)
+		}
+
+		if concurrency < 1 {
+			util.Fail(errors.New("Invalid concurrency "+strconv.Itoa(concurrency)), "At least one worker is needed.")
+		}
+
+		kr := openKeyring(inner)
+		kr.Destroy()
+
+		b, err := backend.New(inner)
 		if err != nil {
-			util.Fail(err, "Failed to set up decryptors.")
+			util.Fail(err, "Failed to set up storage backend.")
 		}
 
-		svc := s3.New(util.GetSession(inner))
-		format := tab.Print(tabular.All)
-
-		err = svc.ListObjectsV2Pages(&s3.ListObjectsV2Input{
-			Bucket: &inner.BucketName,
-		}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
-			for _, key := range page.Contents {
-				res, err := svc.HeadObject(&s3.HeadObjectInput{
-					Bucket: &inner.BucketName,
-					Key:    key.Key,
-				})
-				if err != nil {
-					fmt.Fprintln(os.Stderr, "Failed to head object", *key.Key, err)
-					continue
-				}
-
-				// Just to make the list show less clutter in case the bucket is not ogive-exclusive
-				if *res.ContentType != "application/x-ogive" {
-					continue
-				}
-
-				obj, err := object.Parse(res, key.Key, gcm, nil)
-				if err != nil {
-					fmt.Fprintln(os.Stderr, "Invalid file metadata", *key.Key, err)
-					continue
-				}
-
-				// https://golang.org/src/time/format.go
-				fmt.Printf(format,
-					util.SizeIEC(int64(obj.Size)),
-					obj.LastModified.Format("2006-Jan-02"),
-					obj.Restore, *key.Key, obj.Name)
+		printer, err := newArchivePrinter(outputFormat, true)
+		if err != nil {
+			util.Fail(err, "Invalid output format.")
+		}
 
+		err = listArchives(b, kr, concurrency, nil, func(key string, obj object.ResponseObject) {
+			err := printer.Print(newRecord(key, obj))
+			if err != nil {
+				util.Fail(err, "Failed to print archive.")
 			}
-			return !lastPage
 		})
 
 		if err != nil {
 			util.Fail(err, "Failed to list bucket.")
 		}
 
+		err = printer.Close()
+		if err != nil {
+			util.Fail(err, "Failed to print archives.")
+		}
+
 		memguard.SafeExit(0)
 	},
 }
+
+// listOffline prints archives recorded in the local catalog, then exits.
+func listOffline(inner *profile.InnerData) {
+	kr := openKeyring(inner)
+	ckey, err := catalog.Key(kr.Master())
+	kr.Destroy()
+	if err != nil {
+		util.Fail(err, "Failed to derive catalog key.")
+	}
+
+	c, err := catalog.Open(util.GetStateDir(profileFile), ckey)
+	ckey.Destroy()
+	if err != nil {
+		util.Fail(err, "Failed to open catalog.")
+	}
+
+	printer, err := newArchivePrinter(outputFormat, true)
+	if err != nil {
+		util.Fail(err, "Invalid output format.")
+	}
+
+	for _, e := range c.List() {
+		r := archiveRecord{ID: e.ID, Name: e.Name, Status: "?????", Size: e.Size, LastModified: e.Uploaded, Created: e.Uploaded}
+		if mtime := e.ModTime; !mtime.IsZero() {
+			r.ModTime = &mtime
+		}
+
+		err = printer.Print(r)
+		if err != nil {
+			util.Fail(err, "Failed to print archive.")
+		}
+	}
+
+	err = printer.Close()
+	if err != nil {
+		util.Fail(err, "Failed to print archives.")
+	}
+
+	memguard.SafeExit(0)
+}
+
+// headAll lists the bucket and heads every key using a bounded pool of workers.
+// fn is called from the calling goroutine with results in listing order, regardless of the order in which requests complete.
+func headAll(b backend.Backend, workers int, fn func(key string, res *backend.Object, err error)) error {
+	jobs := make(chan headJob)
+	order := make(chan chan headResult, workers)
+
+	for i := 0; i < workers; i++ {
+		go func() {
+			for j := range jobs {
+				res, err := headWithBackoff(b, j.key)
+				j.out <- headResult{j.key, res, err}
+			}
+		}()
+	}
+
+	var err error
+	go func() {
+		err = b.List(func(key string) bool {
+			out := make(chan headResult, 1)
+			order <- out
+			jobs <- headJob{key, out}
+			return true
+		})
+		close(jobs)
+		close(order)
+	}()
+
+	for out := range order {
+		r := <-out
+		fn(r.key, r.res, r.err)
+	}
+
+	return err
+}
+
+// listArchives heads every object in the bucket like headAll and calls fn with each ogive archive, its name decrypted with the keyring.
+// Objects that fail to be headed or parsed are reported on stderr and skipped, failed is additionally called for the former unless nil.
+func listArchives(b backend.Backend, kr *object.Keyring, workers int, failed func(key string), fn func(key string, obj object.ResponseObject)) error {
+	return headAll(b, workers, func(key string, res *backend.Object, err error) {
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to head object", key, err)
+			if failed != nil {
+				failed(key)
+			}
+			return
+		}
+
+		// Just to make the list show less clutter in case the bucket is not ogive-exclusive
+		if res.ContentType != backend.ContentType {
+			return
+		}
+
+		obj, err := object.Parse(res, &key, kr, false)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Invalid file metadata", key, err)
+			return
+		}
+
+		fn(key, obj)
+	})
+}
+
+// headWithBackoff performs a HEAD request, retrying with exponential backoff while it is being throttled.
+func headWithBackoff(b backend.Backend, key string) (res *backend.Object, err error) {
+	delay := headBackoff
+	for i := 0; ; i++ {
+		res, err = b.Head(key)
+		if err != backend.ErrSlowDown || i == headRetries {
+			return
+		}
+
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
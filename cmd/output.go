@@ -0,0 +1,138 @@
+package cmd
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/InVisionApp/tabular"
+	"github.com/mgren/ogive/object"
+	"github.com/mgren/ogive/util"
+	"os"
+	"strconv"
+	"time"
+)
+
+// csvHeader lists the columns of --output csv.
+var csvHeader = []string{"id", "name", "status", "size", "last_modified", "restore_expiry", "mtime"}
+
+// newArchivePrinter validates the output format. Nothing is printed until the first record or Close.
+// Multiple json records are printed as a single array, a lone record as a single object.
+func newArchivePrinter(format string, array bool) (*archivePrinter, error) {
+	switch format {
+	case "", "json", "csv":
+		return &archivePrinter{format: format, array: array}, nil
+	}
+
+	return nil, errors.New("Unsupported output format " + format)
+}
+
+// start prints the header, if the format has one.
+func (p *archivePrinter) start() {
+	if p.started {
+		return
+	}
+	p.started = true
+
+	switch p.format {
+	case "json":
+		if p.array {
+			fmt.Print("[")
+		}
+	case "csv":
+		p.csv = csv.NewWriter(os.Stdout)
+		p.csv.Write(csvHeader)
+	default:
+		p.row = tab.Print(tabular.All)
+	}
+}
+
+// newRecord describes a parsed archive.
+func newRecord(id string, obj object.ResponseObject) archiveRecord {
+	r := archiveRecord{
+		ID:           id,
+		Name:         obj.Name,
+		Status:       obj.Restore,
+		Size:         int64(obj.Size),
+		LastModified: obj.LastModified,
+		Created:      obj.LastModified,
+	}
+
+	if obj.Meta != nil && !obj.Meta.Uploaded.IsZero() {
+		r.Created = obj.Meta.Uploaded
+	}
+
+	if !obj.Expiry.IsZero() {
+		r.RestoreExpiry = &obj.Expiry
+	}
+
+	if obj.Meta != nil && !obj.Meta.ModTime.IsZero() {
+		r.ModTime = &obj.Meta.ModTime
+	}
+
+	return r
+}
+
+// Print prints a single archive.
+func (p *archivePrinter) Print(r archiveRecord) error {
+	p.start()
+	defer func() { p.count++ }()
+
+	switch p.format {
+	case "json":
+		data, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		if p.array && p.count > 0 {
+			fmt.Print(",")
+		}
+		fmt.Print(string(data))
+		if !p.array {
+			fmt.Println()
+		}
+	case "csv":
+		expiry, mtime := "", ""
+		if r.RestoreExpiry != nil {
+			expiry = r.RestoreExpiry.Format(time.RFC3339)
+		}
+		if r.ModTime != nil {
+			mtime = r.ModTime.Format(time.RFC3339)
+		}
+		p.csv.Write([]string{r.ID, r.Name, r.Status, strconv.FormatInt(r.Size, 10), r.LastModified.Format(time.RFC3339), expiry, mtime})
+		p.csv.Flush()
+		return p.csv.Error()
+	default:
+		expires := "-"
+		if r.RestoreExpiry != nil {
+			expires = util.DurationShort(time.Until(*r.RestoreExpiry))
+		}
+
+		date := r.LastModified
+		if showMtime && r.ModTime != nil {
+			date = *r.ModTime
+		}
+
+		// https://golang.org/src/time/format.go
+		fmt.Printf(p.row, util.SizeIEC(r.Size), date.Format("2006-Jan-02"), r.Status, expires, r.ID, r.Name)
+	}
+
+	return nil
+}
+
+// Close finishes the output.
+func (p *archivePrinter) Close() error {
+	p.start()
+
+	switch p.format {
+	case "json":
+		if p.array {
+			fmt.Println("]")
+		}
+	case "csv":
+		p.csv.Flush()
+		return p.csv.Error()
+	}
+
+	return nil
+}
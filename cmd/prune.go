@@ -0,0 +1,187 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"github.com/awnumar/memguard"
+	"github.com/mgren/ogive/backend"
+	"github.com/mgren/ogive/catalog"
+	"github.com/mgren/ogive/object"
+	"github.com/mgren/ogive/profile"
+	"github.com/mgren/ogive/util"
+	"github.com/spf13/cobra"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	pruneCmd.Flags().IntVar(&keep.Last, "keep-last", 0, "Keep the given number of most recent versions.")
+	pruneCmd.Flags().IntVar(&keep.Weekly, "keep-weekly", 0, "Keep the latest version in each of the given number of most recent weeks with a version.")
+	pruneCmd.Flags().IntVar(&keep.Monthly, "keep-monthly", 0, "Keep the latest version in each of the given number of most recent months with a version.")
+	pruneCmd.Flags().IntVar(&keep.Yearly, "keep-yearly", 0, "Keep the latest version in each of the given number of most recent years with a version.")
+	pruneCmd.Flags().StringVar(&match, "match", "", "Only prune files whose original name matches a glob pattern.")
+	pruneCmd.Flags().BoolVar(&pruneDelete, "delete", false, "Delete the pruned versions. Only prints what would be deleted by default.")
+	pruneCmd.Flags().BoolVarP(&force, "force", "f", false, "Also delete versions stored for less than the Deep Archive minimum storage duration.")
+	pruneCmd.Flags().BoolVarP(&yes, "yes", "y", false, "Skip confirmation. Required when stdin is not interactive.")
+	rootCmd.AddCommand(pruneCmd)
+}
+
+var keep retention
+var pruneDelete bool
+
+var pruneCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "Delete old versions of files.",
+	Long:  "Delete old versions of files according to retention rules. Versions are grouped by original filename and a version is kept if any of the --keep rules selects it. Versions stored for less than the 180-day Deep Archive minimum storage duration are held back unless --force is set. Only prints what would be deleted, unless --delete is set.",
+	Run: func(cmd *cobra.Command, args []string) {
+		if keep.Last < 0 || keep.Weekly < 0 || keep.Monthly < 0 || keep.Yearly < 0 {
+			util.Fail(errors.New("Negative retention count."), "Invalid retention rules.")
+		}
+		if keep == (retention{}) {
+			util.Fail(errors.New("No retention rules given."), "At least one --keep rule is needed, otherwise every version would be deleted.")
+		}
+
+		filter, err := newArchiveFilter(match, "", "")
+		if err != nil {
+			util.Fail(err, "Invalid selection.")
+		}
+
+		inner, err := profile.Open(profileFile)
+		if err != nil {
+			util.Fail(err, "Failed to open profile. Wrong password?")
+		}
+
+		kr := openKeyring(inner)
+		ckey, err := catalog.Key(kr.Master())
+		kr.Destroy()
+		if err != nil {
+			util.Fail(err, "Failed to derive catalog key.")
+		}
+
+		b, err := backend.New(inner)
+		if err != nil {
+			util.Fail(err, "Failed to set up storage backend.")
+		}
+
+		groups := map[string][]archiveRecord{}
+		err = listArchives(b, kr, defaultConcurrency, nil, func(key string, obj object.ResponseObject) {
+			if filter.matches(obj) {
+				groups[obj.Name] = append(groups[obj.Name], newRecord(key, obj))
+			}
+		})
+		if err != nil {
+			util.Fail(err, "Failed to list bucket.")
+		}
+
+		names := make([]string, 0, len(groups))
+		for name := range groups {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		var pruned []archiveRecord
+		size, fee, kept, held := int64(0), 0.0, 0, 0
+		for _, name := range names {
+			versions := groups[name]
+			reasons := keep.apply(versions)
+
+			fmt.Println(name)
+			for _, r := range versions {
+				action, note := "keep", strings.Join(reasons[r.ID], ", ")
+				if len(reasons[r.ID]) == 0 {
+					action, note = "prune", ""
+					if days := earlyDays(r.LastModified); days > 0 {
+						note = fmt.Sprintf("%d days before minimum storage duration", days)
+						if !force {
+							action = "hold"
+						} else {
+							fee += earlyDeletionFee(r.Size, days)
+						}
+					}
+				}
+
+				switch action {
+				case "keep":
+					kept++
+				case "hold":
+					held++
+				default:
+					size += r.Size
+					pruned = append(pruned, r)
+				}
+				line := fmt.Sprintf("  %-5s %s %10s %s %s", action, r.Created.Format("2006-Jan-02"), util.SizeIEC(r.Size), r.ID, note)
+				fmt.Println(strings.TrimRight(line, " "))
+			}
+		}
+
+		fmt.Printf("%d version(s) to prune totaling %s, %d kept.\n", len(pruned), util.SizeIEC(size), kept)
+		if held > 0 {
+			fmt.Printf("%d version(s) held back by the %d-day minimum storage duration, use --force to prune them.\n", held, minStorageDays)
+		}
+		if fee > 0 {
+			fmt.Printf("Warning: pruning incurs an early deletion fee of about $%.4f, based on us-east-1 prices.\n", fee)
+		}
+
+		if len(pruned) == 0 {
+			ckey.Destroy()
+			memguard.SafeExit(0)
+		}
+
+		if !pruneDelete {
+			ckey.Destroy()
+			fmt.Println("Nothing deleted, use --delete to prune.")
+			memguard.SafeExit(0)
+		}
+
+		confirm("Delete permanently?", "prune")
+
+		failed := deleteArchives(b, ckey, pruned)
+		if failed > 0 {
+			util.Fail(errors.New(strconv.Itoa(failed)+" deletion(s) failed."), "Failed to prune files.")
+		}
+
+		memguard.SafeExit(0)
+	},
+}
+
+// apply sorts versions of a single file from the newest and returns the names of the rules keeping each of them by storage ID.
+// Every rule keeps the latest version within its period, so the newest version is always kept.
+func (rt retention) apply(versions []archiveRecord) map[string][]string {
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].Created.After(versions[j].Created)
+	})
+
+	reasons := map[string][]string{}
+	for i := 0; i < rt.Last && i < len(versions); i++ {
+		reasons[versions[i].ID] = append(reasons[versions[i].ID], "last")
+	}
+
+	periods := []struct {
+		name  string
+		count int
+		key   func(t time.Time) int
+	}{
+		{"weekly", rt.Weekly, func(t time.Time) int { y, w := t.ISOWeek(); return y*100 + w }},
+		{"monthly", rt.Monthly, func(t time.Time) int { return t.Year()*100 + int(t.Month()) }},
+		{"yearly", rt.Yearly, func(t time.Time) int { return t.Year() }},
+	}
+
+	for _, p := range periods {
+		seen, last := 0, -1
+		for _, r := range versions {
+			if seen == p.count {
+				break
+			}
+
+			k := p.key(r.Created)
+			if k != last {
+				reasons[r.ID] = append(reasons[r.ID], p.name)
+				seen, last = seen+1, k
+			}
+		}
+	}
+
+	return reasons
+}
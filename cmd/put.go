@@ -1,71 +1,388 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
 	"github.com/awnumar/memguard"
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/mgren/ogive/archive"
+	"github.com/mgren/ogive/backend"
+	"github.com/mgren/ogive/catalog"
+	"github.com/mgren/ogive/checksum"
 	"github.com/mgren/ogive/crypt"
+	"github.com/mgren/ogive/input"
 	"github.com/mgren/ogive/object"
 	"github.com/mgren/ogive/profile"
 	"github.com/mgren/ogive/progress"
+	"github.com/mgren/ogive/transfer"
 	"github.com/mgren/ogive/util"
 	"github.com/spf13/cobra"
+	"io"
+	"os"
 	"path/filepath"
+	"strings"
+	"syscall"
 )
 
 func init() {
+	putCmd.Flags().StringVarP(&name, "name", "n", "", "Override stored filename. Required when uploading from stdin.")
+	putCmd.Flags().BoolVarP(&resume, "resume", "r", false, "Resume an interrupted upload of the source file.")
+	putCmd.Flags().StringArrayVar(&putRecipients, "recipient", nil, "Also encrypt the file to a recipient printed by \"ogive key recipient\". Can be repeated.")
 	rootCmd.AddCommand(putCmd)
 }
 
+var name string
+var resume bool
+var putRecipients []string
+
 var putCmd = &cobra.Command{
-	Use:   "put <source_file>",
-	Short: "Upload file.",
-	Long:  "Encrypt and upload file to S3 Glacier Deep Archive.",
+	Use:   "put <source_file|source_directory|->",
+	Short: "Upload file or directory.",
+	Long:  "Encrypt and upload file to S3 Glacier Deep Archive. Directories are uploaded as a single tar archive, preserving permissions, modification times, ownership and symlinks. If the source is -, data is read from stdin and the profile password must be supplied with --password-file. Uploads of files and block devices can be resumed with --resume if interrupted, except with write-only profiles, which encrypt files to their recipient. With --recipient, the file can also be decrypted with the profiles of the given recipients.",
 	Args:  cobra.MinimumNArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
+		stdin := args[0] == "-"
+		if stdin && input.PasswordFile == "" {
+			util.Fail(errors.New("Stdin is reserved for data."), "Uploading from stdin requires --password-file.")
+		}
+		if stdin && name == "" {
+			util.Fail(errors.New("Stdin has no filename."), "Uploading from stdin requires --name.")
+		}
+		if stdin && resume {
+			util.Fail(errors.New("Stdin can't be resumed."), "Only uploads of files and block devices can be resumed.")
+		}
+		if strings.Contains(name, "/") {
+			util.Fail(errors.New("Invalid name "+name), "Filename must not contain slashes.")
+		}
+		if resume && len(putRecipients) > 0 {
+			util.Fail(errors.New("Conflicting flags."), "The recipients of an interrupted upload can't be changed.")
+		}
+
+		var recipients []*object.Recipient
+		for _, s := range putRecipients {
+			r, err := object.ParseRecipient(s)
+			if err != nil {
+				util.Fail(err, "Invalid recipient.")
+			}
+			recipients = append(recipients, r)
+		}
+
 		inner, err := profile.Open(profileFile)
 		if err != nil {
 			util.Fail(err, "Failed to open profile. Wrong password?")
 		}
 
-		base := filepath.Base(args[0])
+		// Write-only profiles can't read the catalog, nor resume uploads, since they hold no key to decrypt with
+		var kr *object.Keyring
+		var ckey *memguard.LockedBuffer
+		writeOnly := inner.WriteOnly()
+		if writeOnly {
+			if resume {
+				util.Fail(profile.ErrWriteOnly, "Uploads with a write-only profile can't be resumed.")
+			}
 
-		obj, err := object.Prepare(inner.Key, base)
+			r, err := object.ParseRecipient(inner.Recipient)
+			if err != nil {
+				util.Fail(err, "Invalid profile recipient.")
+			}
+			recipients = append([]*object.Recipient{r}, recipients...)
+		} else {
+			// The master keys are destroyed once the file is prepared for encryption
+			kr = openKeyring(inner)
+			ckey, err = catalog.Key(kr.Master())
+			if err != nil {
+				util.Fail(err, "Failed to derive catalog key.")
+			}
+		}
+
+		var abs string
+		var stat os.FileInfo
+
+		if !stdin {
+			abs, err = filepath.Abs(args[0])
+			if err != nil {
+				util.Fail(err, "Failed to resolve source path.")
+			}
+
+			stat, err = os.Stat(abs)
+			if err != nil {
+				util.Fail(err, "Failed to open source.")
+			}
+		}
+
+		base := name
+		if base == "" {
+			base = filepath.Base(abs)
+		}
+
+		if resume {
+			if stat.IsDir() {
+				util.Fail(errors.New(abs+" is a directory."), "Only uploads of files and block devices can be resumed.")
+			}
+			resumeFile(kr, inner, ckey, abs, stat, base)
+		}
+
+		if !stdin && stat.IsDir() {
+			base += object.DirSuffix
+		}
+
+		// Streams only have their checksum once read entirely, so it is appended to the content
+		meta := &object.Meta{Size: -1, Trailer: true}
+		if !stdin {
+			meta, err = fileMeta(abs, stat)
+			if err != nil {
+				util.Fail(err, "Failed to read file attributes.")
+			}
+		}
+
+		obj, err := object.Prepare(kr, recipients, base, meta)
+		if kr != nil {
+			kr.Destroy()
+		}
 		if err != nil {
 			util.Fail(err, "Failed to prepare file for encryption.")
 		}
 
-		reader, size, err := crypt.GetCryptReader(obj.Key, args[0])
+		b, err := backend.New(inner)
+		if err != nil {
+			util.Fail(err, "Failed to set up storage backend.")
+		}
+
+		userMeta := obj.Metadata()
+
+		var reader io.Reader
+		var sum *checksum.Reader
+		var size int
+
+		switch {
+		case stdin:
+			size = -1
+			sum = checksum.NewReader(os.Stdin)
+			reader, err = crypt.NewCryptReader(obj.Key, sum)
+		case stat.IsDir():
+			var src io.ReadCloser
+			src, size, err = archive.NewReader(abs)
+			if err == nil {
+				defer src.Close()
+				sum = checksum.NewReader(src)
+				reader, err = crypt.NewCryptReader(obj.Key, sum)
+				size += checksum.Size
+			}
+		default:
+			var src *os.File
+			var srcSize int64
+			src, srcSize, err = crypt.OpenSource(abs)
+			if err != nil {
+				break
+			}
+
+			// Empty files can't be uploaded in parts, checkpoints of write-only profiles could never be resumed
+			if mp, ok := b.(backend.Multipart); ok && srcSize > 0 && !writeOnly {
+				st, err := transfer.NewUpload(util.GetStateDir(profileFile), abs, srcSize, stat.ModTime(), obj.Name, obj.KeyID, obj.DataKey, obj.Nonce)
+				if err != nil {
+					util.Fail(err, "Failed to prepare upload.")
+				}
+
+				discardUpload(mp, abs)
+				fmt.Printf("Uploading %s as %s\n", base, obj.Name)
+				uploadFile(mp, st, obj.Key, src, userMeta)
+				fmt.Printf("Successfully uploaded %s as %s\n", base, obj.Name)
+				recordUpload(b, ckey, catalog.Entry{ID: obj.Name, Name: base, Nonce: obj.Nonce, ModTime: meta.ModTime, Checksum: meta.Checksum})
+				memguard.SafeExit(0)
+			}
+
+			size = int(srcSize)
+			reader, err = crypt.NewCryptReader(obj.Key, src)
+		}
 		if err != nil {
 			util.Fail(err, "Failed to encrypt file.")
 		}
 
+		// The ciphertext is sent, so it determines the part size
+		if size >= 0 {
+			var encSize int64
+			encSize, err = crypt.EncryptedSize(int64(size))
+			if err != nil {
+				util.Fail(err, "Failed to encrypt file.")
+			}
+			size = int(encSize)
+		}
+
 		fmt.Printf("Uploading %s as %s\n", base, obj.Name)
 
 		proxyReader := progress.NewReader(reader)
-		done := make(chan bool)
-		go progress.TrackProgress(&proxyReader, size, done)
-
-		_, err = s3manager.NewUploader(util.GetSession(inner), func(u *s3manager.Uploader) {
-			u.PartSize = util.GetPartSize(int64(size))
-		}).Upload(&s3manager.UploadInput{
-			Body:        &proxyReader,
-			Bucket:      &inner.BucketName,
-			Key:         &obj.Name,
-			ContentType: aws.String("application/x-ogive"),
-			StorageClass: aws.String("DEEP_ARCHIVE"),
-			Metadata: map[string]*string{
-				"Nonce": aws.String(fmt.Sprintf("%x", obj.Nonce)),
-			},
-		})
+		done := make(chan bool, 1)
+		if stdin {
+			// There is nothing to measure the progress against
+			done <- true
+		} else {
+			go progress.TrackProgress(proxyReader, size, done)
+		}
 
+		err = b.Put(obj.Name, proxyReader, int64(size), userMeta)
 		if err != nil {
 			util.Fail(err, "Failed to upload file.")
 		}
 
+		proxyReader.Finish()
 		<-done
+		if sum != nil {
+			meta.Checksum = sum.Sum()
+		}
+
 		fmt.Printf("Successfully uploaded %s as %s\n", base, obj.Name)
+		recordUpload(b, ckey, catalog.Entry{ID: obj.Name, Name: base, Nonce: obj.Nonce, ModTime: meta.ModTime, Checksum: meta.Checksum})
 		memguard.SafeExit(0)
 	},
 }
+
+// fileMeta collects attributes of the source to be stored with the archive.
+// The content of regular files and block devices is read once to compute its checksum, directory archives carry theirs in a trailer.
+func fileMeta(abs string, stat os.FileInfo) (*object.Meta, error) {
+	meta := &object.Meta{Size: -1, Mode: stat.Mode(), ModTime: stat.ModTime()}
+	if sys, ok := stat.Sys().(*syscall.Stat_t); ok {
+		meta.UID, meta.GID = int(sys.Uid), int(sys.Gid)
+	}
+
+	if stat.IsDir() {
+		meta.Trailer = true
+		return meta, nil
+	}
+
+	src, size, err := crypt.OpenSource(abs)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+
+	fmt.Println("Computing checksum of", abs)
+	meta.Checksum, err = checksum.File(src, size)
+	if err != nil {
+		return nil, err
+	}
+
+	meta.Size = size
+	return meta, nil
+}
+
+// resumeFile continues an interrupted upload of the source file based on its checkpoint state, then exits.
+func resumeFile(kr *object.Keyring, inner *profile.InnerData, ckey *memguard.LockedBuffer, abs string, stat os.FileInfo, base string) {
+	st, err := transfer.LoadUpload(util.GetStateDir(profileFile), abs)
+	if err != nil {
+		util.Fail(err, "No interrupted upload of "+abs+" found.")
+	}
+
+	if !st.ModTime.Equal(stat.ModTime()) {
+		util.Fail(errors.New(abs+" was modified after the upload started."), "Can't resume upload.")
+	}
+
+	// Without the wrapped data key, the parts already uploaded can't be continued
+	if st.KeyID == "" || st.DataKey == "" || len(st.Nonce) == 0 {
+		util.Fail(errors.New("Incomplete upload state of "+abs+"."), "Upload it again without --resume.")
+	}
+
+	// The checksum of such uploads would be appended to the content, but the archive metadata does not say so
+	if st.Trailer {
+		util.Fail(errors.New("Upload of "+abs+" was started by an incompatible version."), "Upload it again without --resume.")
+	}
+
+	// The upload may have been started before the key was rotated
+	key, err := kr.Unwrap(st.KeyID, st.Nonce, st.DataKey)
+	kr.Destroy()
+	if err != nil {
+		util.Fail(err, "Failed to prepare file for encryption.")
+	}
+
+	b, err := backend.New(inner)
+	if err != nil {
+		util.Fail(err, "Failed to set up storage backend.")
+	}
+
+	mp, ok := b.(backend.Multipart)
+	if !ok {
+		util.Fail(errors.New("Multipart uploads not supported."), "Storage backend can't resume uploads.")
+	}
+
+	src, size, err := crypt.OpenSource(abs)
+	if err != nil {
+		util.Fail(err, "Failed to open source.")
+	}
+	if size != st.Size {
+		util.Fail(errors.New(abs+" changed size after the upload started."), "Can't resume upload.")
+	}
+
+	fmt.Printf("Resuming upload of %s as %s, %d parts already uploaded\n", base, st.Key, len(st.Parts))
+	uploadFile(mp, st, key, src, nil)
+	fmt.Printf("Successfully uploaded %s as %s\n", base, st.Key)
+	// The checksum is stored with the archive and picked up by the next catalog sync
+	recordUpload(b, ckey, catalog.Entry{ID: st.Key, Name: base, Nonce: st.Nonce, ModTime: stat.ModTime()})
+	memguard.SafeExit(0)
+}
+
+// uploadFile performs a checkpointed multipart upload, removing the checkpoint state once it completes.
+func uploadFile(b backend.Multipart, st *transfer.UploadState, key *memguard.LockedBuffer, src io.ReaderAt, meta map[string]string) {
+	encSize, err := crypt.EncryptedSize(st.Size)
+	if err != nil {
+		util.Fail(err, "Failed to encrypt file.")
+	}
+
+	counter := &progress.Counter{}
+	done := make(chan bool)
+	go progress.TrackProgress(counter, int(encSize), done)
+
+	err = transfer.Upload(b, st, key, src, meta, counter)
+	key.Destroy()
+	if err != nil {
+		util.Fail(err, "Failed to upload file. Use \"ogive put --resume "+st.Source+"\" to continue.")
+	}
+
+	err = st.Remove()
+	if err != nil {
+		util.Fail(err, "Failed to remove upload state.")
+	}
+
+	counter.Finish()
+	<-done
+}
+
+// recordUpload adds the uploaded archive to the local catalog, filling in its size and upload time.
+// Failures are only reported, since the archive itself is already stored and the catalog can be synchronized later.
+// Write-only profiles have no catalog key, uploads are recorded once the catalog is synchronized with the full profile.
+func recordUpload(b backend.Backend, ckey *memguard.LockedBuffer, e catalog.Entry) {
+	if ckey == nil {
+		return
+	}
+	defer ckey.Destroy()
+
+	res, err := b.Head(e.ID)
+	if err == nil {
+		var c *catalog.Catalog
+		c, err = catalog.Open(util.GetStateDir(profileFile), ckey)
+		if err == nil {
+			e.Size, e.Uploaded = res.Size, res.LastModified
+			e.Nonce = append([]byte(nil), e.Nonce...)
+			c.Add(e)
+			err = c.Save()
+		}
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to update catalog, run \"ogive catalog sync\" to fix it.", err)
+	}
+}
+
+// discardUpload aborts a previous interrupted upload of the source file, so that it won't be left behind when starting anew.
+func discardUpload(b backend.Multipart, abs string) {
+	st, err := transfer.LoadUpload(util.GetStateDir(profileFile), abs)
+	if err != nil {
+		return
+	}
+
+	fmt.Println("Discarding interrupted upload of", abs)
+	if st.UploadID != "" {
+		err = b.AbortUpload(st.Key, st.UploadID)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to abort interrupted upload", st.UploadID, err)
+		}
+	}
+	st.Remove()
+}
@@ -0,0 +1,280 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"github.com/awnumar/memguard"
+	"github.com/mgren/ogive/backend"
+	"github.com/mgren/ogive/catalog"
+	"github.com/mgren/ogive/crypt"
+	"github.com/mgren/ogive/object"
+	"github.com/mgren/ogive/profile"
+	"github.com/mgren/ogive/progress"
+	"github.com/mgren/ogive/util"
+	"github.com/spf13/cobra"
+	"io"
+	"os"
+	"strconv"
+)
+
+func init() {
+	rekeyCmd.Flags().BoolVar(&keepOld, "keep-old", false, "Keep the archives encrypted with retired keys instead of deleting them.")
+	rekeyCmd.Flags().BoolVar(&forceReencrypt, "reencrypt", false, "Download and re-encrypt every file with a new file key, instead of wrapping its file key anew.")
+	rekeyCmd.Flags().BoolVarP(&yes, "yes", "y", false, "Skip confirmation. Required when stdin is not interactive.")
+	rootCmd.AddCommand(rekeyCmd)
+}
+
+var keepOld, forceReencrypt bool
+
+var rekeyCmd = &cobra.Command{
+	Use:   "rekey [storage_id...]",
+	Short: "Re-encrypt files with the active key.",
+	Long:  "Re-encrypt files with the active master key, by default all files encrypted with retired keys. Every file is stored under a new storage ID, then the old archive is deleted unless --keep-old is set. The data keys of archives are wrapped with the active key and their content is copied within the bucket, archives stored before data keys were wrapped are downloaded, re-encrypted and uploaded instead. A copied archive keeps its data key, so the retired key can still decrypt it together with the metadata of the old archive, ex. one kept with --keep-old or in a bucket backup. Use --reencrypt to download and re-encrypt every file with a new data key instead, which also re-encrypts files already encrypted with the active key if named. Files only encrypted to the recipient of the profile are only re-encrypted if named. Files have to be restored first, the others are listed and skipped. The original upload time is kept for prune. Exits with code: 0 - all files re-encrypted, 1 - error occurred, 2 - some files are not restored.",
+	Run: func(cmd *cobra.Command, args []string) {
+		inner, err := profile.Open(profileFile)
+		if err != nil {
+			util.Fail(err, "Failed to open profile. Wrong password?")
+		}
+
+		kr := openKeyring(inner)
+		defer kr.Destroy()
+
+		ckey, err := catalog.Key(kr.Master())
+		if err != nil {
+			util.Fail(err, "Failed to derive catalog key.")
+		}
+
+		b, err := backend.New(inner)
+		if err != nil {
+			util.Fail(err, "Failed to set up storage backend.")
+		}
+
+		var targets []archiveRecord
+		if len(args) == 0 {
+			err = listArchives(b, kr, defaultConcurrency, nil, func(key string, obj object.ResponseObject) {
+				// Files only encrypted to the recipient have no master key to replace
+				if obj.KeyID != "" && obj.KeyID != kr.Active() {
+					targets = append(targets, newRecord(key, obj))
+				}
+			})
+			if err != nil {
+				util.Fail(err, "Failed to list bucket.")
+			}
+		} else {
+			for i := range args {
+				res, err := b.Head(args[i])
+				if err != nil {
+					util.Fail(err, "Failed to head object "+args[i]+".")
+				}
+
+				obj, err := object.Parse(res, &args[i], kr, false)
+				if err != nil {
+					util.Fail(err, "Invalid file metadata "+args[i]+".")
+				}
+
+				if obj.KeyID == kr.Active() && !forceReencrypt {
+					fmt.Println(args[i], obj.Name+": Already encrypted with the active key.")
+					continue
+				}
+				targets = append(targets, newRecord(args[i], obj))
+			}
+		}
+
+		var ready, pending []archiveRecord
+		for _, r := range targets {
+			if r.Status == "READY" {
+				ready = append(ready, r)
+			} else {
+				pending = append(pending, r)
+			}
+		}
+
+		for _, r := range pending {
+			fmt.Fprintf(os.Stderr, "  %s %s %s: File status is %s.\n", r.ID, r.Name, util.SizeIEC(r.Size), r.Status)
+		}
+		if len(pending) > 0 {
+			fmt.Fprintf(os.Stderr, "Skipping %d file(s) not restored, please run ogive restore first.\n", len(pending))
+		}
+
+		if len(ready) == 0 {
+			ckey.Destroy()
+			if len(pending) > 0 {
+				memguard.SafeExit(2)
+			}
+			fmt.Println("All files are encrypted with the active key.")
+			memguard.SafeExit(0)
+		}
+
+		fmt.Printf("Re-encrypting %d file(s) with key %s.\n", len(ready), kr.Active())
+		if keepOld {
+			for _, r := range ready {
+				fmt.Printf("  %s %s %s\n", util.SizeIEC(r.Size), r.ID, r.Name)
+			}
+		} else {
+			// Every re-encrypted archive replaces the original one
+			printDeletion(ready)
+		}
+		confirm("Re-encrypt?", "re-encryption")
+
+		c, err := catalog.Open(util.GetStateDir(profileFile), ckey)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to open catalog, run \"ogive catalog sync\" afterwards to fix it.", err)
+			c = nil
+		}
+
+		var replaced []archiveRecord
+		failed := 0
+		for _, r := range ready {
+			var old catalog.Entry
+			if c != nil {
+				old = c.Entries[r.ID]
+			}
+
+			e, err := rekeyArchive(b, kr, r.ID, old)
+			if err != nil {
+				failed++
+				fmt.Fprintln(os.Stderr, r.ID+" "+r.Name+": Failed to re-encrypt.", err)
+				continue
+			}
+
+			fmt.Println(r.ID + " " + r.Name + ": Re-keyed as " + e.ID + ".")
+			replaced = append(replaced, r)
+			if c != nil {
+				c.Add(e)
+			}
+		}
+
+		if c != nil && len(replaced) > 0 {
+			err = c.Save()
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Failed to update catalog, run \"ogive catalog sync\" to fix it.", err)
+			}
+		}
+
+		if keepOld || len(replaced) == 0 {
+			ckey.Destroy()
+		} else {
+			failed += deleteArchives(b, ckey, replaced)
+		}
+
+		if failed > 0 {
+			util.Fail(errors.New(strconv.Itoa(failed)+" file(s) failed."), "Failed to re-encrypt files.")
+		}
+		if len(pending) > 0 {
+			memguard.SafeExit(2)
+		}
+
+		memguard.SafeExit(0)
+	},
+}
+
+// rekeyArchive stores a restored archive under a new storage ID and the active key.
+// Wrapped data keys are wrapped anew and the content is copied within the backend if possible, unless forceReencrypt is set,
+// otherwise the archive is downloaded, re-encrypted with a new data key and uploaded.
+// It returns the catalog entry of the new archive, carrying over the details only known from the old entry.
+func rekeyArchive(b backend.Backend, kr *object.Keyring, id string, old catalog.Entry) (e catalog.Entry, err error) {
+	res, err := b.Head(id)
+	if err != nil {
+		return
+	}
+
+	obj, err := object.Parse(res, &id, kr, true)
+	if err != nil {
+		return
+	}
+	defer obj.Key.Destroy()
+
+	meta := &object.Meta{Size: -1}
+	if obj.Meta != nil {
+		copied := *obj.Meta
+		meta = &copied
+	}
+	if meta.Uploaded.IsZero() {
+		meta.Uploaded = obj.LastModified
+	}
+	// Checksums of streamed uploads are kept in a trailer, which is carried over with the content
+	checksum := meta.Checksum
+	if meta.Trailer {
+		checksum = old.Checksum
+	}
+
+	var next object.RequestObject
+	if c, ok := b.(backend.Copier); ok && obj.Wrapped() && !forceReencrypt {
+		next, err = obj.Rewrap(kr, meta)
+		if err != nil {
+			return
+		}
+
+		fmt.Printf("Copying %s as %s\n", obj.Name, next.Name)
+		err = c.Copy(id, next.Name, res.Size, next.Metadata())
+	} else {
+		next, err = obj.Renew(kr, meta)
+		if err != nil {
+			return
+		}
+		defer next.Key.Destroy()
+
+		fmt.Printf("Uploading %s as %s\n", obj.Name, next.Name)
+		err = reencrypt(b, id, res.Size, obj.Key, next)
+	}
+	if err != nil {
+		return
+	}
+
+	modTime := meta.ModTime
+	if modTime.IsZero() {
+		modTime = old.ModTime
+	}
+
+	up, err := b.Head(next.Name)
+	if err != nil {
+		return
+	}
+
+	e = catalog.Entry{ID: next.Name, Name: obj.Name, Size: up.Size, Uploaded: up.LastModified, ModTime: modTime, Checksum: checksum}
+	e.Nonce = append([]byte(nil), next.Nonce...)
+	return
+}
+
+// reencrypt streams the size bytes long object id decrypted with key into a new object encrypted with the key of next.
+func reencrypt(b backend.Backend, id string, size int64, key *memguard.LockedBuffer, next object.RequestObject) error {
+	// Closing the decrypting writer must not close the pipe, the final package is only authenticated then
+	pr, pw := io.Pipe()
+	writer, err := crypt.NewCryptWriter(key, struct{ io.Writer }{pw})
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		fake := util.NewWriterAtFake(writer)
+
+		var err error
+		for offset := int64(0); offset < size && err == nil; offset += partSize {
+			err = getRange(b, id, offset, partSize, fake)
+		}
+
+		// Empty files have no final package to authenticate
+		if cerr := writer.Close(); err == nil && size > 0 {
+			err = cerr
+		}
+		pw.CloseWithError(err)
+	}()
+
+	reader, err := crypt.NewCryptReader(next.Key, pr)
+	if err != nil {
+		pr.CloseWithError(err)
+		return err
+	}
+
+	proxyReader := progress.NewReader(reader)
+	done := make(chan bool)
+	go progress.TrackProgress(proxyReader, int(size), done)
+
+	// The plaintext is unchanged, so is the encrypted size
+	err = b.Put(next.Name, proxyReader, size, next.Metadata())
+	pr.CloseWithError(err)
+	proxyReader.Finish()
+	<-done
+
+	return err
+}
@@ -1,66 +1,353 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
 	"github.com/awnumar/memguard"
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/mgren/ogive/backend"
+	"github.com/mgren/ogive/input"
+	"github.com/mgren/ogive/object"
 	"github.com/mgren/ogive/profile"
 	"github.com/mgren/ogive/util"
 	"github.com/spf13/cobra"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
 )
 
 func init() {
 	restoreCmd.Flags().IntVarP(&lifetime, "lifetime", "t", 1, "Specifies the number of days to retain the restored object before returning it to Deep Archive.")
+	restoreCmd.Flags().StringVar(&tier, "tier", "bulk", "Retrieval tier, standard (within 12 hours) or bulk (within 48 hours).")
+	restoreCmd.Flags().BoolVarP(&yes, "yes", "y", false, "Skip confirmation. Required when stdin is not interactive.")
+	restoreCmd.Flags().StringVar(&match, "match", "", "Restore all archives whose original name matches a glob pattern.")
+	restoreCmd.Flags().StringVar(&since, "since", "", "Restore all archives uploaded on or after a date (YYYY-MM-DD or RFC 3339).")
+	restoreCmd.Flags().StringVar(&until, "until", "", "Restore all archives uploaded before the end of a date (YYYY-MM-DD or RFC 3339).")
+	restoreCmd.Flags().StringVar(&notifyQueue, "notify-queue", "", "Wait for restores to complete using S3 event notifications from an SQS queue. Defaults to the queue in the profile when waiting.")
+	restoreCmd.Flags().StringVar(&thenGet, "then-get", "", "Wait for restores to complete and download each file into a directory as soon as it is ready.")
+	restoreCmd.Flags().DurationVar(&waitTimeout, "timeout", 72*time.Hour, "Give up waiting after this long.")
 	rootCmd.AddCommand(restoreCmd)
 }
 
 var lifetime int
+var tier string
+var yes bool
+var match, since, until string
+var notifyQueue string
+
+// tiers holds Deep Archive retrieval tiers with us-east-1 prices.
+var tiers = map[string]restoreTier{
+	"standard": {Name: "Standard", PerGB: 0.02, PerRequest: 0.0001, Window: "12 hours"},
+	"bulk":     {Name: "Bulk", PerGB: 0.0025, PerRequest: 0.000025, Window: "48 hours"},
+}
+
+// notifyPoll is the longest time a single request for notifications waits for them, the SQS maximum.
+const notifyPoll = 20 * time.Second
+
+// notifyRetry is the pause between requests for notifications that return at once without any awaited event.
+const notifyRetry = time.Second
+
+// storagePerGBDay is the us-east-1 price of storing a GiB of the restored copy in STANDARD storage for a day in USD.
+const storagePerGBDay = 0.023 / 30
 
 var restoreCmd = &cobra.Command{
-	Use:   "restore <storage_id>",
-	Short: "Restore a specific file.",
-	Long:  "Initiate file recovery from Deep Archive. Bulk Restore is used. Use \"head\" command to verify when the file becomes ready for download.",
-	Args:  cobra.MinimumNArgs(1),
+	Use:   "restore <storage_id>...",
+	Short: "Restore files.",
+	Long:  "Initiate file recovery from Deep Archive. Files are selected by storage IDs, or with --match, --since and --until, which select archives from the entire bucket. Bulk Restore is used unless --tier is set. An estimate of the cost and completion time is printed and has to be confirmed, unless --yes is set. Use \"head\" command to verify when the file becomes ready for download. With --notify-queue or --then-get, waits for the restores to complete using S3 event notifications from an SQS queue, optionally downloading each file as soon as it is ready, and exits with code: 0 - all files available for download, 1 - error occurred, 2 - some file not available for download.",
 	Run: func(cmd *cobra.Command, args []string) {
+		selecting := match != "" || since != "" || until != ""
+		if selecting == (len(args) > 0) {
+			util.Fail(errors.New("Either storage IDs or --match, --since and --until are needed."), "Nothing to restore.")
+		}
+
+		filter, err := newArchiveFilter(match, since, until)
+		if err != nil {
+			util.Fail(err, "Invalid selection.")
+		}
+
+		t, ok := tiers[strings.ToLower(tier)]
+		if !ok {
+			util.Fail(errors.New("Unknown tier "+tier), "Tier must be standard or bulk.")
+		}
+
 		inner, err := profile.Open(profileFile)
 		if err != nil {
-			util.Fail(err, "Failed to open profile. Wrong password? Exiting...")
-			memguard.SafeExit(1)
+			util.Fail(err, "Failed to open profile. Wrong password?")
 		}
-		inner.Key.Destroy() // Not needed here
 
-		svc := s3.New(util.GetSession(inner))
+		kr := openKeyring(inner)
+		if thenGet == "" {
+			// The master keys are only needed to decrypt file keys for downloads
+			kr.Destroy()
+		}
 
-		_, err = svc.RestoreObject(&s3.RestoreObjectInput{
-			Bucket: &inner.BucketName,
-			Key:    &args[0],
-			RestoreRequest: &s3.RestoreRequest{
-				Days: aws.Int64(int64(lifetime)),
-				GlacierJobParameters: &s3.GlacierJobParameters{
-					Tier: aws.String("Bulk"),
-				},
-			},
-		})
+		awaiting := notifyQueue != "" || thenGet != ""
+		if awaiting && notifyQueue == "" {
+			notifyQueue = inner.NotifyQueue
+			if notifyQueue == "" {
+				util.Fail(errors.New("No notification queue configured."), "Use --notify-queue or add the queue to the profile with ogive init --reinit.")
+			}
+		}
 
+		b, err := backend.New(inner)
 		if err != nil {
-			if aerr, ok := err.(awserr.Error); ok {
-				switch aerr.Code() {
-				case s3.ErrCodeObjectAlreadyInActiveTierError:
-					fmt.Println("Restoration already completed.")
-				case "RestoreAlreadyInProgress": // Doesn't seem to be defined in current version of AWS SDK
-					fmt.Println("Restoration already in progress.")
-				default:
-					util.Fail(err, "Failed to request restore.")
+			util.Fail(err, "Failed to set up storage backend.")
+		}
+
+		n, ok := b.(backend.Notifier)
+		if awaiting && !ok {
+			util.Fail(errors.New("Storage backend does not support notifications."), "Use ogive wait instead.")
+		}
+
+		var targets []archiveRecord
+		if selecting {
+			err = listArchives(b, kr, defaultConcurrency, nil, func(key string, obj object.ResponseObject) {
+				if filter.matches(obj) {
+					targets = append(targets, newRecord(key, obj))
 				}
-			} else {
-				util.Fail(err, "Failed to request restore.")
+			})
+			if err != nil {
+				util.Fail(err, "Failed to list bucket.")
 			}
 		} else {
-			fmt.Println("Restoration request sent.")
+			for i := range args {
+				res, err := b.Head(args[i])
+				if err != nil {
+					util.Fail(err, "Failed to head object "+args[i]+".")
+				}
+
+				obj, err := object.Parse(res, &args[i], kr, false)
+				if err != nil {
+					// Restoring doesn't need the filename, ex. of archives encrypted to other recipients
+					fmt.Fprintln(os.Stderr, "Can't decrypt the filename of "+args[i]+", restoring anyway.", err)
+					obj, err = object.Parse(res, nil, nil, false)
+				}
+				if err != nil {
+					util.Fail(err, "Invalid file metadata "+args[i]+".")
+				}
+
+				targets = append(targets, newRecord(args[i], obj))
+			}
+		}
+
+		if len(targets) == 0 {
+			fmt.Println("No archives selected.")
+			memguard.SafeExit(0)
+		}
+
+		size := int64(0)
+		for _, r := range targets {
+			size += r.Size
+			if len(targets) > 1 {
+				fmt.Printf("  %s %s %s\n", r.Status, r.ID, r.Name)
+			}
+		}
+
+		fmt.Printf("Restoring %d file(s) totaling %s using %s retrieval, expected to complete within %s.\n", len(targets), util.SizeIEC(size), t.Name, t.Window)
+		fmt.Printf("Estimated cost: $%.4f, based on us-east-1 prices.\n", estimateRestore(t, size, len(targets), lifetime))
+		confirm("Proceed with the restore?", "restore")
+
+		failed := 0
+		var ready, pending []archiveRecord
+		for _, r := range targets {
+			prefix := ""
+			if len(targets) > 1 {
+				prefix = r.ID + " " + r.Name + ": "
+			}
+
+			err = b.Restore(r.ID, lifetime, t.Name)
+			switch err {
+			case nil:
+				fmt.Println(prefix + "Restoration request sent.")
+				// Extending an available copy completes at once, without another event
+				if r.Status == "READY" {
+					ready = append(ready, r)
+				} else {
+					pending = append(pending, r)
+				}
+			case backend.ErrRestoreInProgress:
+				fmt.Println(prefix + err.Error())
+				pending = append(pending, r)
+			case backend.ErrAlreadyRestored:
+				fmt.Println(prefix + err.Error())
+				ready = append(ready, r)
+			default:
+				failed++
+				fmt.Fprintln(os.Stderr, prefix+"Failed to request restore.", err)
+			}
+		}
+
+		if !awaiting {
+			if failed > 0 {
+				util.Fail(errors.New(strconv.Itoa(failed)+" restore request(s) failed."), "Failed to request restore.")
+			}
+			memguard.SafeExit(0)
+		}
+
+		getFailed, unavailable := awaitRestores(n, b, kr, ready, pending)
+		kr.Destroy()
+
+		if failed > 0 || getFailed {
+			memguard.SafeExit(1)
+		}
+
+		if unavailable {
+			memguard.SafeExit(2)
 		}
 
 		memguard.SafeExit(0)
 	},
 }
+
+// awaitRestores reports files as their restores complete, according to notifications from the queue, until none is pending or the timeout expires.
+// With --then-get, each file is downloaded as soon as it is ready. Files in ready are reported right away.
+// It returns whether anything failed and whether any restore did not complete in time.
+func awaitRestores(n backend.Notifier, b backend.Backend, kr *object.Keyring, ready, pending []archiveRecord) (failed, unavailable bool) {
+	done := func(r archiveRecord) {
+		fmt.Println(r.ID, "READY")
+		if thenGet == "" {
+			return
+		}
+
+		err := getFile(b, kr, r.ID, thenGet, "")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, r.ID+":", err)
+			failed = true
+		}
+	}
+
+	for _, r := range ready {
+		done(r)
+	}
+
+	left := map[string]archiveRecord{}
+	for _, r := range pending {
+		left[r.ID] = r
+	}
+
+	if len(left) > 0 {
+		fmt.Printf("Waiting for %d restore(s) to complete, notifications from %s\n", len(left), notifyQueue)
+	}
+
+	deadline := time.Now().Add(waitTimeout)
+	for len(left) > 0 {
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			break
+		}
+		if wait > notifyPoll {
+			wait = notifyPoll
+		}
+
+		// Events about other objects are left in the queue for other runs waiting for them
+		start := time.Now()
+		keys, err := n.Restored(notifyQueue, wait, func(key string) bool {
+			_, ok := left[key]
+			return ok
+		})
+		for _, k := range keys {
+			if r, ok := left[k]; ok {
+				delete(left, k)
+				done(r)
+			}
+		}
+
+		// Such events are received again at once, so polling is slowed down while only they are in the queue
+		if len(keys) == 0 && err == nil && time.Since(start) < notifyRetry {
+			time.Sleep(notifyRetry)
+		}
+
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to receive notifications.", err)
+			failed = true
+			break
+		}
+	}
+
+	for _, r := range pending {
+		if _, ok := left[r.ID]; ok {
+			fmt.Fprintln(os.Stderr, r.ID+": Restore did not complete while waiting.")
+			unavailable = true
+		}
+	}
+
+	return
+}
+
+// newArchiveFilter parses selection flags. Dates without time select whole days in UTC, same as list displays them.
+func newArchiveFilter(match, since, until string) (f archiveFilter, err error) {
+	f.Match = match
+
+	// Validate the pattern upfront, path.Match only reports bad patterns when it gets to them
+	_, err = path.Match(match, "")
+	if err != nil {
+		return
+	}
+
+	if since != "" {
+		f.Since, err = parseDate(since, false)
+		if err != nil {
+			return
+		}
+	}
+
+	if until != "" {
+		f.Until, err = parseDate(until, true)
+	}
+
+	return
+}
+
+// parseDate parses an RFC 3339 time or a date. For dates, end selects the end of the day instead of its start.
+func parseDate(s string, end bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+
+	t, err := time.Parse("2006-01-02", s)
+	if err == nil && end {
+		t = t.AddDate(0, 0, 1)
+	}
+
+	return t, err
+}
+
+// matches reports whether the archive is selected by the filter.
+// Directory archives are matched by their name without the trailing suffix.
+func (f archiveFilter) matches(obj object.ResponseObject) bool {
+	if f.Match != "" {
+		if ok, _ := path.Match(f.Match, strings.TrimSuffix(obj.Name, object.DirSuffix)); !ok {
+			return false
+		}
+	}
+
+	if !f.Since.IsZero() && obj.LastModified.Before(f.Since) {
+		return false
+	}
+
+	return f.Until.IsZero() || obj.LastModified.Before(f.Until)
+}
+
+// estimateRestore returns the estimated cost in USD of restoring count objects with total size using the tier,
+// including storage of the restored copies for the given number of days.
+func estimateRestore(t restoreTier, size int64, count, days int) float64 {
+	gb := float64(size) / (1 << 30)
+	return gb*t.PerGB + float64(count)*t.PerRequest + gb*storagePerGBDay*float64(days)
+}
+
+// confirm asks for confirmation of the action unless it was given with --yes, exiting if it is refused.
+func confirm(prompt, action string) {
+	if yes {
+		return
+	}
+
+	ok, err := input.Confirm(prompt)
+	if err != nil {
+		util.Fail(err, "Use --yes to confirm the "+action+" non-interactively.")
+	}
+	if !ok {
+		fmt.Println(strings.ToUpper(action[:1]) + action[1:] + " cancelled.")
+		memguard.SafeExit(0)
+	}
+}
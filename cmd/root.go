@@ -1,13 +1,16 @@
 package cmd
 
 import (
+	"github.com/mgren/ogive/input"
 	"github.com/mgren/ogive/util"
 	"github.com/spf13/cobra"
 )
 
 func init() {
 	rootCmd.PersistentFlags().StringVarP(&profileFile, "profile", "p", util.GetDefaultProfileLoc(), "Location of ogive profile file.")
+	rootCmd.PersistentFlags().StringVar(&input.PasswordFile, "password-file", "", "Read profile password from the first line of a file instead of stdin.")
 	cobra.MarkFlagFilename(rootCmd.PersistentFlags(), "profile")
+	cobra.MarkFlagFilename(rootCmd.PersistentFlags(), "password-file")
 }
 
 var profileFile string
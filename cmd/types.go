@@ -0,0 +1,128 @@
+package cmd
+
+import (
+	"encoding/csv"
+	"github.com/mgren/ogive/backend"
+	"time"
+)
+
+// headJob is a single listed key waiting to be headed.
+type headJob struct {
+	// key is the storage key of the object
+	key string
+
+	// out receives the result of the HEAD request
+	out chan headResult
+}
+
+// headResult is the outcome of heading a single listed key.
+type headResult struct {
+	// key is the storage key of the object
+	key string
+
+	// res is the HEAD response, nil on error
+	res *backend.Object
+
+	// err is the error that persisted after all retries
+	err error
+}
+
+// archiveRecord is the machine-readable representation of an archive printed with --output json|csv.
+type archiveRecord struct {
+	// ID is the storage key of the archive
+	ID string `json:"id"`
+
+	// Name is the original unencrypted filename
+	Name string `json:"name"`
+
+	// Status is the restore status, one of DEEPS, RECOV, READY or ?????
+	Status string `json:"status"`
+
+	// Size is the stored (encrypted) size of the archive
+	Size int64 `json:"size"`
+
+	// LastModified is the upload time
+	LastModified time.Time `json:"last_modified"`
+
+	// RestoreExpiry is the time the restored copy is removed, nil if there is none
+	RestoreExpiry *time.Time `json:"restore_expiry"`
+
+	// ModTime is the original modification time, nil if unknown
+	ModTime *time.Time `json:"mtime"`
+
+	// Created is the upload time of the original archive for re-encrypted ones, same as LastModified otherwise
+	Created time.Time `json:"-"`
+}
+
+// archivePrinter prints archives as a table or in a machine-readable format.
+type archivePrinter struct {
+	// format is the output format, empty for the table
+	format string
+
+	// array makes json records print as a single array instead of a single object
+	array bool
+
+	// row is the tabular row format
+	row string
+
+	// csv writes csv records
+	csv *csv.Writer
+
+	// started is set once the header is printed
+	started bool
+
+	// count is the number of printed records
+	count int
+}
+
+// restoreTier describes a Deep Archive retrieval tier.
+type restoreTier struct {
+	// Name is the tier name used in RestoreObject requests
+	Name string
+
+	// PerGB is the retrieval price per GiB in USD
+	PerGB float64
+
+	// PerRequest is the price of a single restore request in USD
+	PerRequest float64
+
+	// Window is the time within which restores usually complete
+	Window string
+}
+
+// archiveFilter selects archives by original name and upload time.
+type archiveFilter struct {
+	// Match is a glob pattern matched against the original name, empty matches all
+	Match string
+
+	// Since excludes archives uploaded before it, zero if unset
+	Since time.Time
+
+	// Until excludes archives uploaded at or after it, zero if unset
+	Until time.Time
+}
+
+// getError is a failed download together with a hint for the user.
+type getError struct {
+	// err is the cause of the failure
+	err error
+
+	// hint explains the failure to the user
+	hint string
+}
+
+// retention holds the rules deciding which versions of a file are kept by prune.
+// A version is kept when any rule selects it.
+type retention struct {
+	// Last is the number of the most recent versions kept
+	Last int
+
+	// Weekly is the number of most recent weeks in which the latest version is kept
+	Weekly int
+
+	// Monthly is the number of most recent months in which the latest version is kept
+	Monthly int
+
+	// Yearly is the number of most recent years in which the latest version is kept
+	Yearly int
+}
@@ -0,0 +1,118 @@
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/awnumar/memguard"
+	"github.com/mgren/ogive/backend"
+	"github.com/mgren/ogive/catalog"
+	"github.com/mgren/ogive/checksum"
+	"github.com/mgren/ogive/crypt"
+	"github.com/mgren/ogive/object"
+	"github.com/mgren/ogive/profile"
+	"github.com/mgren/ogive/transfer"
+	"github.com/mgren/ogive/util"
+	"github.com/spf13/cobra"
+	"strings"
+)
+
+func init() {
+	rootCmd.AddCommand(verifyCmd)
+}
+
+var verifyCmd = &cobra.Command{
+	Use:   "verify <storage_id> <local_file>",
+	Short: "Compare a local file with an archive.",
+	Long:  "Compare a local file or block device with the checksum stored with the archive, without restoring or downloading it. Archives uploaded from stdin carry their checksum at the end of the encrypted content instead, it is only available once restored, unless the archive was uploaded from the same profile and recorded in the local catalog. Directory archives can only be verified by downloading them. Exits with code: 0 - file matches the archive, 1 - error occurred, 2 - file does not match the archive, 3 - checksum only available after restore.",
+	Args:  cobra.MinimumNArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		id := args[0]
+
+		inner, err := profile.Open(profileFile)
+		if err != nil {
+			util.Fail(err, "Failed to open profile. Wrong password?")
+		}
+
+		kr := openKeyring(inner)
+		ckey, err := catalog.Key(kr.Master())
+		if err != nil {
+			util.Fail(err, "Failed to derive catalog key.")
+		}
+
+		b, err := backend.New(inner)
+		if err != nil {
+			util.Fail(err, "Failed to set up storage backend.")
+		}
+
+		res, err := b.Head(id)
+		if err != nil {
+			util.Fail(err, "Failed to head object.")
+		}
+
+		obj, err := object.Parse(res, &id, kr, true)
+		kr.Destroy()
+		if err != nil {
+			util.Fail(err, "Invalid file metadata.")
+		}
+
+		if strings.HasSuffix(obj.Name, object.DirSuffix) {
+			util.Fail(errors.New(id+" is a directory archive."), "Directory archives can only be verified by downloading them.")
+		}
+
+		expected, size := []byte(nil), int64(-1)
+		if obj.Meta != nil {
+			expected, size = obj.Meta.Checksum, obj.Meta.Size
+		}
+
+		// Checksums of streams are appended to the content, only its final packages are downloaded
+		if obj.Meta != nil && obj.Meta.Trailer {
+			expected, err = transfer.ReadTrailer(b, id, res.Size, size, obj.Key)
+			if err == backend.ErrNotRestored {
+				// Uploads from this profile also recorded the checksum in the catalog
+				c, cerr := catalog.Open(util.GetStateDir(profileFile), ckey)
+				if cerr != nil {
+					util.Fail(cerr, "Failed to open catalog.")
+				}
+				expected = c.Entries[id].Checksum
+				if len(expected) == 0 {
+					fmt.Printf("Checksum of %s only available after restore.\n", id)
+					memguard.SafeExit(3)
+				}
+			} else if err != nil {
+				util.Fail(err, "Failed to read checksum of archive.")
+			}
+		}
+		obj.Key.Destroy()
+		ckey.Destroy()
+
+		if len(expected) == 0 {
+			util.Fail(errors.New("No checksum stored for "+id+"."), "Can't verify file.")
+		}
+
+		src, srcSize, err := crypt.OpenSource(args[1])
+		if err != nil {
+			util.Fail(err, "Failed to open local file.")
+		}
+		defer src.Close()
+
+		if size >= 0 && size != srcSize {
+			fmt.Printf("%s does not match %s, size is %s instead of %s.\n", args[1], id, util.SizeIEC(srcSize), util.SizeIEC(size))
+			memguard.SafeExit(2)
+		}
+
+		fmt.Println("Computing checksum of", args[1])
+		sum, err := checksum.File(src, srcSize)
+		if err != nil {
+			util.Fail(err, "Failed to read local file.")
+		}
+
+		if !bytes.Equal(sum, expected) {
+			fmt.Printf("%s does not match %s.\n", args[1], id)
+			memguard.SafeExit(2)
+		}
+
+		fmt.Printf("%s matches %s.\n", args[1], id)
+		memguard.SafeExit(0)
+	},
+}
@@ -0,0 +1,151 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"github.com/awnumar/memguard"
+	"github.com/mgren/ogive/backend"
+	"github.com/mgren/ogive/object"
+	"github.com/mgren/ogive/profile"
+	"github.com/mgren/ogive/util"
+	"github.com/spf13/cobra"
+	"os"
+	"time"
+)
+
+func init() {
+	waitCmd.Flags().StringVar(&thenGet, "then-get", "", "Download each file into a directory as soon as it is ready.")
+	waitCmd.Flags().DurationVar(&waitTimeout, "timeout", 72*time.Hour, "Give up waiting after this long.")
+	waitCmd.Flags().DurationVar(&waitInterval, "interval", time.Minute, "Delay after the first poll, doubled after every poll up to 30m.")
+	rootCmd.AddCommand(waitCmd)
+}
+
+var thenGet string
+var waitTimeout time.Duration
+var waitInterval time.Duration
+
+// maxWaitInterval caps the delay between two polls.
+const maxWaitInterval = 30 * time.Minute
+
+var waitCmd = &cobra.Command{
+	Use:   "wait <storage_id>...",
+	Short: "Wait until files are restored.",
+	Long:  "Poll the status of files until all of them are ready for download or the timeout expires, optionally downloading each file as soon as it is ready. Exits with code: 0 - all files available for download, 1 - error occurred, 2 - some file not available for download.",
+	Args:  cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if waitInterval <= 0 {
+			util.Fail(errors.New("Invalid interval "+waitInterval.String()+"."), "Interval must be positive.")
+		}
+
+		inner, err := profile.Open(profileFile)
+		if err != nil {
+			util.Fail(err, "Failed to open profile. Wrong password?")
+		}
+
+		// The master keys are only needed to decrypt file keys for downloads
+		kr := openKeyring(inner)
+		if thenGet == "" {
+			kr.Destroy()
+		}
+
+		b, err := backend.New(inner)
+		if err != nil {
+			util.Fail(err, "Failed to set up storage backend.")
+		}
+
+		pending := map[string]bool{}
+		for _, id := range args {
+			pending[id] = true
+		}
+
+		failed, unavailable := false, false
+		deadline := time.Now().Add(waitTimeout)
+		interval := waitInterval
+
+		for {
+			// Poll in the order of arguments, so that output is predictable
+			for _, id := range args {
+				if !pending[id] {
+					continue
+				}
+
+				status, err := pollStatus(b, id)
+				if err != nil {
+					fmt.Fprintln(os.Stderr, id+":", err, "Failed to head object.")
+					failed = true
+					delete(pending, id)
+					continue
+				}
+
+				switch status {
+				case "RECOV":
+					continue
+				case "READY":
+					fmt.Println(id, status)
+					if thenGet != "" {
+						err = getFile(b, kr, id, thenGet, "")
+						if err != nil {
+							fmt.Fprintln(os.Stderr, id+":", err)
+							failed = true
+						}
+					}
+				default:
+					// Nothing will change without another restore
+					fmt.Println(id, status)
+					unavailable = true
+				}
+				delete(pending, id)
+			}
+
+			left := time.Until(deadline)
+			if len(pending) == 0 || left <= 0 {
+				break
+			}
+
+			if interval > left {
+				interval = left
+			}
+			time.Sleep(interval)
+
+			interval *= 2
+			if interval > maxWaitInterval {
+				interval = maxWaitInterval
+			}
+		}
+
+		for _, id := range args {
+			if pending[id] {
+				fmt.Println(id, "RECOV")
+				fmt.Fprintln(os.Stderr, id+": Timed out waiting for restore.")
+				unavailable = true
+			}
+		}
+
+		kr.Destroy()
+
+		if failed {
+			memguard.SafeExit(1)
+		}
+
+		if unavailable {
+			memguard.SafeExit(2)
+		}
+
+		memguard.SafeExit(0)
+	},
+}
+
+// pollStatus returns the restore status of a single file.
+func pollStatus(b backend.Backend, id string) (string, error) {
+	res, err := headWithBackoff(b, id)
+	if err != nil {
+		return "", err
+	}
+
+	obj, err := object.Parse(res, &id, nil, false)
+	if err != nil {
+		return "", err
+	}
+
+	return obj.Restore, nil
+}
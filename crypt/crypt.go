@@ -1,6 +1,7 @@
 package crypt
 
 import (
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
 	"errors"
@@ -9,7 +10,18 @@ import (
 	"golang.org/x/sys/unix"
 	"io"
 	"os"
-	"path/filepath"
+	"strconv"
+)
+
+const (
+	// PayloadSize is the maximum amount of plaintext stored in a single sio package
+	PayloadSize = 1 << 16
+
+	// PackageSize is the size of a single full sio package, including header and authentication tag
+	PackageSize = PayloadSize + 32
+
+	// StreamNonceSize is the size of the random value from which sio derives package nonces
+	StreamNonceSize = 12
 )
 
 // GetGCM returns a new AES GCM cipher with optional custom nonce size
@@ -28,43 +40,40 @@ func GetGCM(key *memguard.LockedBuffer, size int) (gcm cipher.AEAD, err error) {
 	return cipher.NewGCM(c)
 }
 
-// GetCryptWriter returns a new io.WriteCloser that will decrypt data written to it.
-// Plaintext will be saved under the specified directory with chosen filename.
+// NewCryptWriter returns a new io.WriteCloser that will decrypt data written to it and write plaintext into dst.
+// Closing the returned writer also closes dst, if it implements io.Closer.
 //
 // This writer has 2 bytes already written to it in order to initialize the underlying AES instance.
-func GetCryptWriter(key *memguard.LockedBuffer, dir, fname string) (w io.WriteCloser, err error) {
-	var f os.FileInfo
-	f, err = os.Stat(dir)
-	if err != nil {
-		return
-	}
-	if !f.Mode().IsDir() {
-		err = errors.New(dir + " is not a directory.")
-		return
-	}
-
-	dstFname := filepath.Join(dir, fname)
-	var dst *os.File
-
-	dst, err = os.OpenFile(dstFname, os.O_RDWR|os.O_CREATE, 0600)
+func NewCryptWriter(key *memguard.LockedBuffer, dst io.Writer) (w io.WriteCloser, err error) {
+	w, err = sio.DecryptWriter(dst, sio.Config{Key: key.Buffer()})
 	if err != nil {
 		return
 	}
 
-	w, err = sio.DecryptWriter(dst, sio.Config{Key: key.Buffer()})
-
 	var n int
 	n, err = w.Write([]byte{sio.Version20, sio.AES_256_GCM})
 	if n != 2 {
-		err = errors.New("Invalid write length " + string(n))
+		err = errors.New("Invalid write length " + strconv.Itoa(n))
 	}
 
 	return
 }
 
-// GetCryptReader returns a new io.Reader that reads and encrypts the specified filename
-func GetCryptReader(key *memguard.LockedBuffer, fname string) (r io.Reader, s int, err error) {
-	var src *os.File
+// NewCryptWriterAt returns a new io.WriteCloser that decrypts a part of the ciphertext stream starting with the package
+// with sequence number seq, writing plaintext into dst at the position of that package.
+// Unlike NewCryptWriter, the key must stay intact until the returned writer is closed.
+func NewCryptWriterAt(key *memguard.LockedBuffer, dst io.WriterAt, seq uint32) (io.WriteCloser, error) {
+	return sio.DecryptWriter(io.NewOffsetWriter(dst, int64(seq)*PayloadSize), sio.Config{
+		MinVersion:     sio.Version20,
+		MaxVersion:     sio.Version20,
+		CipherSuites:   []byte{sio.AES_256_GCM},
+		Key:            key.Buffer(),
+		SequenceNumber: seq,
+	})
+}
+
+// OpenSource opens the specified file for reading and determines its size, supporting block devices.
+func OpenSource(fname string) (src *os.File, s int64, err error) {
 	src, err = os.Open(fname)
 	if err != nil {
 		return
@@ -76,20 +85,60 @@ func GetCryptReader(key *memguard.LockedBuffer, fname string) (r io.Reader, s in
 		return
 	}
 
-	s = int(f.Size())
+	s = f.Size()
 
 	// Assume block device
 	if s == 0 {
 		// Ignoring the error is ok here, continue without size
-		s, _ = unix.IoctlGetInt(int(src.Fd()), unix.BLKGETSIZE64)
+		var n int
+		n, _ = unix.IoctlGetInt(int(src.Fd()), unix.BLKGETSIZE64)
+		s = int64(n)
 	}
 
-	r, err = sio.EncryptReader(src, sio.Config{
+	return
+}
+
+// NewCryptReader returns a new io.Reader that encrypts everything read from src
+func NewCryptReader(key *memguard.LockedBuffer, src io.Reader) (io.Reader, error) {
+	return sio.EncryptReader(src, sio.Config{
 		MinVersion:   sio.Version20,
 		MaxVersion:   sio.Version20,
 		CipherSuites: []byte{sio.AES_256_GCM},
 		Key:          key.Buffer(),
 	})
+}
 
-	return
+// NewCryptReaderAt returns a new io.Reader that encrypts size bytes of src, starting from the package with sequence number seq.
+//
+// sio encrypts data in fixed-size packages whose nonces are derived from a single random value and the package sequence number.
+// Supplying the same random value (nonce) makes every such reader produce a fragment of one and the same ciphertext stream,
+// which allows to encrypt (and upload) any package-aligned part of the stream independently.
+func NewCryptReaderAt(key *memguard.LockedBuffer, src io.ReaderAt, size int64, seq uint32, nonce []byte) (io.Reader, error) {
+	offset := int64(seq) * PayloadSize
+	return sio.EncryptReader(io.NewSectionReader(src, offset, size-offset), sio.Config{
+		MinVersion:     sio.Version20,
+		MaxVersion:     sio.Version20,
+		CipherSuites:   []byte{sio.AES_256_GCM},
+		Key:            key.Buffer(),
+		SequenceNumber: seq,
+		Rand:           bytes.NewReader(nonce),
+	})
+}
+
+// IsFinal reports whether the sio package starting at pkg is marked as the last one of its stream.
+// The mark is part of the package nonce, so it can only be trusted once the package has been authenticated.
+func IsFinal(pkg []byte) bool {
+	return len(pkg) > 4 && pkg[4]&0x80 != 0
+}
+
+// EncryptedSize returns the size of ciphertext for the given plaintext size.
+func EncryptedSize(size int64) (int64, error) {
+	s, err := sio.EncryptedSize(uint64(size))
+	return int64(s), err
+}
+
+// DecryptedSize returns the size of plaintext for the given ciphertext size.
+func DecryptedSize(size int64) (int64, error) {
+	s, err := sio.DecryptedSize(uint64(size))
+	return int64(s), err
 }
@@ -1,14 +1,27 @@
 module github.com/mgren/ogive
 
+go 1.20
+
 require (
 	github.com/InVisionApp/tabular v0.3.0
 	github.com/awnumar/memguard v0.15.1
 	github.com/aws/aws-sdk-go v1.19.28
-	github.com/inconshreveable/mousetrap v1.0.0 // indirect
 	github.com/minio/sio v0.0.0-20190118043801-035b4ef8c449
 	github.com/schollz/progressbar/v2 v2.12.1
 	github.com/spf13/cobra v0.0.3
-	github.com/spf13/pflag v1.0.3 // indirect
 	golang.org/x/crypto v0.0.0-20190510104115-cbcb75029529
 	golang.org/x/sys v0.0.0-20190412213103-97732733099d
 )
+
+require (
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/inconshreveable/mousetrap v1.0.0 // indirect
+	github.com/jmespath/go-jmespath v0.0.0-20180206201540-c2b33e8439af // indirect
+	github.com/mitchellh/colorstring v0.0.0-20190213212951-d06e56a500db // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	github.com/spf13/pflag v1.0.3 // indirect
+	github.com/stretchr/objx v0.1.1 // indirect
+	github.com/stretchr/testify v1.3.0 // indirect
+	golang.org/x/net v0.0.0-20190404232315-eb5bcb51f2a3 // indirect
+	golang.org/x/text v0.3.0 // indirect
+)
@@ -2,12 +2,48 @@ package input
 
 import (
 	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
 	"github.com/awnumar/memguard"
+	"golang.org/x/sys/unix"
+	"io/ioutil"
 	"os"
+	"strings"
 	"syscall"
 )
 
+// PasswordFile, if not empty, is the file GetPassword reads the password from instead of prompting for it.
+var PasswordFile string
+
+// stdin is shared by all prompts, so that buffered input meant for the next prompt is not lost.
+var stdin = bufio.NewReader(os.Stdin)
+
+// GetPassword returns the first line of PasswordFile if set, otherwise it behaves exactly like GetMaskedInput.
+// Limit checks are not applied to passwords read from a file.
+func GetPassword(prompt string, limitMax, limitMin int) (b *memguard.LockedBuffer, err error) {
+	if PasswordFile == "" {
+		return GetMaskedInput(prompt, "", "", limitMax, limitMin)
+	}
+
+	var data []byte
+	data, err = ioutil.ReadFile(PasswordFile)
+	if err != nil {
+		return
+	}
+	defer memguard.WipeBytes(data)
+
+	if i := bytes.IndexByte(data, '\n'); i >= 0 {
+		data = data[:i]
+	}
+	if len(data) == 0 {
+		err = errors.New("Password file " + PasswordFile + " is empty.")
+		return
+	}
+
+	return memguard.NewImmutableFromBytes(data)
+}
+
 // GetMaskedInput prompts the user for input and then reads a single newline-terminated line
 // from stdin and returns it as a memguard.LockedBuffer with the terminating newline removed.
 // User input is not displayed in the console.
@@ -24,15 +60,10 @@ func GetMaskedInput(prompt, def, after string, limitMax, limitMin int) (b *memgu
 		Files: []uintptr{os.Stdin.Fd(), os.Stdout.Fd(), os.Stderr.Fd()},
 		Sys:   nil}
 	var ws syscall.WaitStatus
-	var stat os.FileInfo
 	var pid int
 
 	// Ugly hack to hide even uglier warning messages when receiving password input from redirected stdin.
-	stat, err = os.Stdin.Stat()
-	if err != nil {
-		return
-	}
-	if (stat.Mode() & os.ModeCharDevice) == 0 {
+	if !IsInteractive() {
 		b, err = readInputBare()
 		if err != nil {
 			return
@@ -72,6 +103,30 @@ func GetMaskedInput(prompt, def, after string, limitMax, limitMin int) (b *memgu
 	return
 }
 
+// IsInteractive reports whether standard input is a terminal rather than redirected from another process or file.
+// Character devices such as /dev/null are not terminals, so a terminal-specific ioctl is used instead of file mode.
+func IsInteractive() bool {
+	_, err := unix.IoctlGetTermios(int(os.Stdin.Fd()), unix.TCGETS)
+	return err == nil
+}
+
+// Confirm asks a yes/no question and reports whether it was answered with yes.
+// Redirected stdin can't be trusted to answer, so an error is returned instead of prompting.
+func Confirm(prompt string) (bool, error) {
+	if !IsInteractive() {
+		return false, errors.New("Stdin is not interactive.")
+	}
+
+	b, err := readInput(prompt+" [y/N]", "")
+	if err != nil {
+		return false, err
+	}
+	defer b.Destroy()
+
+	answer := strings.ToLower(strings.TrimSpace(string(b.Buffer())))
+	return answer == "y" || answer == "yes", nil
+}
+
 // GetInput prompts the user for input and then reads a single newline-terminated line
 // from stdin and returns it as a memguard.LockedBuffer with the terminating newline removed.
 //
@@ -89,9 +144,9 @@ func GetInput(prompt, def, after string, limitMax, limitMin int) (b *memguard.Lo
 
 	for b.Size()-1 > limitMax || b.Size()-1 < limitMin {
 		if b.Size()-1 > limitMax {
-			fmt.Printf("Input is too long. Maximum of %d characters allowed.\n", limitMax)
+			fmt.Fprintf(os.Stderr, "Input is too long. Maximum of %d characters allowed.\n", limitMax)
 		} else {
-			fmt.Printf("Input must be at least %d characters.\n", limitMin)
+			fmt.Fprintf(os.Stderr, "Input must be at least %d characters.\n", limitMin)
 		}
 		b.Destroy()
 
@@ -112,20 +167,20 @@ func GetInput(prompt, def, after string, limitMax, limitMin int) (b *memguard.Lo
 	return nil, nil
 }
 
-// readInput is the prompting and reading primitive
+// readInput is the prompting and reading primitive.
+// Prompts are written to stderr, so that they never mix with data written to stdout.
 func readInput(prompt, after string) (b *memguard.LockedBuffer, err error) {
-	fmt.Print(prompt + ": ")
+	fmt.Fprint(os.Stderr, prompt+": ")
 	b, err = readInputBare()
-	fmt.Print(after)
+	fmt.Fprint(os.Stderr, after)
 	return
 }
 
 // readInputBare can just read user input without any prompts/trailers
 func readInputBare() (b *memguard.LockedBuffer, err error) {
 	var in []byte
-	reader := bufio.NewReader(os.Stdin)
 
-	in, err = reader.ReadBytes('\n')
+	in, err = stdin.ReadBytes('\n')
 	if err != nil {
 		return
 	}
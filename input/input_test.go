@@ -0,0 +1,42 @@
+package input
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGetPasswordFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ogive-input")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func() { PasswordFile = "" }()
+
+	for content, want := range map[string]string{"secret": "secret", "secret\nignored\n": "secret", "\nsecret": "", "": ""} {
+		PasswordFile = filepath.Join(dir, "password")
+		err = ioutil.WriteFile(PasswordFile, []byte(content), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		b, err := GetPassword("Enter password", 64, 8)
+		if want == "" {
+			if err == nil {
+				t.Errorf("GetPassword() of %q succeeded", content)
+			}
+			continue
+		}
+		if err != nil || string(b.Buffer()) != want {
+			t.Errorf("GetPassword() of %q = %v, %v, want %q", content, b, err, want)
+		}
+	}
+
+	PasswordFile = filepath.Join(dir, "missing")
+	_, err = GetPassword("Enter password", 64, 8)
+	if err == nil {
+		t.Error("GetPassword() of a missing file succeeded")
+	}
+}
@@ -2,53 +2,136 @@ package object
 
 import (
 	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"github.com/awnumar/memguard"
-	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/mgren/ogive/backend"
 	"github.com/mgren/ogive/crypt"
 	"golang.org/x/crypto/argon2"
 	"regexp"
 	"strings"
+	"time"
 )
 
-// Parse translates the output of an s3 HeadObject command into a robust ogive archive file representation
+// DirSuffix is appended to the original name of directory archives. It can't occur in a regular filename.
+const DirSuffix = "/"
+
+// metaLabel is authenticated with the metadata blob, so that it can't be swapped with an encrypted filename.
+// The object nonce and key ID are authenticated along with it, so that it can't be copied to another object either.
+const metaLabel = "ogive metadata"
+
+// dataKeyLabel is authenticated with wrapped data keys, so that they can't be swapped with other blobs sealed with the same key.
+// The object nonce and the ID of the wrapping key are authenticated along with it, so that they can't be copied to another object.
+const dataKeyLabel = "ogive data key"
+
+// DataKeySize is the size of the random key the content of every object is encrypted with.
+const DataKeySize = 32
+
+// MaxMetadataSize is the limit S3 imposes on the total size of user metadata keys and values.
+const MaxMetadataSize = 2048
+
+// keyIDLabel is hashed with a master key to identify it without revealing it.
+const keyIDLabel = "ogive key id"
+
+// ErrNoKeys is returned when master keys are needed after the keyring has been destroyed.
+var ErrNoKeys = errors.New("Master keys not available.")
+
+// ErrInvalidName is returned by Parse for decrypted filenames that could lead outside of the download directory.
+var ErrInvalidName = errors.New("Invalid filename stored with the object.")
+
+// Parse translates the output of a backend Head call into a robust ogive archive file representation
 // retrieving information such as original filename, unique file nonce, or the derived key (if possible).
 //
-// The reason this function requires an existing instance of cipher.AEAD is that it can be reused between
-// multiple object instances (in case of list command), which is more efficient than creating it every time.
-func Parse(res *s3.HeadObjectOutput, key *string, gcm cipher.AEAD, master *memguard.LockedBuffer) (o ResponseObject, err error) {
-	if *res.ContentType != "application/x-ogive" {
-		err = errors.New("Invalid content-type " + *res.ContentType)
+// The keyring selects the master key the object is encrypted with. Its ciphers are reused between
+// multiple object instances (in case of list command), which is more efficient than creating them every time.
+// The file key is only retrieved if requested. It is unwrapped from the object metadata, except for objects stored
+// before data keys were wrapped, whose file key is derived from the master key and nonce, which requires the master keys.
+// The filename of objects wrapped to recipients is encrypted with their data key, which is then always unwrapped.
+func Parse(res *backend.Object, key *string, kr *Keyring, withKey bool) (o ResponseObject, err error) {
+	if res.ContentType != backend.ContentType {
+		err = errors.New("Invalid content-type " + res.ContentType)
 		return
 	}
 
 	pattern := regexp.MustCompile("ongoing-request=\\\"(false|true)\\\"")
+	expiry := regexp.MustCompile("expiry-date=\\\"([^\\\"]+)\\\"")
 
 	o.Restore = "?????"
 
-	if res.StorageClass != nil && *res.StorageClass == "DEEP_ARCHIVE" {
+	if res.StorageClass == "DEEP_ARCHIVE" {
 		o.Restore = "DEEPS"
 	}
 
-	if res.Restore != nil {
-		match := pattern.FindStringSubmatch(*res.Restore)
-		if match[1] == "true" {
+	if res.Restore != "" {
+		match := pattern.FindStringSubmatch(res.Restore)
+		if match == nil {
+			o.Restore = "?????"
+		} else if match[1] == "true" {
 			o.Restore = "RECOV"
 		} else if match[1] == "false" {
 			o.Restore = "READY"
 		} else {
 			o.Restore = "?????"
 		}
+
+		// Expiry date is only present once the restore has completed, ex. "Fri, 21 Dec 2012 00:00:00 GMT"
+		if match := expiry.FindStringSubmatch(res.Restore); match != nil {
+			o.Expiry, err = time.Parse(time.RFC1123, match[1])
+			if err != nil {
+				return
+			}
+		}
 	}
 
-	o.Size = int(*res.ContentLength)
-	o.LastModified = *res.LastModified
+	o.Size = int(res.Size)
+	o.LastModified = res.LastModified
 
-	if key == nil || gcm == nil {
+	if key == nil || kr == nil {
+		return
+	}
+
+	o.Nonce, err = hex.DecodeString(res.Metadata["Nonce"])
+	if err != nil {
 		return
 	}
+	if len(o.Nonce) != 32 {
+		err = errors.New("Malformed nonce " + res.Metadata["Nonce"])
+		return
+	}
+
+	var gcm cipher.AEAD
+	if res.Metadata["Recipients"] != "" {
+		var fileKey *memguard.LockedBuffer
+		stanzas := strings.Split(res.Metadata["Recipients"], ",")
+		fileKey, o.KeyID, o.recipients, err = kr.unwrap(stanzas, o.Nonce, res.Metadata)
+		if err != nil {
+			return
+		}
+		o.Recipients = recipientIDs(o.recipients)
+
+		gcm, err = nameCipher(fileKey)
+		if err != nil || !withKey {
+			fileKey.Destroy()
+		} else {
+			o.Key = fileKey
+		}
+		if err != nil {
+			return
+		}
+	} else {
+		var i int
+		i, err = kr.find(res.Metadata["Keyid"])
+		if err != nil {
+			return
+		}
+		o.KeyID = kr.ids[i]
+		gcm = kr.gcms[i]
+	}
 
 	base := strings.Replace(strings.Replace(*key, ".", "/", -1), "-", "+", -1)
 	var cryptName, name []byte
@@ -58,65 +141,366 @@ func Parse(res *s3.HeadObjectOutput, key *string, gcm cipher.AEAD, master *memgu
 		return
 	}
 
-	o.Nonce, err = hex.DecodeString(*res.Metadata["Nonce"])
+	name, err = gcm.Open(nil, o.Nonce, cryptName, nil)
 	if err != nil {
 		return
 	}
-	if len(o.Nonce) != 32 {
-		err = errors.New("Malformed nonce " + *res.Metadata["Nonce"])
+
+	o.Name = string(name)
+	if !validName(o.Name) {
+		if o.Key != nil {
+			o.Key.Destroy()
+			o.Key = nil
+		}
+		err = ErrInvalidName
 		return
 	}
 
-	name, err = gcm.Open(nil, o.Nonce, cryptName, nil)
-	if err != nil {
-		return
+	if blob := res.Metadata["Meta"]; blob != "" {
+		o.Meta, err = openMeta(gcm, blob, binding(metaLabel, o.Nonce, res.Metadata["Keyid"]))
+		if err != nil {
+			return
+		}
 	}
 
-	o.Name = string(name)
+	o.DataKey = res.Metadata["Datakey"]
+	if !withKey || o.Key != nil {
+		return
+	}
 
-	if master == nil {
+	if o.DataKey != "" {
+		o.Key, err = openKey(gcm, o.DataKey, binding(dataKeyLabel, o.Nonce, res.Metadata["Keyid"]))
 		return
 	}
 
-	o.Key, err = memguard.NewImmutableFromBytes(argon2.Key(master.Buffer(), o.Nonce, 3, 32*1024, 4, 32))
+	o.Key, err = kr.Derive(o.KeyID, o.Nonce)
 
 	return
 }
 
-// Prepare is the inverse of Parse. It generates a unique nonce and encrypts the filename.
-func Prepare(master *memguard.LockedBuffer, fname string) (o RequestObject, err error) {
-	var buf *memguard.LockedBuffer
-	buf, err = memguard.NewImmutableRandom(32)
+// validName reports whether a decrypted filename is a single path element, optionally followed by DirSuffix.
+// Filenames of objects encrypted to recipients are chosen by whoever holds the recipient, so they can't be trusted.
+func validName(name string) bool {
+	name = strings.TrimSuffix(name, DirSuffix)
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, "/\\\x00")
+}
+
+// Wrapped reports whether the object content is encrypted with a random data key, rather than one derived from the nonce.
+func (o ResponseObject) Wrapped() bool {
+	return o.DataKey != "" || len(o.Recipients) > 0
+}
+
+// Derive returns the unique file key derived from the master key and file nonce.
+func Derive(master *memguard.LockedBuffer, nonce []byte) (*memguard.LockedBuffer, error) {
+	return memguard.NewImmutableFromBytes(argon2.Key(master.Buffer(), nonce, 3, 32*1024, 4, 32))
+}
+
+// Prepare is the inverse of Parse. It generates a random data key and a unique nonce, then wraps the data key and encrypts
+// the filename and file attributes with the active key, unless meta is nil. If there are any recipients, the data key
+// is also wrapped to each of them and the filename and attributes are encrypted with the data key instead.
+// The keyring may be nil for write-only profiles, which only encrypt to recipients.
+func Prepare(kr *Keyring, recipients []*Recipient, fname string, meta *Meta) (o RequestObject, err error) {
+	var key *memguard.LockedBuffer
+	key, err = memguard.NewImmutableRandom(DataKeySize)
 	if err != nil {
 		return
 	}
 
-	// Assignment to o.Nonce must be done after this KDF (at least in GO 1.11.10). Otherwise, hilarity ensues:
-	// If o.Nonce is used as salt parameter instead of buf.Buffer() the GC will prematurely decide to free
-	// the memory region for memguard container which will then be immediately reused for o.Key...
-	// o.Nonce and o.Key.Buffer() will refer to the same address and return identical data.
-	o.Key, err = memguard.NewImmutableFromBytes(argon2.Key(master.Buffer(), buf.Buffer(), 3, 32*1024, 4, 32))
+	o, err = wrap(kr, recipients, key, fname, meta)
 	if err != nil {
-		return
+		key.Destroy()
 	}
+	return
+}
 
-	o.Nonce = buf.Buffer()
+// Rewrap prepares a copy of an object parsed with its key under a new name and the active key, keeping the data key,
+// so that the content doesn't have to be re-encrypted. The data key is wrapped again to all recipients of the object.
+func (o ResponseObject) Rewrap(kr *Keyring, meta *Meta) (RequestObject, error) {
+	return wrap(kr, o.recipients, o.Key, o.Name, meta)
+}
 
-	// Use bare AES for filename, to save on sio overhead
-	// Override default GCM nonce size, since a single nonce is shared between file content and file name
-	gcm, err := crypt.GetGCM(master, 32)
-	master.Destroy()
+// Renew prepares a copy of an object under a new name and the active key like Rewrap, but with a new random data key,
+// so that the content has to be re-encrypted. The new data key is wrapped to all recipients of the object.
+func (o ResponseObject) Renew(kr *Keyring, meta *Meta) (RequestObject, error) {
+	return Prepare(kr, o.recipients, o.Name, meta)
+}
+
+// wrap wraps the data key with the active key and to the recipients under a new nonce, then encrypts the filename
+// and file attributes. The keyring may be nil if there are any recipients.
+func wrap(kr *Keyring, recipients []*Recipient, key *memguard.LockedBuffer, fname string, meta *Meta) (o RequestObject, err error) {
+	o.Key = key
+	o.Nonce = make([]byte, 32)
+	_, err = rand.Read(o.Nonce)
 	if err != nil {
 		return
 	}
 
+	var gcm cipher.AEAD
+	if kr != nil {
+		active := len(kr.gcms) - 1
+		gcm, o.KeyID = kr.gcms[active], kr.ids[active]
+
+		o.DataKey, err = sealKey(gcm, key, binding(dataKeyLabel, o.Nonce, o.KeyID))
+		if err != nil {
+			return
+		}
+	}
+
+	var stanzas []string
+	wrapped := make(map[string]bool)
+	for _, r := range recipients {
+		// The same recipient may be given multiple times
+		if wrapped[r.ID] {
+			continue
+		}
+		wrapped[r.ID] = true
+
+		var s string
+		s, err = r.wrap(key, o.Nonce)
+		if err != nil {
+			return
+		}
+		stanzas = append(stanzas, s)
+	}
+
+	if len(stanzas) > 0 {
+		o.Recipients = strings.Join(stanzas, ",")
+
+		gcm, err = nameCipher(key)
+		if err != nil {
+			return
+		}
+	}
+
+	if gcm == nil {
+		err = errors.New("No master key or recipient to encrypt with.")
+		return
+	}
+
 	encryptedBase := gcm.Seal(nil, o.Nonce, []byte(fname), nil)
 
 	o.Name = strings.Replace(strings.Replace(base64.RawStdEncoding.EncodeToString(encryptedBase), "/", ".", -1), "+", "-", -1)
 
 	if len(o.Name) > 1024 {
 		err = errors.New("Storage filename too long.")
+		return
+	}
+
+	if meta != nil {
+		o.Meta, err = sealMeta(gcm, meta, binding(metaLabel, o.Nonce, o.KeyID))
+		if err != nil {
+			return
+		}
+	}
+
+	size := 0
+	for k, v := range o.Metadata() {
+		size += len(k) + len(v)
+	}
+	if size > MaxMetadataSize {
+		err = errors.New("Object metadata too large, too many recipients.")
 	}
 
 	return
 }
+
+// Metadata returns the user metadata to store the object with.
+func (o RequestObject) Metadata() map[string]string {
+	meta := map[string]string{
+		"Nonce": hex.EncodeToString(o.Nonce),
+	}
+	if o.KeyID != "" {
+		meta["Keyid"], meta["Datakey"] = o.KeyID, o.DataKey
+	}
+	if o.Recipients != "" {
+		meta["Recipients"] = o.Recipients
+	}
+	if o.Meta != "" {
+		meta["Meta"] = o.Meta
+	}
+	return meta
+}
+
+// NewKeyring takes ownership of the master keys, oldest first, and sets up the filename ciphers of all of them.
+// It also takes ownership of the identity objects wrapped to the profile recipient are decrypted with, which may be nil.
+func NewKeyring(keys []*memguard.LockedBuffer, identity *memguard.LockedBuffer) (*Keyring, error) {
+	kr := &Keyring{keys: keys, identity: identity}
+	if identity != nil {
+		var err error
+		kr.recipient, err = IdentityRecipient(identity)
+		if err != nil {
+			kr.Destroy()
+			identity.Destroy()
+			return nil, err
+		}
+	}
+
+	for _, k := range keys {
+		// Use bare AES for filename, to save on sio overhead
+		// Override default GCM nonce size, since a single nonce is shared between file content and file name
+		gcm, err := crypt.GetGCM(k, 32)
+		if err != nil {
+			kr.Destroy()
+			if identity != nil {
+				identity.Destroy()
+			}
+			return nil, err
+		}
+
+		kr.ids = append(kr.ids, KeyID(k))
+		kr.gcms = append(kr.gcms, gcm)
+	}
+
+	return kr, nil
+}
+
+// KeyID returns the identifier of a master key, stored with every object encrypted with it.
+func KeyID(master *memguard.LockedBuffer) string {
+	h := hmac.New(sha256.New, master.Buffer())
+	h.Write([]byte(keyIDLabel))
+	return hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+// IDs returns the key IDs of all master keys, oldest first.
+func (kr *Keyring) IDs() []string {
+	return kr.ids
+}
+
+// Active returns the key ID of the active master key.
+func (kr *Keyring) Active() string {
+	return kr.ids[len(kr.ids)-1]
+}
+
+// Master returns the active master key, nil once destroyed.
+func (kr *Keyring) Master() *memguard.LockedBuffer {
+	if kr.keys == nil {
+		return nil
+	}
+	return kr.keys[len(kr.keys)-1]
+}
+
+// Derive returns the unique file key derived from the identified master key and file nonce.
+func (kr *Keyring) Derive(id string, nonce []byte) (*memguard.LockedBuffer, error) {
+	if kr.keys == nil {
+		return nil, ErrNoKeys
+	}
+
+	i, err := kr.find(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return Derive(kr.keys[i], nonce)
+}
+
+// Unwrap returns the data key of the object with the given nonce, wrapped with the identified master key.
+// Unlike Derive, it works after the keyring is destroyed.
+func (kr *Keyring) Unwrap(id string, nonce []byte, blob string) (*memguard.LockedBuffer, error) {
+	i, err := kr.find(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return openKey(kr.gcms[i], blob, binding(dataKeyLabel, nonce, id))
+}
+
+// Destroy destroys the master keys. The filename ciphers and the identity remain usable,
+// since the filenames of objects wrapped to recipients can only be read with their unwrapped data keys.
+func (kr *Keyring) Destroy() {
+	for _, k := range kr.keys {
+		k.Destroy()
+	}
+	kr.keys = nil
+}
+
+// find returns the index of the identified master key.
+// Objects stored before keys could be rotated carry no key ID, they are encrypted with the oldest key.
+func (kr *Keyring) find(id string) (int, error) {
+	if id == "" {
+		return 0, nil
+	}
+
+	for i, kid := range kr.ids {
+		if kid == id {
+			return i, nil
+		}
+	}
+
+	return 0, errors.New("Unknown key " + id + ", the file is encrypted with a master key missing from the profile.")
+}
+
+// binding returns the additional data authenticated with a blob stored in the object metadata,
+// tying it to the purpose given by label and to the object identified by its nonce and key ID.
+func binding(label string, nonce []byte, keyID string) []byte {
+	return append(append([]byte(label), nonce...), keyID...)
+}
+
+// sealMeta encrypts file attributes with the filename cipher, authenticating ad along with them.
+// A fresh random nonce is prepended to the ciphertext, since the object nonce is already used for the filename.
+func sealMeta(gcm cipher.AEAD, meta *Meta, ad []byte) (string, error) {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawStdEncoding.EncodeToString(gcm.Seal(nonce, nonce, data, ad)), nil
+}
+
+// sealKey wraps a data key with the filename cipher, authenticating ad along with it.
+// A fresh random nonce is prepended to the ciphertext like with sealMeta.
+func sealKey(gcm cipher.AEAD, key *memguard.LockedBuffer, ad []byte) (string, error) {
+	nonce := make([]byte, gcm.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawStdEncoding.EncodeToString(gcm.Seal(nonce, nonce, key.Buffer(), ad)), nil
+}
+
+// openKey is the inverse of sealKey.
+func openKey(gcm cipher.AEAD, blob string, ad []byte) (*memguard.LockedBuffer, error) {
+	data, err := base64.RawStdEncoding.DecodeString(blob)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, errors.New("Malformed data key.")
+	}
+
+	data, err = gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], ad)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) != DataKeySize {
+		return nil, errors.New("Malformed data key.")
+	}
+
+	return memguard.NewImmutableFromBytes(data)
+}
+
+// openMeta is the inverse of sealMeta.
+func openMeta(gcm cipher.AEAD, blob string, ad []byte) (*Meta, error) {
+	data, err := base64.RawStdEncoding.DecodeString(blob)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, errors.New("Malformed file metadata.")
+	}
+
+	data, err = gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], ad)
+	if err != nil {
+		return nil, err
+	}
+
+	var meta Meta
+	err = json.Unmarshal(data, &meta)
+	return &meta, err
+}
@@ -0,0 +1,504 @@
+package object
+
+import (
+	"encoding/hex"
+	"github.com/awnumar/memguard"
+	"github.com/mgren/ogive/backend"
+	"github.com/mgren/ogive/s3test"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestKeyring returns a keyring with the given number of random master keys and, if requested, an identity.
+func newTestKeyring(t *testing.T, n int, identity bool) *Keyring {
+	var keys []*memguard.LockedBuffer
+	for i := 0; i < n; i++ {
+		master, err := memguard.NewImmutableRandom(32)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, master)
+	}
+
+	var id *memguard.LockedBuffer
+	if identity {
+		var err error
+		id, err = NewIdentity()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	kr, err := NewKeyring(keys, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kr
+}
+
+// stored returns the HEAD result of an object stored from o.
+func stored(o RequestObject) *backend.Object {
+	return &backend.Object{
+		ContentType:  backend.ContentType,
+		StorageClass: "DEEP_ARCHIVE",
+		Metadata:     o.Metadata(),
+	}
+}
+
+func TestParseStatus(t *testing.T) {
+	for _, c := range []struct {
+		class, restore, status string
+	}{
+		{"DEEP_ARCHIVE", "", "DEEPS"},
+		{"DEEP_ARCHIVE", "ongoing-request=\"true\"", "RECOV"},
+		{"DEEP_ARCHIVE", "ongoing-request=\"false\", expiry-date=\"Fri, 21 Dec 2012 00:00:00 GMT\"", "READY"},
+		{"DEEP_ARCHIVE", "garbage", "?????"},
+		{"STANDARD", "", "?????"},
+	} {
+		o, err := Parse(&backend.Object{ContentType: backend.ContentType, StorageClass: c.class, Restore: c.restore, Size: 42}, nil, nil, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if o.Restore != c.status || o.Size != 42 {
+			t.Errorf("Parse(%s, %q) = %+v, want status %s", c.class, c.restore, o, c.status)
+		}
+	}
+
+	_, err := Parse(&backend.Object{ContentType: "text/plain"}, nil, nil, false)
+	if err == nil {
+		t.Error("Parse() accepted an object with another content type")
+	}
+}
+
+func TestPrepareParse(t *testing.T) {
+	kr := newTestKeyring(t, 1, false)
+
+	meta := &Meta{Size: 7, Mode: 0640, ModTime: time.Date(2019, 5, 1, 12, 0, 0, 0, time.UTC), UID: 1000, GID: 100}
+	req, err := Prepare(kr, nil, "file name.txt", meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := stored(req)
+	o, err := Parse(res, &req.Name, kr, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.Name != "file name.txt" || o.KeyID != kr.Active() || o.Key == nil || string(o.Key.Buffer()) != string(req.Key.Buffer()) {
+		t.Errorf("Parse() = %+v", o)
+	}
+	if o.Meta == nil || o.Meta.Size != 7 || o.Meta.Mode != 0640 || !o.Meta.ModTime.Equal(meta.ModTime) || o.Meta.UID != 1000 || o.Meta.GID != 100 {
+		t.Errorf("Parse() returned attributes %+v, want %+v", o.Meta, meta)
+	}
+
+	// The name can't pass for the attributes
+	res.Metadata["Meta"] = req.Name
+	_, err = Parse(res, &req.Name, kr, false)
+	if err == nil {
+		t.Error("Parse() accepted the encrypted name as attributes")
+	}
+	res.Metadata["Meta"] = req.Meta
+
+	res.Metadata["Nonce"] = hex.EncodeToString(make([]byte, 32))
+	_, err = Parse(res, &req.Name, kr, false)
+	if err == nil {
+		t.Error("Parse() accepted a name encrypted under another nonce")
+	}
+}
+
+func TestMetaBoundToObject(t *testing.T) {
+	kr := newTestKeyring(t, 1, false)
+
+	a, err := Prepare(kr, nil, "a", &Meta{Size: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := Prepare(kr, nil, "b", &Meta{Size: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := stored(b)
+	res.Metadata["Meta"] = a.Metadata()["Meta"]
+
+	_, err = Parse(res, &b.Name, kr, false)
+	if err == nil {
+		t.Error("Parse() accepted metadata copied from another object")
+	}
+}
+
+func TestDataKeyBoundToObject(t *testing.T) {
+	kr := newTestKeyring(t, 1, false)
+
+	a, err := Prepare(kr, nil, "a", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := Prepare(kr, nil, "b", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := stored(b)
+	res.Metadata["Datakey"] = a.Metadata()["Datakey"]
+
+	_, err = Parse(res, &b.Name, kr, true)
+	if err == nil {
+		t.Error("Parse() accepted a data key copied from another object")
+	}
+
+	_, err = kr.Unwrap(kr.Active(), b.Nonce, a.DataKey)
+	if err == nil {
+		t.Error("Unwrap() accepted a data key of another object")
+	}
+}
+
+func TestKeyring(t *testing.T) {
+	old := newTestKeyring(t, 1, false)
+	req, err := Prepare(old, nil, "old", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Rotation appends a new active key, so the same master key is still around under its ID
+	rotated, err := NewKeyring([]*memguard.LockedBuffer{old.Master(), newTestKeyring(t, 1, false).Master()}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rotated.IDs()) != 2 || rotated.IDs()[0] != old.Active() || rotated.Active() == old.Active() {
+		t.Fatalf("IDs() = %q after rotating %s", rotated.IDs(), old.Active())
+	}
+
+	o, err := Parse(stored(req), &req.Name, rotated, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.Name != "old" || o.KeyID != old.Active() || string(o.Key.Buffer()) != string(req.Key.Buffer()) {
+		t.Errorf("Parse() with a retired key = %+v", o)
+	}
+
+	req, err = Prepare(rotated, nil, "new", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.KeyID != rotated.Active() {
+		t.Errorf("Prepare() used key %s, want the active %s", req.KeyID, rotated.Active())
+	}
+	_, err = Parse(stored(req), &req.Name, newTestKeyring(t, 1, false), false)
+	if err == nil {
+		t.Error("Parse() succeeded without the key of the object")
+	}
+
+	// Data keys are unwrapped with the filename ciphers, which outlive the master keys
+	rotated.Destroy()
+	if rotated.Master() != nil {
+		t.Error("Master() returned a destroyed key")
+	}
+	key, err := rotated.Unwrap(req.KeyID, req.Nonce, req.DataKey)
+	if err != nil || string(key.Buffer()) != string(req.Key.Buffer()) {
+		t.Errorf("Unwrap() with a destroyed keyring = %v", err)
+	}
+}
+
+func TestParseBaseline(t *testing.T) {
+	kr := newTestKeyring(t, 2, false)
+
+	first, err := NewKeyring([]*memguard.LockedBuffer{kr.keys[0]}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := Prepare(first, nil, "baseline", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Archives from before key rotation and data keys carry neither, their key is derived from the oldest key
+	res := stored(req)
+	delete(res.Metadata, "Keyid")
+	delete(res.Metadata, "Datakey")
+
+	o, err := Parse(res, &req.Name, kr, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	derived, err := Derive(kr.keys[0], req.Nonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.Name != "baseline" || o.DataKey != "" || string(o.Key.Buffer()) != string(derived.Buffer()) {
+		t.Errorf("Parse() of a baseline archive = %+v", o)
+	}
+
+	kr.Destroy()
+	_, err = Parse(res, &req.Name, kr, true)
+	if err != ErrNoKeys {
+		t.Errorf("Parse() of a baseline archive with a destroyed keyring = %v, want %v", err, ErrNoKeys)
+	}
+}
+
+func TestRewrap(t *testing.T) {
+	kr := newTestKeyring(t, 1, false)
+
+	req, err := Prepare(kr, nil, "file", &Meta{Size: 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := Parse(stored(req), &req.Name, kr, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The content stays encrypted with the same data key under a new name and nonce
+	copied, err := res.Rewrap(kr, res.Meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if copied.Name == req.Name || string(copied.Nonce) == string(req.Nonce) || copied.DataKey == req.DataKey {
+		t.Errorf("Rewrap() = %+v, want a new name, nonce and wrapping", copied)
+	}
+
+	res, err = Parse(stored(copied), &copied.Name, kr, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Name != "file" || res.Meta.Size != 7 || string(res.Key.Buffer()) != string(req.Key.Buffer()) {
+		t.Errorf("Parse() of the copy = %+v", res)
+	}
+
+	// A wrapped key can't pass for the attributes
+	tampered := stored(copied)
+	tampered.Metadata["Meta"] = copied.DataKey
+	_, err = Parse(tampered, &copied.Name, kr, false)
+	if err == nil {
+		t.Error("Parse() accepted the data key as attributes")
+	}
+}
+
+func TestRecipients(t *testing.T) {
+	owner := newTestKeyring(t, 1, true)
+
+	// Write-only profiles have no keyring
+	req, err := Prepare(nil, []*Recipient{owner.recipient}, "shared", &Meta{Size: 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.KeyID != "" || req.DataKey != "" {
+		t.Errorf("Prepare() without a keyring wrapped the data key to %s", req.KeyID)
+	}
+
+	// The owner only has the identity to read the object with, even after its master keys are gone
+	owner.Destroy()
+	res, err := Parse(stored(req), &req.Name, owner, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Name != "shared" || res.Meta.Size != 7 || !res.Wrapped() || string(res.Key.Buffer()) != string(req.Key.Buffer()) {
+		t.Errorf("Parse() = %+v", res)
+	}
+	if len(res.Recipients) != 1 || res.Recipients[0] != owner.recipient.ID {
+		t.Errorf("Recipients = %v, want [%s]", res.Recipients, owner.recipient.ID)
+	}
+
+	_, err = Parse(stored(req), &req.Name, newTestKeyring(t, 1, true), false)
+	if err == nil {
+		t.Error("Parse() succeeded without the identity of the recipient")
+	}
+
+	_, err = Prepare(nil, nil, "file", nil)
+	if err == nil {
+		t.Error("Prepare() succeeded without a master key or recipient")
+	}
+}
+
+func TestParseInvalidName(t *testing.T) {
+	owner := newTestKeyring(t, 1, true)
+
+	// Whoever holds the recipient chooses the filename
+	for _, name := range []string{"../x", "..", ".", "", "/", "a/b", "/etc/passwd", "a\\b", "a\x00b", "a//"} {
+		req, err := Prepare(nil, []*Recipient{owner.recipient}, name, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := Parse(stored(req), &req.Name, owner, true)
+		if err != ErrInvalidName || res.Key != nil {
+			t.Errorf("Parse() of %q = %v, %v, want %v", name, res.Name, err, ErrInvalidName)
+		}
+	}
+}
+
+func TestParseRecipient(t *testing.T) {
+	kr := newTestKeyring(t, 0, true)
+
+	s := kr.recipient.String()
+	r, err := ParseRecipient(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.ID != kr.recipient.ID || r.key != kr.recipient.key {
+		t.Errorf("ParseRecipient(%s) = %+v, want %+v", s, r, kr.recipient)
+	}
+
+	// Any typo changes the checksum
+	typo := []byte(s)
+	if typo[10] == 'A' {
+		typo[10] = 'B'
+	} else {
+		typo[10] = 'A'
+	}
+	for _, invalid := range []string{string(typo), s[:len(s)-1], "ogive2" + s[6:], ""} {
+		if _, err := ParseRecipient(invalid); err == nil {
+			t.Errorf("ParseRecipient(%q) succeeded", invalid)
+		}
+	}
+}
+
+func TestStoredS3(t *testing.T) {
+	s := s3test.NewServer("bucket")
+	defer s.Close()
+	in, err := s.Profile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := backend.New(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	owner := newTestKeyring(t, 1, true)
+	other := newTestKeyring(t, 0, true)
+
+	req, err := Prepare(owner, []*Recipient{owner.recipient, other.recipient}, "file name.txt/", &Meta{Size: 42})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.Put(req.Name, strings.NewReader(""), 0, req.Metadata())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var keys []string
+	err = b.List(func(key string) bool {
+		keys = append(keys, key)
+		return true
+	})
+	if err != nil || len(keys) != 1 || keys[0] != req.Name {
+		t.Fatalf("List() = %q, %v, want [%s]", keys, err, req.Name)
+	}
+
+	// The metadata has to survive the trip through HTTP headers, for both the owner and the recipient
+	for _, kr := range []*Keyring{owner, other} {
+		head, err := b.Head(keys[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res, err := Parse(head, &keys[0], kr, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Name != "file name.txt/" || res.Meta == nil || res.Meta.Size != 42 || len(res.Recipients) != 2 {
+			t.Errorf("Parse() = %+v", res)
+		}
+		if string(res.Key.Buffer()) != string(req.Key.Buffer()) {
+			t.Error("Parse() returned a different data key")
+		}
+	}
+}
+
+func TestMultipleRecipients(t *testing.T) {
+	owner := newTestKeyring(t, 1, true)
+	other := newTestKeyring(t, 0, true)
+
+	// Repeated recipients are wrapped to once
+	req, err := Prepare(owner, []*Recipient{owner.recipient, other.recipient, other.recipient}, "shared", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := Parse(stored(req), &req.Name, other, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Name != "shared" || len(res.Recipients) != 2 || string(res.Key.Buffer()) != string(req.Key.Buffer()) {
+		t.Errorf("Parse() = %+v", res)
+	}
+
+	// Copies made by the owner stay readable by the other recipient
+	res, err = Parse(stored(req), &req.Name, owner, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copied, err := res.Rewrap(owner, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err = Parse(stored(copied), &copied.Name, other, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Name != "shared" || string(res.Key.Buffer()) != string(req.Key.Buffer()) {
+		t.Errorf("Parse() of the copy = %+v", res)
+	}
+
+	// A stanza taken from another object must not open
+	tampered := stored(copied)
+	tampered.Metadata["Recipients"] = req.Recipients
+	_, err = Parse(tampered, &copied.Name, other, true)
+	if err == nil {
+		t.Error("Parse() accepted recipients copied from another object")
+	}
+}
+
+func TestRecipientsLimit(t *testing.T) {
+	kr := newTestKeyring(t, 1, false)
+
+	var recipients []*Recipient
+	for i := 0; i < 8; i++ {
+		recipients = append(recipients, newTestKeyring(t, 0, true).recipient)
+	}
+
+	// Attributes of a file the size of a regular upload, including a checksum
+	meta := &Meta{Size: 1 << 40, Mode: 0644, UID: 1000, GID: 1000, Checksum: make([]byte, 32)}
+	_, err := Prepare(kr, recipients, "a rather long filename of a backup archive.tar.gz", meta)
+	if err != nil {
+		t.Errorf("Prepare() with %d recipients: %v", len(recipients), err)
+	}
+
+	for i := 0; i < 8; i++ {
+		recipients = append(recipients, newTestKeyring(t, 0, true).recipient)
+	}
+	_, err = Prepare(kr, recipients, "file", meta)
+	if err == nil {
+		t.Errorf("Prepare() with %d recipients succeeded", len(recipients))
+	}
+}
+
+func TestRenew(t *testing.T) {
+	owner := newTestKeyring(t, 1, true)
+	other := newTestKeyring(t, 0, true)
+
+	req, err := Prepare(owner, []*Recipient{other.recipient}, "file", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := Parse(stored(req), &req.Name, owner, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	renewed, err := res.Renew(owner, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(renewed.Key.Buffer()) == string(req.Key.Buffer()) {
+		t.Error("Renew() kept the data key")
+	}
+
+	res, err = Parse(stored(renewed), &renewed.Name, other, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Name != "file" || string(res.Key.Buffer()) != string(renewed.Key.Buffer()) {
+		t.Errorf("Parse() of the renewed object = %+v", res)
+	}
+}
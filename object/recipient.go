@@ -0,0 +1,243 @@
+package object
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"github.com/awnumar/memguard"
+	"github.com/mgren/ogive/crypt"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+	"io"
+	"strings"
+)
+
+// RecipientPrefix starts the printable form of every recipient.
+const RecipientPrefix = "ogive1"
+
+// recipientLabel is the HKDF info of the keys wrapping data keys to recipients.
+const recipientLabel = "ogive x25519"
+
+// nameLabel is the HKDF info of the filename key of objects wrapped to recipients.
+const nameLabel = "ogive filename"
+
+// IdentitySize is the size of an X25519 private key.
+const IdentitySize = 32
+
+// checksumSize is the size of the checksum appended to printed recipients, so that typos are caught.
+const checksumSize = 4
+
+// NewIdentity generates a random X25519 private key.
+func NewIdentity() (*memguard.LockedBuffer, error) {
+	return memguard.NewImmutableRandom(IdentitySize)
+}
+
+// IdentityRecipient returns the recipient public key of an X25519 private key.
+func IdentityRecipient(identity *memguard.LockedBuffer) (*Recipient, error) {
+	if identity.Size() != IdentitySize {
+		return nil, errors.New("Malformed identity.")
+	}
+
+	var priv [32]byte
+	copy(priv[:], identity.Buffer())
+	defer memguard.WipeBytes(priv[:])
+
+	r := &Recipient{}
+	curve25519.ScalarBaseMult(&r.key, &priv)
+	r.ID = recipientID(r.key)
+	return r, nil
+}
+
+// ParseRecipient parses the printable form of a recipient, as returned by Recipient.String.
+func ParseRecipient(s string) (*Recipient, error) {
+	invalid := errors.New("Invalid recipient " + s)
+	if !strings.HasPrefix(s, RecipientPrefix) {
+		return nil, invalid
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(s[len(RecipientPrefix):])
+	if err != nil || len(data) != 32+checksumSize {
+		return nil, invalid
+	}
+
+	sum := sha256.Sum256(data[:32])
+	if !bytes.Equal(sum[:checksumSize], data[32:]) {
+		return nil, errors.New("Recipient checksum mismatch, " + s + " is mistyped.")
+	}
+
+	r := &Recipient{}
+	copy(r.key[:], data)
+	r.ID = recipientID(r.key)
+	return r, nil
+}
+
+// String returns the printable form of the recipient, the public key followed by a short checksum.
+func (r *Recipient) String() string {
+	sum := sha256.Sum256(r.key[:])
+	return RecipientPrefix + base64.RawURLEncoding.EncodeToString(append(r.key[:], sum[:checksumSize]...))
+}
+
+// wrap wraps a data key to the recipient with a new ephemeral key pair, bound to the object nonce.
+// It returns the stanza stored in the object metadata: recipient public key, ephemeral public key and wrapped key,
+// separated by colons. The recipient public key allows wrapping the data key again when the object is copied.
+func (r *Recipient) wrap(key *memguard.LockedBuffer, nonce []byte) (string, error) {
+	eph, err := NewIdentity()
+	if err != nil {
+		return "", err
+	}
+	defer eph.Destroy()
+
+	var priv, pub [32]byte
+	copy(priv[:], eph.Buffer())
+	defer memguard.WipeBytes(priv[:])
+	curve25519.ScalarBaseMult(&pub, &priv)
+
+	gcm, err := wrapCipher(&priv, &r.key, &pub, &r.key)
+	if err != nil {
+		return "", err
+	}
+
+	blob, err := sealKey(gcm, key, binding(dataKeyLabel, nonce, r.ID))
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawStdEncoding.EncodeToString(r.key[:]) + ":" + base64.RawStdEncoding.EncodeToString(pub[:]) + ":" + blob, nil
+}
+
+// parseStanza splits a stanza created by Recipient.wrap into the recipient, the ephemeral public key and the wrapped key.
+func parseStanza(s string) (r *Recipient, eph [32]byte, blob string, err error) {
+	stanza := strings.Split(s, ":")
+	if len(stanza) != 3 {
+		err = errors.New("Malformed recipients.")
+		return
+	}
+
+	r = &Recipient{}
+	for i, k := range []*[32]byte{&r.key, &eph} {
+		data, derr := base64.RawStdEncoding.DecodeString(stanza[i])
+		if derr != nil || len(data) != len(k) {
+			err = errors.New("Malformed recipients.")
+			return
+		}
+		copy(k[:], data)
+	}
+
+	r.ID = recipientID(r.key)
+	return r, eph, stanza[2], nil
+}
+
+// unwrapStanza is the inverse of Recipient.wrap, using the identity of the keyring.
+func (kr *Keyring) unwrapStanza(eph [32]byte, blob string, nonce []byte) (*memguard.LockedBuffer, error) {
+	var priv [32]byte
+	copy(priv[:], kr.identity.Buffer())
+	defer memguard.WipeBytes(priv[:])
+
+	gcm, err := wrapCipher(&priv, &eph, &eph, &kr.recipient.key)
+	if err != nil {
+		return nil, err
+	}
+
+	return openKey(gcm, blob, binding(dataKeyLabel, nonce, kr.recipient.ID))
+}
+
+// unwrap returns the data key of an object wrapped to recipients, along with the ID of the master key it was unwrapped
+// with and all its recipients. The master key is preferred, the identity is only used if the object carries
+// no data key wrapped with a master key in the keyring.
+func (kr *Keyring) unwrap(stanzas []string, nonce []byte, meta map[string]string) (key *memguard.LockedBuffer, keyID string, recipients []*Recipient, err error) {
+	var own string
+	var ownEph [32]byte
+	for _, s := range stanzas {
+		r, eph, blob, perr := parseStanza(s)
+		if perr != nil {
+			err = perr
+			return
+		}
+
+		recipients = append(recipients, r)
+		if kr.recipient != nil && r.ID == kr.recipient.ID {
+			own, ownEph = blob, eph
+		}
+	}
+
+	// Objects wrapped to recipients always carry the key ID, an empty one must not select the oldest key
+	if id, blob := meta["Keyid"], meta["Datakey"]; id != "" && blob != "" {
+		if i, ferr := kr.find(id); ferr == nil {
+			key, err = openKey(kr.gcms[i], blob, binding(dataKeyLabel, nonce, id))
+			return key, kr.ids[i], recipients, err
+		}
+	}
+
+	if own == "" {
+		err = errors.New("No key in the profile can decrypt the file, it is encrypted to recipients " + strings.Join(recipientIDs(recipients), ", ") + ".")
+		return
+	}
+
+	key, err = kr.unwrapStanza(ownEph, own, nonce)
+	return
+}
+
+// recipientIDs returns the IDs of the recipients.
+func recipientIDs(recipients []*Recipient) []string {
+	ids := make([]string, len(recipients))
+	for i, r := range recipients {
+		ids[i] = r.ID
+	}
+	return ids
+}
+
+// wrapCipher sets up the cipher wrapping data keys, keyed by the X25519 shared secret of priv and peer.
+// The ephemeral and recipient public keys are bound to the derived key.
+func wrapCipher(priv, peer, ephemeral, recipient *[32]byte) (cipher.AEAD, error) {
+	var shared [32]byte
+	curve25519.ScalarMult(&shared, priv, peer)
+	defer memguard.WipeBytes(shared[:])
+
+	// Low order points yield an all-zero secret
+	if shared == [32]byte{} {
+		return nil, errors.New("Invalid X25519 public key.")
+	}
+
+	buf := make([]byte, 32)
+	salt := append(append([]byte(nil), ephemeral[:]...), recipient[:]...)
+	_, err := io.ReadFull(hkdf.New(sha256.New, shared[:], salt, []byte(recipientLabel)), buf)
+	if err != nil {
+		return nil, err
+	}
+
+	k, err := memguard.NewImmutableFromBytes(buf)
+	if err != nil {
+		return nil, err
+	}
+	defer k.Destroy()
+
+	return crypt.GetGCM(k, 0)
+}
+
+// nameCipher sets up the filename cipher of objects wrapped to recipients, keyed by the data key,
+// so that any recipient can read the filename without the master key.
+func nameCipher(key *memguard.LockedBuffer) (cipher.AEAD, error) {
+	buf := make([]byte, 32)
+	_, err := io.ReadFull(hkdf.New(sha256.New, key.Buffer(), nil, []byte(nameLabel)), buf)
+	if err != nil {
+		return nil, err
+	}
+
+	k, err := memguard.NewImmutableFromBytes(buf)
+	if err != nil {
+		return nil, err
+	}
+	defer k.Destroy()
+
+	// The object nonce is shared with the filename, like with the master key ciphers
+	return crypt.GetGCM(k, 32)
+}
+
+// recipientID returns the identifier of a recipient, stored with every object wrapped to it.
+func recipientID(pub [32]byte) string {
+	sum := sha256.Sum256(append([]byte(recipientLabel), pub[:]...))
+	return hex.EncodeToString(sum[:8])
+}
@@ -1,7 +1,9 @@
 package object
 
 import (
+	"crypto/cipher"
 	"github.com/awnumar/memguard"
+	"os"
 	"time"
 )
 
@@ -16,19 +18,38 @@ type ResponseObject struct {
 	// LastModified is the file creation date as indicated by Last-Modified
 	LastModified time.Time
 
-	// Nonce is the unique nonce used for key derivation
+	// Expiry is the time the restored copy is removed as indicated by x-amz-restore, zero if there is none
+	Expiry time.Time
+
+	// Nonce is the unique nonce used for filename encryption, and for key derivation in objects without a wrapped data key
 	Nonce []byte
 
 	// Name is the original unencrypted filename
 	Name string
 
-	// Key is the unique derived key
+	// Meta holds the original file attributes, nil for archives stored without them
+	Meta *Meta
+
+	// KeyID identifies the master key the object is encrypted with, empty for objects only readable with the identity
+	KeyID string
+
+	// DataKey is the wrapped data key as stored in the object metadata, empty for objects whose key is derived from the nonce
+	// and objects wrapped to recipients only
+	DataKey string
+
+	// Recipients holds the IDs of the recipients the data key is wrapped to, nil if there are none
+	Recipients []string
+
+	// recipients holds the recipients the data key is wrapped to, so that it can be wrapped to them again
+	recipients []*Recipient
+
+	// Key is the unique file key, only set if requested
 	Key *memguard.LockedBuffer
 }
 
 // RequestObject is an ogive-friendly representation of object metadata needed to prepare a PUT request
 type RequestObject struct {
-	// Nonce is the unique nonce used for key derivation
+	// Nonce is the unique nonce used for filename encryption
 	Nonce []byte
 
 	// Name is the encrypted filename, represented as AWS-key-safe version of base64
@@ -37,6 +58,73 @@ type RequestObject struct {
 	// https://docs.aws.amazon.com/AmazonS3/latest/dev/UsingMetadata.html
 	Name string
 
-	// Key is the unique derived key
+	// Meta is the encrypted metadata blob, represented as base64, empty if there are no attributes to store
+	Meta string
+
+	// KeyID identifies the master key the object is encrypted with, empty if there is none
+	KeyID string
+
+	// DataKey is the data key wrapped with the master key, represented as base64
+	DataKey string
+
+	// Recipients holds the data key wrapped to every recipient, as comma separated stanzas, empty if there are none
+	Recipients string
+
+	// Key is the random data key the content is encrypted with
 	Key *memguard.LockedBuffer
 }
+
+// Meta holds attributes of the original file, stored encrypted in the object user metadata
+type Meta struct {
+	// Size is the original size in bytes, -1 if unknown (ex. for directories)
+	Size int64
+
+	// Mode is the original file mode, including type bits
+	Mode os.FileMode
+
+	// ModTime is the original modification time
+	ModTime time.Time
+
+	// UID is the id of the original owner
+	UID int
+
+	// GID is the id of the original group
+	GID int
+
+	// Checksum is the SHA-256 digest of the original content, empty for streams, which carry it in a trailer
+	Checksum []byte
+
+	// Uploaded is the upload time of the original archive for archives re-encrypted with another key, zero otherwise
+	Uploaded time.Time
+
+	// Trailer indicates that the digest is instead appended to the content, for streams whose checksum is only known once uploaded
+	Trailer bool
+}
+
+// Keyring holds all master keys of a profile, so that objects encrypted with retired keys remain readable.
+// New objects are always encrypted with the active key, the last one.
+type Keyring struct {
+	// keys holds the master keys, oldest first, nil once destroyed.
+	keys []*memguard.LockedBuffer
+
+	// ids holds the key IDs of the master keys.
+	ids []string
+
+	// gcms holds the filename ciphers of the master keys.
+	gcms []cipher.AEAD
+
+	// identity is the X25519 private key of the profile, nil if there is none.
+	identity *memguard.LockedBuffer
+
+	// recipient is the public key of identity.
+	recipient *Recipient
+}
+
+// Recipient is an X25519 public key, which data keys can be wrapped to without holding any master key
+type Recipient struct {
+	// ID identifies the recipient in the metadata of objects wrapped to it
+	ID string
+
+	// key is the public key
+	key [32]byte
+}
@@ -10,20 +10,39 @@ import (
 	"io/ioutil"
 )
 
-const version = uint32(1)
+const version = uint32(4)
 const magic = "OGPROF"
 
-// Open reads the profile file from provided location and returns decrypted InnerData.
-func Open(fname string) (in *InnerData, err error) {
-	var pwd, derived *memguard.LockedBuffer
-	var od *OuterData
+// KeySize is the size of a master key.
+const KeySize = 32
+
+// IdentitySize is the size of an X25519 identity.
+const IdentitySize = 32
+
+// fieldCount is the number of InnerData fields stored by each supported profile version.
+// Fields added in later versions are appended, so older profiles simply lack them.
+var fieldCount = map[uint32]int{1: 6, 2: 7, 3: 8, 4: 10}
+
+// ErrWriteOnly is returned when master keys are needed from a write-only profile.
+var ErrWriteOnly = errors.New("Write-only profile holds no master key.")
 
-	pwd, err = input.GetMaskedInput("Enter password", "", "", 64, 8)
+// Open asks for the profile password, then reads the profile file from provided location and returns decrypted InnerData.
+func Open(fname string) (in *InnerData, err error) {
+	var pwd *memguard.LockedBuffer
+	pwd, err = input.GetPassword("Enter password", 64, 8)
 	if err != nil {
 		return
 	}
 	defer pwd.Destroy()
 
+	return Load(fname, pwd)
+}
+
+// Load reads the profile file from provided location and returns InnerData decrypted with the password.
+func Load(fname string, pwd *memguard.LockedBuffer) (in *InnerData, err error) {
+	var derived *memguard.LockedBuffer
+	var od *OuterData
+
 	var data []byte
 	data, err = ioutil.ReadFile(fname)
 	if err != nil {
@@ -36,7 +55,7 @@ func Open(fname string) (in *InnerData, err error) {
 		return
 	}
 
-	if od.Magic != magic || od.Version != version {
+	if _, ok := fieldCount[od.Version]; od.Magic != magic || !ok {
 		err = errors.New("Unsupported or corrupted profile file.")
 		return
 	}
@@ -82,10 +101,153 @@ func Save(key *memguard.LockedBuffer, in *InnerData, fname string) (err error) {
 	return ioutil.WriteFile(fname, buf.Bytes(), 0600)
 }
 
-// NewInner creates a mew InnerData instance with a randomly generated master key.
+// NewInner creates a mew InnerData instance with a randomly generated master key and identity.
 func NewInner() (in *InnerData, err error) {
 	var i InnerData
 	in = &i
-	in.Key, err = memguard.NewImmutableRandom(32)
+	in.Key, err = memguard.NewImmutableRandom(KeySize)
+	if err != nil {
+		return
+	}
+
+	in.Identity, err = memguard.NewImmutableRandom(IdentitySize)
 	return
 }
+
+// NewWriteOnly creates a new InnerData instance holding no master key, which can only encrypt files to the recipient.
+func NewWriteOnly(recipient string) *InnerData {
+	return &InnerData{Recipient: recipient}
+}
+
+// WriteOnly reports whether the profile holds no master key.
+func (in *InnerData) WriteOnly() bool {
+	return in.Key == nil
+}
+
+// Keys returns copies of all master keys, oldest first, the last one being the active key.
+func (in *InnerData) Keys() (keys []*memguard.LockedBuffer, err error) {
+	if in.WriteOnly() {
+		return nil, ErrWriteOnly
+	}
+
+	if in.Retired != nil {
+		if in.Retired.Size()%KeySize != 0 {
+			return nil, errors.New("Corrupted profile file.")
+		}
+
+		for off := 0; off < in.Retired.Size(); off += KeySize {
+			var k *memguard.LockedBuffer
+			k, err = memguard.Trim(in.Retired, off, KeySize)
+			if err != nil {
+				return
+			}
+			keys = append(keys, k)
+		}
+	}
+
+	var k *memguard.LockedBuffer
+	k, err = memguard.Duplicate(in.Key)
+	if err != nil {
+		return
+	}
+
+	return append(keys, k), nil
+}
+
+// KeyMaterial serializes the secrets a profile can't be rebuilt without: the number of master keys,
+// the master keys oldest first and the identity, if there is one.
+func (in *InnerData) KeyMaterial() (*memguard.LockedBuffer, error) {
+	keys, err := in.Keys()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, k := range keys {
+			k.Destroy()
+		}
+	}()
+
+	if len(keys) > 255 {
+		return nil, errors.New("Too many master keys.")
+	}
+
+	size := 1 + len(keys)*KeySize
+	if in.Identity != nil {
+		size += in.Identity.Size()
+	}
+
+	data, err := memguard.NewMutable(size)
+	if err != nil {
+		return nil, err
+	}
+
+	data.Buffer()[0] = byte(len(keys))
+	for i, k := range keys {
+		data.CopyAt(k.Buffer(), 1+i*KeySize)
+	}
+	if in.Identity != nil {
+		data.CopyAt(in.Identity.Buffer(), 1+len(keys)*KeySize)
+	}
+
+	data.MakeImmutable()
+	return data, nil
+}
+
+// FromKeyMaterial creates a new InnerData instance holding the secrets serialized by KeyMaterial.
+func FromKeyMaterial(data *memguard.LockedBuffer) (in *InnerData, err error) {
+	size := data.Size()
+	if size < 1 {
+		return nil, errors.New("Malformed key material.")
+	}
+
+	n := int(data.Buffer()[0])
+	rest := size - 1 - n*KeySize
+	if n == 0 || (rest != 0 && rest != IdentitySize) {
+		return nil, errors.New("Malformed key material.")
+	}
+
+	in = &InnerData{}
+	if n > 1 {
+		in.Retired, err = memguard.Trim(data, 1, (n-1)*KeySize)
+		if err != nil {
+			return
+		}
+	}
+
+	in.Key, err = memguard.Trim(data, 1+(n-1)*KeySize, KeySize)
+	if err != nil {
+		return
+	}
+
+	if rest != 0 {
+		in.Identity, err = memguard.Trim(data, 1+n*KeySize, IdentitySize)
+	}
+	return
+}
+
+// Rotate retires the active master key and replaces it with a new random one.
+func (in *InnerData) Rotate() error {
+	if in.WriteOnly() {
+		return ErrWriteOnly
+	}
+
+	retired := in.Key
+	if in.Retired != nil {
+		var err error
+		retired, err = memguard.Concatenate(in.Retired, in.Key)
+		if err != nil {
+			return err
+		}
+		in.Retired.Destroy()
+		in.Key.Destroy()
+	}
+	retired.MakeImmutable()
+
+	key, err := memguard.NewImmutableRandom(KeySize)
+	if err != nil {
+		return err
+	}
+
+	in.Retired, in.Key = retired, key
+	return nil
+}
@@ -20,6 +20,15 @@ func (id *InnerData) marshalBinaryLocked() (buf *memguard.LockedBuffer, err erro
 			t := f.Interface()
 			switch t := t.(type) {
 			case *memguard.LockedBuffer:
+				// Optional fields may be left unset
+				if t == nil {
+					err = binary.Write(&head, binary.LittleEndian, uint32(0))
+					if err != nil {
+						return nil, err
+					}
+					continue
+				}
+
 				err = binary.Write(&head, binary.LittleEndian, uint32(t.Size()))
 				if err != nil {
 					return nil, err
@@ -60,20 +69,23 @@ func (id *InnerData) marshalBinaryLocked() (buf *memguard.LockedBuffer, err erro
 	return memguard.Concatenate(headLocked, bodyLocked)
 }
 
-func (id *InnerData) unmarshalBinaryLocked(data *memguard.LockedBuffer) error {
-	v, total := reflect.ValueOf(id).Elem(), uint32(24) // four bytes per value times six fields
+func (id *InnerData) unmarshalBinaryLocked(data *memguard.LockedBuffer, fields int) error {
+	v, total := reflect.ValueOf(id).Elem(), uint32(4*fields) // four bytes per value
 	data.MakeMutable()
 
-	for i := 0; i < v.NumField(); i++ {
+	for i := 0; i < fields; i++ {
 		f := v.Field(i)
 		if f.CanInterface() {
 			size := binary.LittleEndian.Uint32(data.Buffer()[4*i : 4*(1+i)])
-			if size == 0 {
+			if size == 0 && v.Type().Field(i).Tag.Get("profile") != "optional" {
 				return errors.New("Corruped profile file.")
 			}
 			t := f.Interface()
 			switch t.(type) {
 			case *memguard.LockedBuffer:
+				if size == 0 {
+					continue
+				}
 				b, err := memguard.NewImmutableFromBytes(data.Buffer()[total : total+size])
 				if err != nil {
 					return err
@@ -103,7 +115,9 @@ func (id *InnerData) wipe() {
 			// We don't care about string data here
 			switch t := t.(type) {
 			case *memguard.LockedBuffer:
-				t.Destroy()
+				if t != nil {
+					t.Destroy()
+				}
 			default:
 			}
 		}
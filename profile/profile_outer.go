@@ -1,6 +1,7 @@
 package profile
 
 import (
+	"errors"
 	"github.com/awnumar/memguard"
 	"github.com/mgren/ogive/crypt"
 )
@@ -47,6 +48,9 @@ func (od *OuterData) unpack(key *memguard.LockedBuffer) (*InnerData, error) {
 		return nil, err
 	}
 
-	err = inner.unmarshalBinaryLocked(locked)
+	err = inner.unmarshalBinaryLocked(locked, fieldCount[od.Version])
+	if err == nil && inner.Key == nil && inner.Recipient == "" {
+		err = errors.New("Corrupted profile file.")
+	}
 	return &inner, err
 }
@@ -6,8 +6,8 @@ import (
 
 // InnerData is the actual profile data, stored in an encrypted format
 type InnerData struct {
-	// Key is the master key used to encrypt files at rest
-	Key *memguard.LockedBuffer
+	// Key is the master key used to encrypt files at rest, nil for write-only profiles
+	Key *memguard.LockedBuffer `profile:"optional"`
 
 	// AWSKeyId ia the AWS Key ID used to upload/download files
 	AWSKeyId *memguard.LockedBuffer
@@ -23,6 +23,18 @@ type InnerData struct {
 
 	// Region is the AWS region in which the S3 bucket is located
 	Region string
+
+	// NotifyQueue is the URL of an SQS queue receiving S3 restore completion events, empty if none
+	NotifyQueue string `profile:"optional"`
+
+	// Retired holds previous master keys, KeySize bytes each, oldest first, nil if the key was never rotated
+	Retired *memguard.LockedBuffer `profile:"optional"`
+
+	// Identity is the X25519 private key files encrypted to the profile recipient are decrypted with, nil if there is none
+	Identity *memguard.LockedBuffer `profile:"optional"`
+
+	// Recipient is the public key write-only profiles encrypt files to, empty for profiles holding the master key
+	Recipient string `profile:"optional"`
 }
 
 // OuterData is a wrapper for InnerData that holds information needed to perform
@@ -8,8 +8,9 @@ import (
 	"time"
 )
 
-// TrackProgress monitors the passed ProgressReporter and draws a progress bar to stdout based on expected total.
+// TrackProgress monitors the passed ProgressReporter and draws a progress bar to stderr based on expected total.
 // Due to a 1 second resolution it uses a channel to wake the parent goroutine once it finishes.
+// If the total is only an estimate, the reporter must be marked as finished once the transfer completes.
 func TrackProgress(p ProgressReporter, total int, done chan<- bool) {
 	theme := progressbar.Theme{Saucer: "█", SaucerPadding: "░", BarStart: "┨", BarEnd: "┠"}
 	bar := progressbar.NewOptions(total,
@@ -22,9 +23,9 @@ func TrackProgress(p ProgressReporter, total int, done chan<- bool) {
 
 	for true {
 		current := p.GetProgress()
-		if current >= total {
+		if current >= total || p.IsFinished() {
 			bar.Finish()
-			fmt.Println("\nFinalizing, please wait for the process to exit...")
+			fmt.Fprintln(os.Stderr, "\nFinalizing, please wait for the process to exit...")
 			break
 		}
 		bar.Add(current - sum)
@@ -38,33 +39,51 @@ func TrackProgress(p ProgressReporter, total int, done chan<- bool) {
 // Read proxies all reads while tracking the totalProgress.
 func (r *Reader) Read(p []byte) (n int, err error) {
 	n, err = r.Reader.Read(p)
-	r.totalProgress += n
+	r.Add(n)
 	return
 }
 
 // Write proxies all writes while tracking the totalProgress.
 func (w *Writer) Write(p []byte) (n int, err error) {
 	n, err = w.Writer.Write(p)
-	w.totalProgress += n
+	w.Add(n)
 	return
 }
 
-// GetProgress returns the total number of bytes read.
-func (r *Reader) GetProgress() int {
-	return r.totalProgress
+// Add increases the total number of bytes processed.
+func (c *Counter) Add(n int) {
+	c.mu.Lock()
+	c.totalProgress += n
+	c.mu.Unlock()
 }
 
-// GetProgress returns the total number of bytes written.
-func (w *Writer) GetProgress() int {
-	return w.totalProgress
+// GetProgress returns the total number of bytes processed.
+func (c *Counter) GetProgress() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.totalProgress
+}
+
+// Finish marks the counter as finished.
+func (c *Counter) Finish() {
+	c.mu.Lock()
+	c.finished = true
+	c.mu.Unlock()
+}
+
+// IsFinished reports whether the counter was marked as finished.
+func (c *Counter) IsFinished() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.finished
 }
 
 // NewReader returns a new reader with progress reporting capability.
-func NewReader(r io.Reader) Reader {
-	return Reader{r, 0}
+func NewReader(r io.Reader) *Reader {
+	return &Reader{Reader: r}
 }
 
 // NewWriter returns a new writer with progress reporting capability.
-func NewWriter(w io.Writer) Writer {
-	return Writer{w, 0}
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{Writer: w}
 }
@@ -2,6 +2,7 @@ package progress
 
 import (
 	"io"
+	"sync"
 )
 
 // Reader extends io.Reader interface with a byte counter
@@ -9,8 +10,8 @@ type Reader struct {
 	// Reader is the underlying io.Reader to which all read calls are proxied.
 	io.Reader
 
-	// totalProgress indicates the total number of bytes read from reader.
-	totalProgress int
+	// Counter counts the bytes read from reader, it is read concurrently by TrackProgress.
+	Counter
 }
 
 // Writer extends io.Writer interface with a byte counter
@@ -18,12 +19,27 @@ type Writer struct {
 	// Writer is the underlying io.Writer to which all read calls are proxied.
 	io.Writer
 
-	// totalProgress indicates the total number of bytes written to writer.
+	// Counter counts the bytes written to writer, it is read concurrently by TrackProgress.
+	Counter
+}
+
+// Counter is a byte counter for transfers split into concurrently processed parts
+type Counter struct {
+	// mu guards totalProgress and finished.
+	mu sync.Mutex
+
+	// totalProgress indicates the total number of bytes processed.
 	totalProgress int
+
+	// finished indicates that no more bytes are expected.
+	finished bool
 }
 
 // ProgressReporter is an interface implemented by progress-tracking readers and writers
 type ProgressReporter interface {
 	// GetProgress returns the totalProgress of the r/w interface
 	GetProgress() int
+
+	// IsFinished reports whether the transfer is known to be complete, regardless of its progress
+	IsFinished() bool
 }
@@ -0,0 +1,600 @@
+package s3test
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"github.com/awnumar/memguard"
+	"github.com/mgren/ogive/profile"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const metaPrefix = "X-Amz-Meta-"
+
+// NewServer starts a new Server serving an empty bucket. It should be closed when no longer needed.
+func NewServer(bucket string) *Server {
+	s := &Server{
+		Bucket:  bucket,
+		MaxKeys: 1000,
+		objects: map[string]*object{},
+		uploads: map[string]*upload{},
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+// Profile returns ogive profile data with a new random master key and dummy AWS credentials,
+// pointing at the Server and its notification queue. The result can be stored with profile.Save and used by any ogive command.
+func (s *Server) Profile() (in *profile.InnerData, err error) {
+	in, err = profile.NewInner()
+	if err != nil {
+		return
+	}
+
+	in.AWSKeyId, err = memguard.NewImmutableFromBytes([]byte("AKIAOGIVETEST"))
+	if err != nil {
+		return
+	}
+
+	in.AWSSecret, err = memguard.NewImmutableFromBytes([]byte("ogive-test-secret"))
+	if err != nil {
+		return
+	}
+
+	in.BucketName = s.Bucket
+	in.Endpoint = s.URL
+	in.Region = "us-east-1"
+	in.NotifyQueue = s.QueueURL()
+	return
+}
+
+// CompleteRestores immediately finishes all ongoing restores, regardless of RestoreDelay.
+func (s *Server) CompleteRestores() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, o := range s.objects {
+		if !o.restored.IsZero() {
+			o.restored = time.Now().Add(-s.RestoreDelay)
+		}
+	}
+}
+
+// Keys returns all stored keys in lexical order.
+func (s *Server) Keys() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.keys()
+}
+
+func (s *Server) keys() []string {
+	keys := make([]string, 0, len(s.objects))
+	for k := range s.objects {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// SetModified changes the upload time of a stored object, ex. to make it older than the Deep Archive minimum storage duration.
+// It reports whether the object exists.
+func (s *Server) SetModified(key string, t time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	o, ok := s.objects[key]
+	if ok {
+		o.modified = t
+	}
+	return ok
+}
+
+// Throttle makes the server reject the next n object requests with 503 SlowDown.
+func (s *Server) Throttle(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.slowDown = n
+}
+
+// Corrupt makes the server flip a bit in the content of the next n PutObject or UploadPart requests, as if damaged in transit.
+// Requests carrying Content-MD5 are then rejected with BadDigest, others are stored damaged.
+func (s *Server) Corrupt(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.corrupt = n
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	// Queue requests are sent to the service endpoint rather than the bucket
+	if r.Method == http.MethodPost && r.URL.Path == "/" {
+		s.handleQueue(w, r)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	path := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if path[0] != s.Bucket {
+		writeError(w, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist")
+		return
+	}
+
+	q := r.URL.Query()
+
+	if len(path) == 1 || path[1] == "" {
+		if r.Method == http.MethodGet && q.Get("list-type") == "2" {
+			s.listObjects(w, r)
+			return
+		}
+		writeError(w, http.StatusNotImplemented, "NotImplemented", "Unsupported bucket operation")
+		return
+	}
+
+	if s.slowDown > 0 {
+		s.slowDown--
+		writeError(w, http.StatusServiceUnavailable, "SlowDown", "Please reduce your request rate.")
+		return
+	}
+
+	key := path[1]
+	_, isUploads := q["uploads"]
+	_, isRestore := q["restore"]
+	uploadID := q.Get("uploadId")
+	copySource := r.Header.Get("X-Amz-Copy-Source")
+
+	switch {
+	case r.Method == http.MethodPut && uploadID != "" && copySource != "":
+		s.uploadPartCopy(w, r, uploadID, copySource)
+	case r.Method == http.MethodPut && copySource != "":
+		s.copyObject(w, r, key, copySource)
+	case r.Method == http.MethodPost && isUploads:
+		s.createUpload(w, r, key)
+	case r.Method == http.MethodPut && uploadID != "":
+		s.uploadPart(w, r, uploadID)
+	case r.Method == http.MethodPost && uploadID != "":
+		s.completeUpload(w, r, key, uploadID)
+	case r.Method == http.MethodDelete && uploadID != "":
+		delete(s.uploads, uploadID)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPost && isRestore:
+		s.restoreObject(w, r, key)
+	case r.Method == http.MethodPut:
+		s.putObject(w, r, key)
+	case r.Method == http.MethodHead:
+		s.headObject(w, key)
+	case r.Method == http.MethodGet:
+		s.getObject(w, r, key)
+	case r.Method == http.MethodDelete:
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusNotImplemented, "NotImplemented", "Unsupported object operation")
+	}
+}
+
+func (s *Server) putObject(w http.ResponseWriter, r *http.Request, key string) {
+	data, ok := s.readBody(w, r)
+	if !ok {
+		return
+	}
+
+	o := newObject(r, data)
+	s.objects[key] = o
+
+	w.Header().Set("ETag", o.etag)
+}
+
+// readBody reads uploaded content, damaging it if requested by Corrupt, and checks it against Content-MD5 if present.
+// Errors are written to w, in which case ok is false.
+func (s *Server) readBody(w http.ResponseWriter, r *http.Request) (data []byte, ok bool) {
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+		return nil, false
+	}
+
+	if s.corrupt > 0 && len(data) > 0 {
+		s.corrupt--
+		data[len(data)/2] ^= 1
+	}
+
+	if v := r.Header.Get("Content-MD5"); v != "" {
+		sum := md5.Sum(data)
+		if v != base64.StdEncoding.EncodeToString(sum[:]) {
+			writeError(w, http.StatusBadRequest, "BadDigest", "The Content-MD5 you specified did not match what was received.")
+			return nil, false
+		}
+	}
+
+	return data, true
+}
+
+func (s *Server) createUpload(w http.ResponseWriter, r *http.Request, key string) {
+	s.seq++
+	id := fmt.Sprintf("upload-%d", s.seq)
+	o := newObject(r, nil)
+	s.uploads[id] = &upload{key, o.contentType, o.storageClass, o.meta, map[int][]byte{}}
+
+	writeXML(w, http.StatusOK, initiateResult{Bucket: s.Bucket, Key: key, UploadId: id})
+}
+
+func (s *Server) uploadPart(w http.ResponseWriter, r *http.Request, uploadID string) {
+	u, ok := s.uploads[uploadID]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchUpload", "The specified upload does not exist")
+		return
+	}
+
+	n, err := strconv.Atoi(r.URL.Query().Get("partNumber"))
+	if err != nil || n < 1 || n > 10000 {
+		writeError(w, http.StatusBadRequest, "InvalidArgument", "Invalid part number")
+		return
+	}
+
+	data, ok := s.readBody(w, r)
+	if !ok {
+		return
+	}
+
+	u.parts[n] = data
+	sum := md5.Sum(data)
+	w.Header().Set("ETag", "\""+hex.EncodeToString(sum[:])+"\"")
+}
+
+func (s *Server) copyObject(w http.ResponseWriter, r *http.Request, key, source string) {
+	src, data, ok := s.copySource(w, source, "")
+	if !ok {
+		return
+	}
+
+	o := newObject(r, data)
+	if r.Header.Get("X-Amz-Metadata-Directive") != "REPLACE" {
+		o.contentType, o.meta = src.contentType, src.meta
+	}
+	s.objects[key] = o
+
+	writeXML(w, http.StatusOK, copyResult{ETag: o.etag, LastModified: o.modified.UTC().Format(time.RFC3339)})
+}
+
+func (s *Server) uploadPartCopy(w http.ResponseWriter, r *http.Request, uploadID, source string) {
+	u, ok := s.uploads[uploadID]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchUpload", "The specified upload does not exist")
+		return
+	}
+
+	n, err := strconv.Atoi(r.URL.Query().Get("partNumber"))
+	if err != nil || n < 1 || n > 10000 {
+		writeError(w, http.StatusBadRequest, "InvalidArgument", "Invalid part number")
+		return
+	}
+
+	_, data, ok := s.copySource(w, source, r.Header.Get("X-Amz-Copy-Source-Range"))
+	if !ok {
+		return
+	}
+
+	u.parts[n] = data
+	sum := md5.Sum(data)
+	writeXML(w, http.StatusOK, copyPartResult{ETag: "\"" + hex.EncodeToString(sum[:]) + "\"", LastModified: time.Now().UTC().Format(time.RFC3339)})
+}
+
+// copySource looks up the object named by an x-amz-copy-source header and returns its content, limited to rng unless empty.
+// Archived objects have to be restored first, same as for GetObject. Errors are written to w, in which case ok is false.
+func (s *Server) copySource(w http.ResponseWriter, source, rng string) (o *object, data []byte, ok bool) {
+	source, err := url.PathUnescape(strings.TrimPrefix(source, "/"))
+	path := strings.SplitN(source, "/", 2)
+	if err != nil || len(path) != 2 || path[0] != s.Bucket {
+		writeError(w, http.StatusBadRequest, "InvalidArgument", "Invalid copy source")
+		return nil, nil, false
+	}
+
+	o, ok = s.objects[path[1]]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+		return nil, nil, false
+	}
+
+	if o.storageClass == "DEEP_ARCHIVE" && !strings.Contains(s.restoreHeader(o), "ongoing-request=\"false\"") {
+		writeError(w, http.StatusForbidden, "InvalidObjectState", "The source object of the COPY operation is not in the active tier")
+		return nil, nil, false
+	}
+
+	data = o.data
+	if rng != "" {
+		start, end, err := parseRange(rng, len(o.data))
+		if err != nil {
+			writeError(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange", err.Error())
+			return nil, nil, false
+		}
+		data = o.data[start : end+1]
+	}
+
+	return o, data, true
+}
+
+func (s *Server) completeUpload(w http.ResponseWriter, r *http.Request, key, uploadID string) {
+	u, ok := s.uploads[uploadID]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchUpload", "The specified upload does not exist")
+		return
+	}
+
+	var req completeRequest
+	err := xml.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "MalformedXML", err.Error())
+		return
+	}
+
+	var data, sums []byte
+	for i, p := range req.Parts {
+		part, ok := u.parts[p.PartNumber]
+		sum := md5.Sum(part)
+		if !ok || p.ETag != "\""+hex.EncodeToString(sum[:])+"\"" {
+			writeError(w, http.StatusBadRequest, "InvalidPart", "One or more of the specified parts could not be found")
+			return
+		}
+		if i > 0 && p.PartNumber <= req.Parts[i-1].PartNumber {
+			writeError(w, http.StatusBadRequest, "InvalidPartOrder", "The list of parts was not in ascending order")
+			return
+		}
+		data = append(data, part...)
+		sums = append(sums, sum[:]...)
+	}
+
+	sum := md5.Sum(sums)
+	etag := fmt.Sprintf("\"%x-%d\"", sum, len(req.Parts))
+
+	s.objects[key] = &object{
+		data:         data,
+		contentType:  u.contentType,
+		storageClass: u.storageClass,
+		etag:         etag,
+		modified:     time.Now(),
+		meta:         u.meta,
+	}
+	delete(s.uploads, uploadID)
+
+	writeXML(w, http.StatusOK, completeResult{Bucket: s.Bucket, Key: key, ETag: etag})
+}
+
+func (s *Server) headObject(w http.ResponseWriter, key string) {
+	o, ok := s.objects[key]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	s.writeHeaders(w, o)
+	w.Header().Set("Content-Length", strconv.Itoa(len(o.data)))
+}
+
+func (s *Server) getObject(w http.ResponseWriter, r *http.Request, key string) {
+	o, ok := s.objects[key]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+		return
+	}
+
+	if o.storageClass == "DEEP_ARCHIVE" && !strings.Contains(s.restoreHeader(o), "ongoing-request=\"false\"") {
+		writeError(w, http.StatusForbidden, "InvalidObjectState", "The operation is not valid for the object's storage class")
+		return
+	}
+
+	start, end := 0, len(o.data)-1
+	status := http.StatusOK
+	if rng := r.Header.Get("Range"); rng != "" {
+		var err error
+		start, end, err = parseRange(rng, len(o.data))
+		if err != nil {
+			writeError(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange", err.Error())
+			return
+		}
+		status = http.StatusPartialContent
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(o.data)))
+	}
+
+	s.writeHeaders(w, o)
+	w.Header().Set("Content-Length", strconv.Itoa(end-start+1))
+	w.WriteHeader(status)
+
+	// Stored data is never modified in place, so it can be sent without blocking other requests on a slow reader
+	s.mu.Unlock()
+	w.Write(o.data[start : end+1])
+	s.mu.Lock()
+}
+
+func (s *Server) restoreObject(w http.ResponseWriter, r *http.Request, key string) {
+	o, ok := s.objects[key]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+		return
+	}
+
+	if o.storageClass != "DEEP_ARCHIVE" && o.storageClass != "GLACIER" {
+		writeError(w, http.StatusForbidden, "ObjectAlreadyInActiveTierError", "Restore is not allowed for the object's current storage class")
+		return
+	}
+
+	var req restoreRequest
+	err := xml.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.Days < 1 {
+		writeError(w, http.StatusBadRequest, "MalformedXML", "Invalid restore request")
+		return
+	}
+
+	switch s.restoreHeader(o) {
+	case "":
+		o.restored = time.Now()
+		o.days = req.Days
+		o.notified = false
+		w.WriteHeader(http.StatusAccepted)
+	case "ongoing-request=\"true\"":
+		writeError(w, http.StatusConflict, "RestoreAlreadyInProgress", "Object restore is already in progress")
+	default:
+		// S3 only updates the expiry date of already restored objects
+		o.days = req.Days
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func (s *Server) listObjects(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	res := listResult{
+		Name:              s.Bucket,
+		Prefix:            q.Get("prefix"),
+		MaxKeys:           s.MaxKeys,
+		ContinuationToken: q.Get("continuation-token"),
+	}
+
+	if m, err := strconv.Atoi(q.Get("max-keys")); err == nil && m < res.MaxKeys {
+		res.MaxKeys = m
+	}
+
+	for _, k := range s.keys() {
+		if !strings.HasPrefix(k, res.Prefix) || k <= res.ContinuationToken {
+			continue
+		}
+		if len(res.Contents) == res.MaxKeys {
+			res.IsTruncated = true
+			res.NextContinuationToken = res.Contents[len(res.Contents)-1].Key
+			break
+		}
+
+		o := s.objects[k]
+		res.Contents = append(res.Contents, listEntry{
+			Key:          k,
+			LastModified: o.modified.UTC().Format(time.RFC3339),
+			ETag:         o.etag,
+			Size:         len(o.data),
+			StorageClass: o.storageClass,
+		})
+	}
+	res.KeyCount = len(res.Contents)
+
+	writeXML(w, http.StatusOK, res)
+}
+
+func (s *Server) writeHeaders(w http.ResponseWriter, o *object) {
+	w.Header().Set("Content-Type", o.contentType)
+	w.Header().Set("ETag", o.etag)
+	w.Header().Set("Last-Modified", o.modified.UTC().Format(http.TimeFormat))
+	w.Header().Set("Accept-Ranges", "bytes")
+	if o.storageClass != "STANDARD" {
+		w.Header().Set("X-Amz-Storage-Class", o.storageClass)
+	}
+	if h := s.restoreHeader(o); h != "" {
+		w.Header().Set("X-Amz-Restore", h)
+	}
+	for k, v := range o.meta {
+		w.Header().Set(metaPrefix+k, v)
+	}
+}
+
+// restoreHeader emulates the x-amz-restore header for the current point in time.
+func (s *Server) restoreHeader(o *object) string {
+	if o.restored.IsZero() {
+		return ""
+	}
+
+	ready := o.restored.Add(s.RestoreDelay)
+	if time.Now().Before(ready) {
+		return "ongoing-request=\"true\""
+	}
+
+	expiry := ready.UTC().Truncate(24*time.Hour).AddDate(0, 0, o.days+1)
+	if time.Now().After(expiry) {
+		return ""
+	}
+
+	return "ongoing-request=\"false\", expiry-date=\"" + expiry.Format(http.TimeFormat) + "\""
+}
+
+// newObject creates an object from PutObject or CreateMultipartUpload request headers.
+func newObject(r *http.Request, data []byte) *object {
+	o := &object{
+		data:         data,
+		contentType:  r.Header.Get("Content-Type"),
+		storageClass: r.Header.Get("X-Amz-Storage-Class"),
+		modified:     time.Now(),
+		meta:         map[string]string{},
+	}
+
+	if o.contentType == "" {
+		o.contentType = "binary/octet-stream"
+	}
+	if o.storageClass == "" {
+		o.storageClass = "STANDARD"
+	}
+
+	sum := md5.Sum(data)
+	o.etag = "\"" + hex.EncodeToString(sum[:]) + "\""
+
+	for k, v := range r.Header {
+		if strings.HasPrefix(k, metaPrefix) {
+			o.meta[strings.TrimPrefix(k, metaPrefix)] = v[0]
+		}
+	}
+
+	return o
+}
+
+// parseRange parses a single-range Range header of the form bytes=start-[end].
+func parseRange(rng string, size int) (start, end int, err error) {
+	spec := strings.SplitN(strings.TrimPrefix(rng, "bytes="), "-", 2)
+	if len(spec) != 2 {
+		err = fmt.Errorf("Invalid range %s", rng)
+		return
+	}
+
+	start, err = strconv.Atoi(spec[0])
+	if err != nil {
+		return
+	}
+
+	end = size - 1
+	if spec[1] != "" {
+		end, err = strconv.Atoi(spec[1])
+		if err != nil {
+			return
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+
+	if start > end || start >= size {
+		err = fmt.Errorf("Unsatisfiable range %s", rng)
+	}
+
+	return
+}
+
+func writeXML(w http.ResponseWriter, status int, v interface{}) {
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	xml.NewEncoder(&buf).Encode(v)
+
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+}
+
+func writeError(w http.ResponseWriter, status int, code, msg string) {
+	writeXML(w, status, errorResponse{Code: code, Message: msg})
+}
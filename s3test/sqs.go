@@ -0,0 +1,170 @@
+package s3test
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// queuePath is the path of the only notification queue, in the account/name form used by SQS.
+	queuePath = "/000000000000/ogive-restores"
+
+	// visibilityTimeout is the time for which received messages are not delivered again.
+	visibilityTimeout = 30 * time.Second
+)
+
+// QueueURL returns the URL of an SQS stand-in queue served alongside the bucket.
+// Once a restore completes, an s3:ObjectRestore:Completed event is queued for it, same as with
+// S3 event notifications configured to deliver to an SQS queue. The queue understands ReceiveMessage
+// (with long polling), DeleteMessage and ChangeMessageVisibility.
+func (s *Server) QueueURL() string {
+	return s.URL + queuePath
+}
+
+// Messages returns the number of messages in the queue, including those received but not deleted.
+func (s *Server) Messages() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.queueRestores()
+	return len(s.messages)
+}
+
+func (s *Server) handleQueue(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		writeQueueError(w, http.StatusBadRequest, "MalformedQueryString", err.Error())
+		return
+	}
+
+	if u, err := url.Parse(r.Form.Get("QueueUrl")); err != nil || u.Path != queuePath {
+		writeQueueError(w, http.StatusBadRequest, "AWS.SimpleQueueService.NonExistentQueue", "The specified queue does not exist.")
+		return
+	}
+
+	switch r.Form.Get("Action") {
+	case "ReceiveMessage":
+		s.receiveMessage(w, r)
+	case "DeleteMessage":
+		s.deleteMessage(w, r)
+	case "ChangeMessageVisibility":
+		s.changeVisibility(w, r)
+	default:
+		writeQueueError(w, http.StatusBadRequest, "InvalidAction", "Unsupported queue action")
+	}
+}
+
+// receiveMessage waits up to WaitTimeSeconds for a message without holding the lock, so that restores can still be requested meanwhile.
+func (s *Server) receiveMessage(w http.ResponseWriter, r *http.Request) {
+	max, err := strconv.Atoi(r.Form.Get("MaxNumberOfMessages"))
+	if err != nil {
+		max = 1
+	}
+	wait, _ := strconv.Atoi(r.Form.Get("WaitTimeSeconds"))
+	deadline := time.Now().Add(time.Duration(wait) * time.Second)
+
+	var res receiveResponse
+	for {
+		s.mu.Lock()
+		s.queueRestores()
+
+		now := time.Now()
+		for _, m := range s.messages {
+			if len(res.Messages) == max {
+				break
+			}
+			if now.Before(m.hidden) {
+				continue
+			}
+
+			s.seq++
+			m.receipt = fmt.Sprintf("receipt-%d", s.seq)
+			m.hidden = now.Add(visibilityTimeout)
+
+			sum := md5.Sum([]byte(m.body))
+			res.Messages = append(res.Messages, queueMessage{m.id, m.receipt, hex.EncodeToString(sum[:]), m.body})
+		}
+		s.mu.Unlock()
+
+		if len(res.Messages) > 0 || !time.Now().Before(deadline) {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	writeXML(w, http.StatusOK, res)
+}
+
+func (s *Server) deleteMessage(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	receipt := r.Form.Get("ReceiptHandle")
+	for i, m := range s.messages {
+		if m.receipt == receipt {
+			s.messages = append(s.messages[:i], s.messages[i+1:]...)
+			writeXML(w, http.StatusOK, deleteResponse{})
+			return
+		}
+	}
+
+	writeQueueError(w, http.StatusBadRequest, "ReceiptHandleIsInvalid", "The receipt handle is not valid.")
+}
+
+func (s *Server) changeVisibility(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	timeout, err := strconv.Atoi(r.Form.Get("VisibilityTimeout"))
+	if err != nil || timeout < 0 {
+		writeQueueError(w, http.StatusBadRequest, "InvalidParameterValue", "Invalid VisibilityTimeout.")
+		return
+	}
+
+	receipt := r.Form.Get("ReceiptHandle")
+	for _, m := range s.messages {
+		if m.receipt == receipt {
+			m.hidden = time.Now().Add(time.Duration(timeout) * time.Second)
+			writeXML(w, http.StatusOK, changeVisibilityResponse{})
+			return
+		}
+	}
+
+	writeQueueError(w, http.StatusBadRequest, "ReceiptHandleIsInvalid", "The receipt handle is not valid.")
+}
+
+// queueRestores queues an event for every restore completed since the last call.
+func (s *Server) queueRestores() {
+	for _, k := range s.keys() {
+		o := s.objects[k]
+		if o.notified || !strings.Contains(s.restoreHeader(o), "ongoing-request=\"false\"") {
+			continue
+		}
+		o.notified = true
+
+		rec := eventRecord{
+			EventVersion: "2.1",
+			EventSource:  "aws:s3",
+			EventTime:    time.Now().UTC().Format(time.RFC3339),
+			EventName:    "ObjectRestore:Completed",
+		}
+		rec.S3.Bucket.Name = s.Bucket
+		rec.S3.Object.Key = url.QueryEscape(k)
+		rec.S3.Object.Size = len(o.data)
+
+		body, _ := json.Marshal(event{[]eventRecord{rec}})
+		s.seq++
+		s.messages = append(s.messages, &message{id: fmt.Sprintf("message-%d", s.seq), body: string(body)})
+	}
+}
+
+func writeQueueError(w http.ResponseWriter, status int, code, msg string) {
+	writeXML(w, status, queueErrorResponse{Type: "Sender", Code: code, Message: msg})
+}
@@ -0,0 +1,201 @@
+package s3test
+
+import (
+	"encoding/xml"
+	"net/http/httptest"
+	"sync"
+	"time"
+)
+
+// Server is an in-process S3 stand-in serving a single bucket over HTTP with path-style addressing.
+// It understands the subset of the S3 API used by ogive and simulates Deep Archive restores.
+// Request signatures are not verified.
+type Server struct {
+	*httptest.Server
+
+	// Bucket is the name of the only bucket served.
+	Bucket string
+
+	// RestoreDelay is the simulated time it takes for a restore request to complete.
+	RestoreDelay time.Duration
+
+	// MaxKeys is the maximum number of keys returned in a single ListObjectsV2 page.
+	MaxKeys int
+
+	// mu guards objects, uploads and messages.
+	mu sync.Mutex
+
+	// objects holds all stored objects by key.
+	objects map[string]*object
+
+	// uploads holds all pending multipart uploads by UploadId.
+	uploads map[string]*upload
+
+	// seq is used to generate unique UploadIds.
+	seq int
+
+	// slowDown is the number of upcoming object requests to reject with SlowDown.
+	slowDown int
+
+	// corrupt is the number of upcoming uploads whose content gets damaged on arrival.
+	corrupt int
+
+	// messages holds the restore notification queue, oldest first.
+	messages []*message
+}
+
+// object is a single stored object
+type object struct {
+	data         []byte
+	contentType  string
+	storageClass string
+	etag         string
+	modified     time.Time
+	meta         map[string]string
+
+	// restored is the time at which the last restore was requested, zero if never.
+	restored time.Time
+
+	// days is the number of days the restored copy remains available.
+	days int
+
+	// notified is set once the completion of the last restore has been queued.
+	notified bool
+}
+
+// message is a single message in the notification queue
+type message struct {
+	id   string
+	body string
+
+	// receipt is the handle of the last receipt, needed to delete the message.
+	receipt string
+
+	// hidden is the time until which the message is not delivered again after being received.
+	hidden time.Time
+}
+
+// upload is a pending multipart upload
+type upload struct {
+	key          string
+	contentType  string
+	storageClass string
+	meta         map[string]string
+	parts        map[int][]byte
+}
+
+type errorResponse struct {
+	XMLName xml.Name `xml:"Error"`
+	Code    string
+	Message string
+}
+
+type initiateResult struct {
+	XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+	Bucket   string
+	Key      string
+	UploadId string
+}
+
+type completeRequest struct {
+	Parts []struct {
+		PartNumber int
+		ETag       string
+	} `xml:"Part"`
+}
+
+type completeResult struct {
+	XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+	Bucket  string
+	Key     string
+	ETag    string
+}
+
+type copyResult struct {
+	XMLName      xml.Name `xml:"CopyObjectResult"`
+	ETag         string
+	LastModified string
+}
+
+type copyPartResult struct {
+	XMLName      xml.Name `xml:"CopyPartResult"`
+	ETag         string
+	LastModified string
+}
+
+type restoreRequest struct {
+	Days                 int
+	GlacierJobParameters struct {
+		Tier string
+	}
+}
+
+type listResult struct {
+	XMLName               xml.Name `xml:"ListBucketResult"`
+	Name                  string
+	Prefix                string
+	KeyCount              int
+	MaxKeys               int
+	IsTruncated           bool
+	ContinuationToken     string `xml:",omitempty"`
+	NextContinuationToken string `xml:",omitempty"`
+	Contents              []listEntry
+}
+
+type listEntry struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int
+	StorageClass string
+}
+
+type receiveResponse struct {
+	XMLName  xml.Name       `xml:"ReceiveMessageResponse"`
+	Messages []queueMessage `xml:"ReceiveMessageResult>Message"`
+}
+
+type queueMessage struct {
+	MessageId     string
+	ReceiptHandle string
+	MD5OfBody     string
+	Body          string
+}
+
+type deleteResponse struct {
+	XMLName xml.Name `xml:"DeleteMessageResponse"`
+}
+
+type changeVisibilityResponse struct {
+	XMLName xml.Name `xml:"ChangeMessageVisibilityResponse"`
+}
+
+type queueErrorResponse struct {
+	XMLName xml.Name `xml:"ErrorResponse"`
+	Type    string   `xml:"Error>Type"`
+	Code    string   `xml:"Error>Code"`
+	Message string   `xml:"Error>Message"`
+}
+
+// event is an S3 event notification message
+type event struct {
+	Records []eventRecord
+}
+
+type eventRecord struct {
+	EventVersion string    `json:"eventVersion"`
+	EventSource  string    `json:"eventSource"`
+	EventTime    string    `json:"eventTime"`
+	EventName    string    `json:"eventName"`
+	S3           eventData `json:"s3"`
+}
+
+type eventData struct {
+	Bucket struct {
+		Name string `json:"name"`
+	} `json:"bucket"`
+	Object struct {
+		Key  string `json:"key"`
+		Size int    `json:"size"`
+	} `json:"object"`
+}
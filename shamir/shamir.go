@@ -0,0 +1,201 @@
+package shamir
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"errors"
+	"github.com/awnumar/memguard"
+	"strconv"
+	"strings"
+)
+
+// version is the version of the printable share encoding.
+const version = byte(1)
+
+// prefix starts every printable share.
+const prefix = "OGS"
+
+// groupSize is the number of characters between the dashes of printable shares.
+const groupSize = 5
+
+// checksumSize is the size of the checksum appended to printable shares, so that typos are caught.
+const checksumSize = 4
+
+// encoding is used for printable shares, since it is case insensitive and avoids ambiguous characters.
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// exp and log are the exponentiation and logarithm tables of GF(2^8) with the AES polynomial, generator 3.
+var exp, log [256]byte
+
+func init() {
+	x := byte(1)
+	for i := 0; i < 255; i++ {
+		exp[i], log[x] = x, byte(i)
+		// Multiply by 3, reducing by x^8 + x^4 + x^3 + x + 1
+		hi := x & 0x80
+		x ^= x << 1
+		if hi != 0 {
+			x ^= 0x1b
+		}
+	}
+	exp[255] = exp[0]
+}
+
+// Split splits the secret into the given number of shares, any threshold of which combine to the secret again.
+// Fewer shares reveal nothing about the secret. The key ID is stored in every share as is.
+func Split(secret []byte, keyID [8]byte, shares, threshold int) ([]Share, error) {
+	if threshold < 2 || threshold > shares || shares > 255 {
+		return nil, errors.New("Invalid number of shares, the threshold must be at least 2 and at most the number of shares, which is at most 255.")
+	}
+	if len(secret) == 0 {
+		return nil, errors.New("Empty secret.")
+	}
+
+	// Every secret byte is the constant term of its own random polynomial of degree threshold-1
+	coeffs := make([]byte, len(secret)*(threshold-1))
+	defer memguard.WipeBytes(coeffs)
+	_, err := rand.Read(coeffs)
+	if err != nil {
+		return nil, err
+	}
+
+	// The ID must not be derived from the secret, since shares are kept by different people
+	var id [4]byte
+	_, err = rand.Read(id[:])
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]Share, shares)
+	for i := range out {
+		s := Share{ID: id, KeyID: keyID, Threshold: byte(threshold), X: byte(i + 1), Y: make([]byte, len(secret))}
+
+		for j := range secret {
+			// Horner's method, from the highest coefficient down to the secret byte
+			y := byte(0)
+			for k := threshold - 2; k >= 0; k-- {
+				y = mul(y, s.X) ^ coeffs[j*(threshold-1)+k]
+			}
+			s.Y[j] = mul(y, s.X) ^ secret[j]
+		}
+		out[i] = s
+	}
+
+	return out, nil
+}
+
+// Combine recovers the secret from at least threshold shares of the same split.
+// Damaged shares combine to a different secret, which has to be verified against the key ID by the caller.
+func Combine(shares []Share) ([]byte, error) {
+	if len(shares) == 0 {
+		return nil, errors.New("No shares.")
+	}
+
+	first := shares[0]
+	if len(shares) < int(first.Threshold) {
+		return nil, errors.New("Not enough shares, " + strconv.Itoa(int(first.Threshold)) + " are required.")
+	}
+	shares = shares[:first.Threshold]
+
+	for i, s := range shares {
+		if s.ID != first.ID || s.KeyID != first.KeyID || s.Threshold != first.Threshold || len(s.Y) != len(first.Y) {
+			return nil, errors.New("Shares belong to different secrets.")
+		}
+		for _, o := range shares[:i] {
+			if o.X == s.X {
+				return nil, errors.New("Share " + strconv.Itoa(int(s.X)) + " was given twice.")
+			}
+		}
+	}
+
+	// Lagrange interpolation at 0, where subtraction is addition in GF(2^8)
+	secret := make([]byte, len(first.Y))
+	for i, s := range shares {
+		basis := byte(1)
+		for j, o := range shares {
+			if i != j {
+				basis = mul(basis, div(o.X, o.X^s.X))
+			}
+		}
+
+		for k := range secret {
+			secret[k] ^= mul(basis, s.Y[k])
+		}
+	}
+
+	return secret, nil
+}
+
+// ParseShare parses the printable form of a share, as returned by Share.String.
+// Case, whitespace and the placement of dashes don't matter.
+func ParseShare(s string) (Share, error) {
+	var share Share
+	clean := strings.ToUpper(strings.Join(strings.Fields(s), ""))
+	if !strings.HasPrefix(clean, prefix) {
+		return share, errors.New("Invalid share, it must start with " + prefix + ".")
+	}
+
+	data, err := encoding.DecodeString(strings.Replace(clean[len(prefix):], "-", "", -1))
+	if err != nil {
+		return share, errors.New("Invalid share, it contains invalid characters.")
+	}
+	defer memguard.WipeBytes(data)
+
+	if len(data) < 16+checksumSize || data[0] != version {
+		return share, errors.New("Invalid share, unsupported format.")
+	}
+
+	body, check := data[:len(data)-checksumSize], data[len(data)-checksumSize:]
+	sum := sha256.Sum256(body)
+	if !bytes.Equal(sum[:checksumSize], check) {
+		return share, errors.New("Share checksum mismatch, it is mistyped.")
+	}
+
+	copy(share.ID[:], body[1:5])
+	copy(share.KeyID[:], body[5:13])
+	share.Threshold, share.X = body[13], body[14]
+	share.Y = append([]byte(nil), body[15:]...)
+	if share.Threshold < 2 || share.X == 0 {
+		return share, errors.New("Invalid share, unsupported format.")
+	}
+
+	return share, nil
+}
+
+// String returns the printable form of the share: the share encoded in base32 followed by a checksum,
+// in dash-separated groups of characters.
+func (s Share) String() string {
+	data := append([]byte{version}, s.ID[:]...)
+	data = append(data, s.KeyID[:]...)
+	data = append(data, s.Threshold, s.X)
+	data = append(data, s.Y...)
+	sum := sha256.Sum256(data)
+	text := encoding.EncodeToString(append(data, sum[:checksumSize]...))
+	memguard.WipeBytes(data)
+
+	groups := []string{prefix}
+	for len(text) > groupSize {
+		groups = append(groups, text[:groupSize])
+		text = text[groupSize:]
+	}
+
+	return strings.Join(append(groups, text), "-")
+}
+
+// mul multiplies in GF(2^8).
+func mul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return exp[(int(log[a])+int(log[b]))%255]
+}
+
+// div divides in GF(2^8), b must not be 0.
+func div(a, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	return exp[(int(log[a])+255-int(log[b]))%255]
+}
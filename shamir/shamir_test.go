@@ -0,0 +1,119 @@
+package shamir
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// keyID is the key ID stored in test shares.
+var keyID = [8]byte{1, 2, 3, 4, 5, 6, 7, 8}
+
+func TestSplitCombine(t *testing.T) {
+	secret := []byte("correct horse battery staple")
+	shares, err := Split(secret, keyID, 5, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, pick := range [][]int{{0, 1, 2}, {4, 2, 0}, {1, 3, 4, 0}} {
+		var in []Share
+		for _, i := range pick {
+			in = append(in, shares[i])
+		}
+
+		got, err := Combine(in)
+		if err != nil || !bytes.Equal(got, secret) {
+			t.Errorf("Combine(%v) = %q, %v", pick, got, err)
+		}
+	}
+
+	_, err = Combine(shares[:2])
+	if err == nil {
+		t.Error("Combine() with too few shares succeeded")
+	}
+
+	_, err = Combine([]Share{shares[0], shares[1], shares[0]})
+	if err == nil {
+		t.Error("Combine() with a duplicate share succeeded")
+	}
+
+	// Every split gets its own ID, which has nothing to do with the secret
+	other, err := Split(secret, keyID, 5, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other[0].ID == shares[0].ID || other[0].KeyID != keyID {
+		t.Errorf("Split() IDs %x and %x, key ID %x", shares[0].ID, other[0].ID, other[0].KeyID)
+	}
+	_, err = Combine([]Share{shares[0], shares[1], other[2]})
+	if err == nil {
+		t.Error("Combine() of shares of different splits succeeded")
+	}
+
+	shares[1].Y[0] ^= 1
+	got, err := Combine(shares[:3])
+	if err != nil || bytes.Equal(got, secret) {
+		t.Errorf("Combine() with a damaged share = %q, %v", got, err)
+	}
+}
+
+func TestSplitInvalid(t *testing.T) {
+	for _, c := range []struct{ shares, threshold int }{{3, 1}, {2, 3}, {256, 2}} {
+		_, err := Split([]byte("secret"), keyID, c.shares, c.threshold)
+		if err == nil {
+			t.Errorf("Split(%d, %d) succeeded", c.shares, c.threshold)
+		}
+	}
+
+	_, err := Split(nil, keyID, 3, 2)
+	if err == nil {
+		t.Error("Split() of an empty secret succeeded")
+	}
+}
+
+func TestParseShare(t *testing.T) {
+	shares, err := Split([]byte("secret"), keyID, 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := shares[2].String()
+	if !strings.HasPrefix(s, prefix+"-") {
+		t.Errorf("String() = %q", s)
+	}
+
+	// Case, whitespace and dashes don't matter
+	for _, text := range []string{s, strings.ToLower(s), " " + strings.Replace(s, "-", " ", -1) + "\n"} {
+		got, err := ParseShare(text)
+		if err != nil {
+			t.Errorf("ParseShare(%q) failed: %v", text, err)
+			continue
+		}
+		if got.ID != shares[2].ID || got.KeyID != keyID || got.Threshold != 2 || got.X != 3 || !bytes.Equal(got.Y, shares[2].Y) {
+			t.Errorf("ParseShare(%q) = %+v, want %+v", text, got, shares[2])
+		}
+	}
+
+	// A typo in any character is caught, except in padding bits of the last one, which leave the share unchanged
+	for i := len(prefix) + 1; i < len(s); i++ {
+		if s[i] == '-' {
+			continue
+		}
+		c := byte('A')
+		if s[i] == 'A' {
+			c = 'B'
+		}
+		got, err := ParseShare(s[:i] + string(c) + s[i+1:])
+		if err == nil && (got.X != shares[2].X || !bytes.Equal(got.Y, shares[2].Y)) {
+			t.Errorf("ParseShare() with a typo at %d succeeded", i)
+		}
+	}
+
+	for _, text := range []string{"", "XYZ-AAAAA", prefix + "-1111", prefix + "-AAAAA"} {
+		_, err := ParseShare(text)
+		if err == nil {
+			t.Errorf("ParseShare(%q) succeeded", text)
+		}
+	}
+}
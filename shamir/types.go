@@ -0,0 +1,19 @@
+package shamir
+
+// Share is a single share of a split secret.
+type Share struct {
+	// ID is random for every split, so that shares of different splits can't be mixed up
+	ID [4]byte
+
+	// KeyID identifies the key the secret belongs to, so that the combined secret can be verified against it
+	KeyID [8]byte
+
+	// Threshold is the number of shares needed to combine the secret
+	Threshold byte
+
+	// X is the point the share polynomials are evaluated at, never 0
+	X byte
+
+	// Y holds the values of the share polynomials at X, one per secret byte
+	Y []byte
+}
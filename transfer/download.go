@@ -0,0 +1,195 @@
+package transfer
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/awnumar/memguard"
+	"github.com/mgren/ogive/backend"
+	"github.com/mgren/ogive/checksum"
+	"github.com/mgren/ogive/crypt"
+	"github.com/mgren/ogive/progress"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// downloadPartSize is the approximate length of a single ranged download request.
+const downloadPartSize = int64(50 << 20)
+
+// NewDownload prepares the journal of a new download of the object into the output file, stored under the specified state directory.
+// Range size is aligned to sio package boundaries, so that every range can be decrypted on its own.
+func NewDownload(dir, key, output string, size int64) *DownloadState {
+	return &DownloadState{
+		Key:      key,
+		Output:   output,
+		Size:     size,
+		PartSize: (downloadPartSize + crypt.PackageSize - 1) / crypt.PackageSize * crypt.PackageSize,
+		Parts:    map[int]bool{},
+		fname:    stateFile(dir, "downloads", key),
+	}
+}
+
+// LoadDownload reads the journal of an interrupted download of the object.
+func LoadDownload(dir, key string) (st *DownloadState, err error) {
+	fname := stateFile(dir, "downloads", key)
+
+	var data []byte
+	data, err = ioutil.ReadFile(fname)
+	if err != nil {
+		return
+	}
+
+	err = json.Unmarshal(data, &st)
+	if err != nil {
+		return
+	}
+
+	st.fname = fname
+	return
+}
+
+// Save writes the journal to disk, replacing the previous one atomically.
+func (st *DownloadState) Save() error {
+	return saveState(st.fname, st)
+}
+
+// Remove deletes the journal from disk.
+func (st *DownloadState) Remove() error {
+	return os.Remove(st.fname)
+}
+
+// Download fetches, decrypts and writes all ranges of the object missing from the journal into dst.
+// The journal is saved after every completed range, so that a failed download can be continued by calling Download again.
+// The counter is increased by the encrypted size of every completed range, including those completed in previous runs.
+func Download(b backend.Backend, st *DownloadState, key *memguard.LockedBuffer, dst io.WriterAt, counter *progress.Counter) (err error) {
+	count := int((st.Size + st.PartSize - 1) / st.PartSize)
+	pending := make(chan int, count)
+
+	for n := 1; n <= count; n++ {
+		if st.Parts[n] {
+			counter.Add(int(partLength(st.Size, st.PartSize, n)))
+		} else {
+			pending <- n
+		}
+	}
+	close(pending)
+
+	errs := make(chan error, concurrency)
+	for i := 0; i < concurrency; i++ {
+		go func() {
+			for n := range pending {
+				err := st.downloadPart(b, key, dst, n)
+				if err != nil {
+					errs <- err
+					return
+				}
+				counter.Add(int(partLength(st.Size, st.PartSize, n)))
+			}
+			errs <- nil
+		}()
+	}
+
+	for i := 0; i < concurrency; i++ {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+		}
+	}
+
+	return
+}
+
+// downloadPart fetches a single range, decrypts it into dst and records its completion.
+func (st *DownloadState) downloadPart(b backend.Backend, key *memguard.LockedBuffer, dst io.WriterAt, n int) error {
+	offset := int64(n-1) * st.PartSize
+
+	body, err := b.Get(st.Key, offset, partLength(st.Size, st.PartSize, n))
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	w, err := crypt.NewCryptWriterAt(key, dst, uint32(offset/crypt.PackageSize))
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(w, body)
+	if err != nil {
+		return err
+	}
+
+	// Closing authenticates the trailing package of the last range
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.Parts[n] = true
+	return st.Save()
+}
+
+// ReadTrailer fetches and decrypts only the final packages of the size bytes long object, returning the digest
+// appended to its content as a trailer. The trailer may straddle a package boundary, so up to two packages are read.
+// The expected length of the content without the trailer is checked unless negative, since it is unknown for streams.
+func ReadTrailer(b backend.Backend, key string, size, expected int64, fileKey *memguard.LockedBuffer) ([]byte, error) {
+	plain, err := crypt.DecryptedSize(size)
+	if err != nil {
+		return nil, err
+	}
+	if plain < checksum.Size || expected >= 0 && plain != expected+checksum.Size {
+		return nil, errors.New("Object size does not match the size of its content.")
+	}
+
+	seq := uint32((plain - checksum.Size) / crypt.PayloadSize)
+	offset := int64(seq) * crypt.PackageSize
+	body, err := b.Get(key, offset, -1)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	data, err := ioutil.ReadAll(io.LimitReader(body, size-offset+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) != size-offset {
+		return nil, errors.New("Object size changed while reading it.")
+	}
+
+	base := int64(seq) * crypt.PayloadSize
+	buf := &bufferAt{buf: make([]byte, plain-base), base: base}
+	w, err := crypt.NewCryptWriterAt(fileKey, buf, seq)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = w.Write(data)
+	if err != nil {
+		return nil, err
+	}
+
+	// Closing authenticates the last package read, but does not tell whether it ends the stream
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	// A stream cut at a package boundary would end with an intact package not marked as the last one
+	if !crypt.IsFinal(data[(len(data)-1)/crypt.PackageSize*crypt.PackageSize:]) {
+		return nil, errors.New("Object content is truncated.")
+	}
+
+	return buf.buf[len(buf.buf)-checksum.Size:], nil
+}
+
+// WriteAt copies p into the buffer, failing for writes outside of it.
+func (b *bufferAt) WriteAt(p []byte, off int64) (int, error) {
+	off -= b.base
+	if off < 0 || off+int64(len(p)) > int64(len(b.buf)) {
+		return 0, errors.New("Decrypted content exceeds the object size.")
+	}
+	return copy(b.buf[off:], p), nil
+}
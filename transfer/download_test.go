@@ -0,0 +1,205 @@
+package transfer
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"github.com/awnumar/memguard"
+	"github.com/mgren/ogive/backend"
+	"github.com/mgren/ogive/checksum"
+	"github.com/mgren/ogive/crypt"
+	"github.com/mgren/ogive/progress"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakyGetBackend fails the download of the range at the selected offset once.
+type flakyGetBackend struct {
+	*backend.Local
+	fail int64
+	mu   sync.Mutex
+}
+
+func (f *flakyGetBackend) Get(key string, offset, length int64) (io.ReadCloser, error) {
+	f.mu.Lock()
+	fail := offset == f.fail
+	if fail {
+		f.fail = -1
+	}
+	f.mu.Unlock()
+
+	if fail {
+		return nil, errors.New("Connection reset.")
+	}
+	return f.Local.Get(key, offset, length)
+}
+
+func TestDownloadResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ogive-transfer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	local, err := backend.NewLocal(filepath.Join(dir, "bucket"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := make([]byte, 1<<20+10)
+	_, err = rand.Read(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := memguard.NewImmutableRandom(32)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	up, err := NewUpload(filepath.Join(dir, "state"), "source", int64(len(data)), time.Now(), "object", "", "", make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Upload(local, up, key, bytes.NewReader(data), nil, &progress.Counter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = local.Restore("object", 1, "Bulk")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := local.Head("object")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	output := filepath.Join(dir, "output")
+	dst, err := os.Create(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+
+	st := NewDownload(filepath.Join(dir, "state"), "object", output, res.Size)
+	st.PartSize = 2 * crypt.PackageSize
+	b := &flakyGetBackend{Local: local, fail: 3 * st.PartSize}
+
+	err = Download(b, st, key, dst, &progress.Counter{})
+	if err == nil {
+		t.Fatal("Download() succeeded despite a failed range")
+	}
+
+	st, err = LoadDownload(filepath.Join(dir, "state"), "object")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(st.Parts) == 0 || st.Parts[4] {
+		t.Fatalf("journal recorded ranges %v", st.Parts)
+	}
+
+	var counter progress.Counter
+	err = Download(b, st, key, dst, &counter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counter.GetProgress() != int(res.Size) {
+		t.Errorf("counted %d bytes, want %d", counter.GetProgress(), res.Size)
+	}
+
+	plain, err := ioutil.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(plain, data) {
+		t.Error("downloaded content does not match the source")
+	}
+}
+
+func TestReadTrailer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ogive-transfer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	local, err := backend.NewLocal(filepath.Join(dir, "bucket"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := memguard.NewImmutableRandom(32)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The trailer straddles a package boundary in the second stream
+	for _, length := range []int{100, crypt.PayloadSize - 10} {
+		data := make([]byte, length)
+		_, err = rand.Read(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sum := checksum.NewReader(bytes.NewReader(data))
+		r, err := crypt.NewCryptReader(key, sum)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = local.Put("stream", r, -1, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res, err := local.Head("stream")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = ReadTrailer(local, "stream", res.Size, -1, key)
+		if err != backend.ErrNotRestored {
+			t.Errorf("ReadTrailer() of an archived object = %v, want %v", err, backend.ErrNotRestored)
+		}
+
+		err = local.Restore("stream", 1, "Bulk")
+		if err != nil {
+			t.Fatal(err)
+		}
+		trailer, err := ReadTrailer(local, "stream", res.Size, -1, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(trailer, sum.Sum()) {
+			t.Errorf("ReadTrailer() = %x, want %x", trailer, sum.Sum())
+		}
+
+		_, err = ReadTrailer(local, "stream", res.Size, int64(length+1), key)
+		if err == nil {
+			t.Error("ReadTrailer() accepted a different expected size")
+		}
+	}
+
+	// A stream cut at a package boundary still ends with an intact package
+	r, err := crypt.NewCryptReader(key, checksum.NewReader(bytes.NewReader(make([]byte, 2*crypt.PayloadSize+100))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = local.Put("truncated", io.LimitReader(r, 2*crypt.PackageSize), -1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = local.Restore("truncated", 1, "Bulk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ReadTrailer(local, "truncated", 2*crypt.PackageSize, -1, key)
+	if err == nil {
+		t.Error("ReadTrailer() accepted a truncated stream")
+	}
+}
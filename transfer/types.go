@@ -0,0 +1,86 @@
+package transfer
+
+import (
+	"sync"
+	"time"
+)
+
+// UploadState is the local checkpoint of a resumable multipart upload.
+// It holds everything needed to continue encryption and upload from the last completed part.
+type UploadState struct {
+	// Source is the absolute path of the uploaded file
+	Source string
+
+	// Size is the plaintext size of the source
+	Size int64
+
+	// Trailer is set by versions that appended the checksum of files to their content, such uploads can't be resumed
+	Trailer bool
+
+	// ModTime is the source modification time, used to detect changes between runs
+	ModTime time.Time
+
+	// Key is the storage key of the object
+	Key string
+
+	// UploadID is the multipart upload identifier, empty until the upload is created
+	UploadID string
+
+	// PartSize is the size of every encrypted part except the last one, always a multiple of crypt.PackageSize
+	PartSize int64
+
+	// Nonce is the unique object nonce
+	Nonce []byte
+
+	// KeyID identifies the master key the data key is wrapped with
+	KeyID string
+
+	// DataKey is the data key wrapped with the master key
+	DataKey string
+
+	// StreamNonce is the random value sio derives package nonces from
+	StreamNonce []byte
+
+	// Parts maps numbers of completed parts to their ETags
+	Parts map[int]string
+
+	// fname is the location of the state file.
+	fname string
+
+	// mu guards Parts and state file writes.
+	mu sync.Mutex
+}
+
+// DownloadState is the local journal of a resumable download.
+// It records which package-aligned ranges of the object have already been decrypted into the output file.
+type DownloadState struct {
+	// Key is the storage key of the object
+	Key string
+
+	// Output is the absolute path of the plaintext file
+	Output string
+
+	// Size is the encrypted size of the object
+	Size int64
+
+	// PartSize is the size of every range except the last one, always a multiple of crypt.PackageSize
+	PartSize int64
+
+	// Parts holds numbers of completed ranges
+	Parts map[int]bool
+
+	// fname is the location of the state file.
+	fname string
+
+	// mu guards Parts and state file writes.
+	mu sync.Mutex
+}
+
+// bufferAt is an in-memory io.WriterAt over the part of a stream starting at base.
+type bufferAt struct {
+	// buf holds the content written so far.
+	buf []byte
+
+	// base is the stream offset of the first byte of buf.
+	base int64
+}
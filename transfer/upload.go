@@ -0,0 +1,217 @@
+package transfer
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/awnumar/memguard"
+	"github.com/mgren/ogive/backend"
+	"github.com/mgren/ogive/crypt"
+	"github.com/mgren/ogive/progress"
+	"github.com/mgren/ogive/util"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// concurrency is the number of parts transferred in parallel.
+const concurrency = 4
+
+// NewUpload prepares the checkpoint state of a new upload of the source file, stored under the specified state directory.
+// Part size is chosen based on the encrypted size and aligned to sio package boundaries.
+// The nonce is copied, since it may refer to memory owned by memguard.
+func NewUpload(dir, source string, size int64, modTime time.Time, key, keyID, dataKey string, nonce []byte) (st *UploadState, err error) {
+	var encSize int64
+	encSize, err = crypt.EncryptedSize(size)
+	if err != nil {
+		return
+	}
+
+	partSize := util.GetPartSize(encSize)
+	partSize = (partSize + crypt.PackageSize - 1) / crypt.PackageSize * crypt.PackageSize
+
+	st = &UploadState{
+		Source:      source,
+		Size:        size,
+		ModTime:     modTime,
+		Key:         key,
+		PartSize:    partSize,
+		Nonce:       append([]byte(nil), nonce...),
+		KeyID:       keyID,
+		DataKey:     dataKey,
+		StreamNonce: make([]byte, crypt.StreamNonceSize),
+		Parts:       map[int]string{},
+		fname:       stateFile(dir, "uploads", source),
+	}
+
+	_, err = rand.Read(st.StreamNonce)
+	return
+}
+
+// LoadUpload reads the checkpoint state of an interrupted upload of the source file.
+func LoadUpload(dir, source string) (st *UploadState, err error) {
+	fname := stateFile(dir, "uploads", source)
+
+	var data []byte
+	data, err = ioutil.ReadFile(fname)
+	if err != nil {
+		return
+	}
+
+	err = json.Unmarshal(data, &st)
+	if err != nil {
+		return
+	}
+
+	st.fname = fname
+	return
+}
+
+// Save writes the checkpoint state to disk, replacing the previous one atomically.
+func (st *UploadState) Save() error {
+	return saveState(st.fname, st)
+}
+
+// Remove deletes the checkpoint state from disk.
+func (st *UploadState) Remove() error {
+	return os.Remove(st.fname)
+}
+
+// Upload encrypts and uploads all parts of the source missing from the checkpoint state, then completes the upload.
+// The state is saved after every completed part, so that a failed upload can be continued by calling Upload again.
+//
+// Every part is encrypted independently starting from its first sio package, which allows parts to be processed in parallel.
+// The counter is increased by the encrypted size of every completed part, including those completed in previous runs.
+func Upload(b backend.Multipart, st *UploadState, key *memguard.LockedBuffer, src io.ReaderAt, meta map[string]string, counter *progress.Counter) error {
+	encSize, err := crypt.EncryptedSize(st.Size)
+	if err != nil {
+		return err
+	}
+
+	if st.UploadID == "" {
+		st.UploadID, err = b.CreateUpload(st.Key, meta)
+		if err != nil {
+			return err
+		}
+
+		err = st.Save()
+		if err != nil {
+			return err
+		}
+	}
+
+	count := int((encSize + st.PartSize - 1) / st.PartSize)
+	pending := make(chan int, count)
+
+	for n := 1; n <= count; n++ {
+		if _, ok := st.Parts[n]; ok {
+			counter.Add(int(partLength(encSize, st.PartSize, n)))
+		} else {
+			pending <- n
+		}
+	}
+	close(pending)
+
+	errs := make(chan error, concurrency)
+	for i := 0; i < concurrency; i++ {
+		go func() {
+			for n := range pending {
+				err := st.uploadPart(b, key, src, encSize, n)
+				if err != nil {
+					errs <- err
+					return
+				}
+				counter.Add(int(partLength(encSize, st.PartSize, n)))
+			}
+			errs <- nil
+		}()
+	}
+
+	for i := 0; i < concurrency; i++ {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	parts := make([]backend.Part, 0, count)
+	for n, etag := range st.Parts {
+		parts = append(parts, backend.Part{Number: n, ETag: etag})
+	}
+	sort.Slice(parts, func(i, j int) bool { return parts[i].Number < parts[j].Number })
+
+	if len(parts) != count {
+		return errors.New("Incorrect number of uploaded parts.")
+	}
+
+	return b.CompleteUpload(st.Key, st.UploadID, parts)
+}
+
+// uploadPart encrypts a single part into memory, uploads it and records its ETag.
+func (st *UploadState) uploadPart(b backend.Multipart, key *memguard.LockedBuffer, src io.ReaderAt, encSize int64, n int) error {
+	seq := uint32(int64(n-1) * st.PartSize / crypt.PackageSize)
+
+	r, err := crypt.NewCryptReaderAt(key, src, st.Size, seq, st.StreamNonce)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, partLength(encSize, st.PartSize, n))
+	_, err = io.ReadFull(r, buf)
+	if err != nil {
+		return err
+	}
+
+	etag, err := b.UploadPart(st.Key, st.UploadID, n, bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.Parts[n] = etag
+	return st.Save()
+}
+
+// partLength returns the encrypted length of part n.
+func partLength(encSize, partSize int64, n int) int64 {
+	if rest := encSize - int64(n-1)*partSize; rest < partSize {
+		return rest
+	}
+	return partSize
+}
+
+// saveState writes v as JSON into fname, replacing the previous state atomically.
+func saveState(fname string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(fname), 0700)
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(fname+".tmp", data, 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(fname+".tmp", fname)
+}
+
+// stateFile returns the location of the state of a transfer identified by id, kept under the specified kind of transfers.
+func stateFile(dir, kind, id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return filepath.Join(dir, kind, hex.EncodeToString(sum[:]))
+}
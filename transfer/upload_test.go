@@ -0,0 +1,172 @@
+package transfer
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"github.com/awnumar/memguard"
+	"github.com/mgren/ogive/backend"
+	"github.com/mgren/ogive/crypt"
+	"github.com/mgren/ogive/progress"
+	"github.com/mgren/ogive/s3test"
+	"github.com/minio/sio"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakyBackend fails the upload of the selected part once.
+type flakyBackend struct {
+	*backend.Local
+	fail int
+	mu   sync.Mutex
+}
+
+func (f *flakyBackend) UploadPart(key, uploadID string, number int, body io.ReadSeeker) (string, error) {
+	f.mu.Lock()
+	fail := number == f.fail
+	if fail {
+		f.fail = 0
+	}
+	f.mu.Unlock()
+
+	if fail {
+		return "", errors.New("Connection reset.")
+	}
+	return f.Local.UploadPart(key, uploadID, number, body)
+}
+
+// stored restores and decrypts the object.
+func stored(t *testing.T, b backend.Backend, key *memguard.LockedBuffer) []byte {
+	err := b.Restore("object", 1, "Bulk")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := b.Get("object", 0, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer body.Close()
+
+	var plain bytes.Buffer
+	_, err = sio.Decrypt(&plain, body, sio.Config{Key: key.Buffer()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return plain.Bytes()
+}
+
+func TestUploadResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ogive-transfer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	local, err := backend.NewLocal(filepath.Join(dir, "bucket"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &flakyBackend{Local: local, fail: 7}
+
+	// Not aligned to parts nor packages
+	data := make([]byte, 3<<20-10)
+	_, err = rand.Read(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := memguard.NewImmutableRandom(32)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	st, err := NewUpload(filepath.Join(dir, "state"), "source", int64(len(data)), time.Now(), "object", "", "", make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.PartSize = 4 * crypt.PackageSize
+
+	err = Upload(b, st, key, bytes.NewReader(data), nil, &progress.Counter{})
+	if err == nil {
+		t.Fatal("Upload() succeeded despite a failed part")
+	}
+
+	st, err = LoadUpload(filepath.Join(dir, "state"), "source")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(st.Parts) == 0 {
+		t.Fatal("no parts checkpointed")
+	}
+
+	err = Upload(b, st, key, bytes.NewReader(data), nil, &progress.Counter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(stored(t, local, key), data) {
+		t.Error("stored content does not match the source")
+	}
+}
+
+func TestUploadS3(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ogive-transfer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := s3test.NewServer("bucket")
+	defer s.Close()
+	in, err := s.Profile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := backend.New(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := make([]byte, 1<<20+1)
+	_, err = rand.Read(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := memguard.NewImmutableRandom(32)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	st, err := NewUpload(filepath.Join(dir, "state"), "source", int64(len(data)), time.Now(), "object", "", "", make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.PartSize = 4 * crypt.PackageSize
+
+	// Throttled requests are retried by the SDK
+	s.Throttle(1)
+	err = Upload(b.(backend.Multipart), st, key, bytes.NewReader(data), map[string]string{"Nonce": "abc"}, &progress.Counter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	size, err := crypt.EncryptedSize(int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := b.Head("object")
+	if err != nil || res.Metadata["Nonce"] != "abc" || res.Size != size {
+		t.Fatalf("Head() = %+v, %v", res, err)
+	}
+
+	if !bytes.Equal(stored(t, b, key), data) {
+		t.Error("stored content does not match the source")
+	}
+}
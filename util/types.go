@@ -9,6 +9,6 @@ type WriterAtFake struct {
 	// w is the underlying io.Writer that WriterAtFake proxies writes to.
 	w io.Writer
 
-	// f is a flag used to indicate whether the writer had received no writes (true) or had its first byte wtitten (false).
-	f *bool
+	// n is the number of header bytes validated and omitted so far, writes are passed through once it reaches two.
+	n *int
 }
@@ -11,8 +11,11 @@ import (
 	"github.com/mgren/ogive/profile"
 	"github.com/minio/sio"
 	"io"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 )
 
 // GetDefaultProfileLoc returns the default ogive profile location
@@ -20,6 +23,11 @@ func GetDefaultProfileLoc() string {
 	return filepath.Join(os.Getenv("HOME"), ".ogive")
 }
 
+// GetStateDir returns the directory holding local state belonging to a profile, such as upload checkpoints.
+func GetStateDir(profile string) string {
+	return profile + ".d"
+}
+
 // SizeIEC transforms a bytesize into an approximate (1 decimal place) IEC-compliant representation.
 // It supports sizes up to 1000 TiB which is more than plenty for S3 maximum of 5 TB
 func SizeIEC(b int64) string {
@@ -37,36 +45,75 @@ func SizeIEC(b int64) string {
 	return fmt.Sprintf("%.1f %ciB", float64(b)/float64(div), "KMGT"[exp])
 }
 
+// DurationShort transforms a duration into an approximate representation with two units at most, ex. "2d 5h" or "5h 12m".
+// Negative durations are represented as "0m".
+func DurationShort(d time.Duration) string {
+	m := int64(d / time.Minute)
+	if m < 0 {
+		m = 0
+	}
+
+	days, hours, mins := m/(24*60), m/60%24, m%60
+
+	switch {
+	case days > 0:
+		return fmt.Sprintf("%dd %dh", days, hours)
+	case hours > 0:
+		return fmt.Sprintf("%dh %dm", hours, mins)
+	}
+
+	return fmt.Sprintf("%dm", mins)
+}
+
 // WriteAt is a dummy positional writer method. It ignores the offset and writes into the original Writer sequentially.
 // This implementation is ogive-specific and omits first two bytes, making sure they are 0x20 0x00.
+// The header may arrive split across several writes, ex. when copying from a network stream.
 // See ogive/cmd/get.go source code for an explanation.
 func (w WriterAtFake) WriteAt(p []byte, offset int64) (s int, err error) {
-	if offset == 0 && *w.f {
-		if p[0] != byte(sio.Version20) || p[1] != byte(sio.AES_256_GCM) {
-			return 2, fmt.Errorf("Wrong start of header %x %x", p[0], p[1])
+	header := [2]byte{byte(sio.Version20), byte(sio.AES_256_GCM)}
+	for *w.n < len(header) && s < len(p) {
+		if p[s] != header[*w.n] {
+			return s, fmt.Errorf("Wrong start of header, byte %d is %x", *w.n, p[s])
 		}
-		*w.f = false
-		s, err = w.w.Write(p[2:])
-		s += 2
+		*w.n++
+		s++
+	}
+
+	if s == len(p) {
 		return
 	}
-	return w.w.Write(p)
+
+	n, err := w.w.Write(p[s:])
+	return s + n, err
+}
+
+// Write writes into the original Writer sequentially, same as WriteAt would.
+func (w WriterAtFake) Write(p []byte) (int, error) {
+	return w.WriteAt(p, 0)
 }
 
 // NewWriterAtFake wraps an io.Writer into a dummy io.WriterAt interface.
 func NewWriterAtFake(w io.Writer) WriterAtFake {
-	f := true
-	return WriterAtFake{w, &f}
+	return WriterAtFake{w, new(int)}
 }
 
 // GetSession uses ogive profile data to create a new AWS session.
+// Path-style bucket addressing is used for endpoints outside of amazonaws.com,
+// since S3-compatible services (and local stand-ins) can't be relied on to resolve bucket subdomains.
 func GetSession(i *profile.InnerData) *session.Session {
 	defer i.AWSKeyId.Destroy()
 	defer i.AWSSecret.Destroy()
+
+	pathStyle := true
+	if u, err := url.Parse(i.Endpoint); err == nil {
+		pathStyle = !strings.HasSuffix(u.Hostname(), ".amazonaws.com")
+	}
+
 	return session.New(&aws.Config{
-		Region:      &i.Region,
-		Credentials: credentials.NewStaticCredentials(string(i.AWSKeyId.Buffer()), string(i.AWSSecret.Buffer()), ""),
-		Endpoint:    &i.Endpoint,
+		Region:           &i.Region,
+		Credentials:      credentials.NewStaticCredentials(string(i.AWSKeyId.Buffer()), string(i.AWSSecret.Buffer()), ""),
+		Endpoint:         &i.Endpoint,
+		S3ForcePathStyle: &pathStyle,
 	})
 }
 
@@ -75,7 +122,12 @@ func GetSession(i *profile.InnerData) *session.Session {
 // For files between 500 MiB and 5 000 MiB part size grows dynamically to create a 100-part upload
 // For files between 5 000 MiB and 50 000 MiB the part size is 50 MiB and part count increases
 // For files more than 50 000 MiB part count is 10 000 and part size starts to grow again
+// For streams of unknown size (indicated by a negative size) part size is 64 MiB, which allows for uploads up to 625 GiB
 func GetPartSize(size int64) int64 {
+	if size < 0 {
+		return 64 << 20
+	}
+
 	partSize := size / 100
 	def := int64(50 << 20)
 
@@ -0,0 +1,55 @@
+package util
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestWriterAtFakeSplitHeader(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriterAtFake(&buf)
+
+	for _, p := range [][]byte{{0x20}, {0x00, 'a'}, {'b', 'c'}} {
+		if n, err := w.Write(p); err != nil || n != len(p) {
+			t.Fatalf("Write(%x) = %d, %v", p, n, err)
+		}
+	}
+
+	if buf.String() != "abc" {
+		t.Errorf("got %q, want %q", buf.String(), "abc")
+	}
+}
+
+func TestWriterAtFakeWrongHeader(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriterAtFake(&buf)
+
+	if _, err := w.Write([]byte{0x20}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte{0x01, 'a'}); err == nil {
+		t.Error("expected an error for a wrong header")
+	}
+	if buf.Len() != 0 {
+		t.Errorf("wrote %q past a wrong header", buf.String())
+	}
+}
+
+func TestDurationShort(t *testing.T) {
+	for _, c := range []struct {
+		d    time.Duration
+		want string
+	}{
+		{-time.Hour, "0m"},
+		{59 * time.Second, "0m"},
+		{12 * time.Minute, "12m"},
+		{5*time.Hour + 12*time.Minute + 30*time.Second, "5h 12m"},
+		{24 * time.Hour, "1d 0h"},
+		{53*time.Hour + 59*time.Minute, "2d 5h"},
+	} {
+		if got := DurationShort(c.d); got != c.want {
+			t.Errorf("DurationShort(%v) = %q, want %q", c.d, got, c.want)
+		}
+	}
+}